@@ -0,0 +1,267 @@
+// The agent which runs a cluster's services on a single Docker host.
+package daprdockr
+
+import (
+	"context"
+	goerrors "errors"
+	dockerclient "github.com/fsouza/go-dockerclient"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultUpdateThrottleInterval = 2 * time.Second
+	AgentShutdownTimeout          = 60 // Seconds to wait for the components to stop before leaving the cluster.
+)
+
+var agentLog = NewLogger("Agent")
+
+// Configures an agent. Only the store and either the runtime or the Docker client are required.
+type AgentOptions struct {
+	Store        Store // Holds the cluster's configuration and state, eg: NewEtcdStore(etcd.NewClient(machines)).
+	DockerClient *dockerclient.Client
+
+	// Runs the instances' containers, eg: NewFakeRuntime(). Default: NewDockerRuntime(DockerClient).
+	Runtime Runtime
+
+	// Runs the instances of services which select RuntimeProcess. Default: NewProcessRuntime(DefaultProcessStateDir).
+	ProcessRuntime Runtime
+
+	// The IP address of the Docker host, advertised for local instances and used as their DNS server.
+	// Discovered from the route file if not provided.
+	HostIp net.IP
+
+	// The host's IPv4 route file, used to discover the host IP. Default: DefaultRoute4FilePath.
+	RouteFile string
+
+	// Identifier of the node, unique within the cluster. Default: the host IP address.
+	NodeId string
+
+	// Port of the agent's HTTP endpoint, bound to the host IP. Default: DefaultAgentHttpPort.
+	HttpPort string
+
+	// Minimum interval between updates passed to each component. Default: DefaultUpdateThrottleInterval.
+	UpdateThrottleInterval time.Duration
+
+	// What happens to the managed containers when the agent stops. Default: ExitStop.
+	OnExit ExitMode
+
+	// The DNS zone which instances are named within, eg: "svc.prod.internal". Containers are named
+	// "<instance>.<service>.<group>.<zone>", so only containers named within the zone are managed. Default: DefaultZone.
+	Zone string
+
+	// Addresses which the DNS server listens on over both UDP and TCP, as "[host]:port". Default: DefaultDnsAddr.
+	DnsAddrs []string
+
+	// Secondary DNS servers, as "ip[:port]", which may transfer the zone and are notified when it changes.
+	DnsSecondaries []string
+
+	// DNS servers which queries outside the zone are forwarded to, as "host[:port]".
+	// Default: the servers in DefaultResolvConf.
+	DnsUpstreams []string
+
+	// Receives non-fatal errors from the load balancer and DNS server, if provided. Must be drained.
+	Errors chan error
+}
+
+// An agent, which runs the instances assigned to its host and serves DNS, load balancing and its HTTP endpoint.
+// Agents share no state other than the logging configuration, so several may run in one process.
+type Agent struct {
+	store            Store
+	runtime          Runtime
+	hostIp           net.IP
+	nodeId           string
+	httpAddr         string
+	throttleInterval time.Duration
+	onExit           ExitMode
+	errors           *chan error
+	instances        *instances
+	exits            *containerExits
+	serviceConfigs   *serviceConfigs
+	state            *agentState
+	metrics          *agentMetrics
+	dnsMux           *dns.ServeMux
+	dnsUpstreams     []string
+	dnsAddrs         []string
+	dnsSecondaries   []string
+	dnsZone          *dnsZoneVersions
+	zone             string
+	dnsIndex         atomic.Value // The current *dnsIndex, once the DNS server has received the instances.
+}
+
+// Creates an agent from the provided options, applying defaults to those which are not set.
+// Each agent has its own metrics, but the logging configuration, such as that set by SetLogLevels and SetLogNode,
+// belongs to the process, so agents in one process share log levels and their entries are tagged with the same node.
+func NewAgent(options AgentOptions) (agent *Agent, err error) {
+	if options.Store == nil || (options.Runtime == nil && options.DockerClient == nil) {
+		err = goerrors.New("Agent requires a store and either a runtime or a Docker client")
+		return
+	}
+
+	hostIp := options.HostIp
+	if len(hostIp) == 0 {
+		routeFile := options.RouteFile
+		if len(routeFile) == 0 {
+			routeFile = DefaultRoute4FilePath
+		}
+		if hostIp, err = InternetRoutedIp(routeFile); err != nil {
+			return
+		}
+	}
+
+	agent = &Agent{
+		store:            options.Store,
+		hostIp:           append(net.IP(nil), hostIp...),
+		nodeId:           options.NodeId,
+		throttleInterval: options.UpdateThrottleInterval,
+		onExit:           options.OnExit,
+		instances:        newInstances(),
+		exits:            newContainerExits(),
+		serviceConfigs:   newServiceConfigs(),
+		state:            newAgentState(),
+		metrics:          newAgentMetrics(),
+		dnsMux:           dns.NewServeMux(),
+		dnsUpstreams:     dnsUpstreamAddrs(options.DnsUpstreams),
+		dnsAddrs:         options.DnsAddrs,
+		dnsSecondaries:   dnsUpstreamAddrs(options.DnsSecondaries),
+		dnsZone:          newDnsZoneVersions(),
+		zone:             strings.ToLower(strings.Trim(options.Zone, ".")),
+	}
+	if len(agent.zone) == 0 {
+		agent.zone = DefaultZone
+	}
+	if _, ok := dns.IsDomainName(agent.zone); !ok {
+		return nil, goerrors.New("Invalid zone: " + options.Zone)
+	}
+	for _, secondary := range agent.dnsSecondaries {
+		if host, _, _ := net.SplitHostPort(secondary); net.ParseIP(host) == nil {
+			return nil, goerrors.New("DNS secondary must be an IP address: " + secondary)
+		}
+	}
+	if len(agent.dnsAddrs) == 0 {
+		agent.dnsAddrs = []string{DefaultDnsAddr}
+	}
+	containerRuntime, processRuntime := options.Runtime, options.ProcessRuntime
+	if containerRuntime == nil {
+		containerRuntime = NewDockerRuntime(options.DockerClient)
+	}
+	if processRuntime == nil {
+		processRuntime = NewProcessRuntime(DefaultProcessStateDir)
+	}
+	agent.runtime = newRuntimeSet(map[string]Runtime{RuntimeDocker: containerRuntime, RuntimeProcess: processRuntime})
+	if len(agent.nodeId) == 0 {
+		agent.nodeId = hostIp.String()
+	}
+	httpPort := options.HttpPort
+	if len(httpPort) == 0 {
+		httpPort = DefaultAgentHttpPort
+	}
+	agent.httpAddr = net.JoinHostPort(hostIp.String(), httpPort)
+	if agent.throttleInterval <= 0 {
+		agent.throttleInterval = DefaultUpdateThrottleInterval
+	}
+	if len(agent.onExit) == 0 {
+		agent.onExit = ExitStop
+	}
+	if options.Errors != nil {
+		agent.errors = &options.Errors
+	}
+	return
+}
+
+// Gets the DNS zone which instances are named within, eg: "container".
+func (this *Agent) Zone() string {
+	return this.zone
+}
+
+// Gets the IP address of the Docker host.
+func (this *Agent) HostIp() net.IP {
+	return this.hostIp
+}
+
+// Gets the identifier of the node.
+func (this *Agent) NodeId() string {
+	return this.nodeId
+}
+
+// Gets the address which the agent's HTTP endpoint listens on.
+func (this *Agent) HttpAddr() string {
+	return this.httpAddr
+}
+
+// Returns a copy of the agent's current view of the cluster and of its local components.
+func (this *Agent) State() AgentStateSnapshot {
+	return this.state.Snapshot()
+}
+
+// Runs the agent's components until the context is cancelled or any component fails, then leaves the cluster
+// according to the exit mode. Returns the error of the component which failed, if any.
+func (this *Agent) Run(ctx context.Context) (err error) {
+	componentCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	instanceUpdates := []chan map[string]*Instance{
+		make(chan map[string]*Instance),
+		make(chan map[string]*Instance),
+		make(chan map[string]*Instance),
+	}
+	serviceConfigUpdates := make(chan map[string]*ServiceConfig)
+	requiredChanges := make(chan map[string]*RequiredStateChange)
+
+	result := make(chan error, 1)
+	go func() {
+		result <- RunComponents(componentCtx,
+			// Push changes from the local Docker instance into the store.
+			this.PushStateChangesIntoStore,
+
+			// Pull changes to the currently running instances and configurations.
+			func(ctx context.Context) error { return this.LatestInstances(ctx, instanceUpdates) },
+			func(ctx context.Context) error { return this.LatestServiceConfigs(ctx, serviceConfigUpdates) },
+
+			// Pull required state changes from the store and attempt to apply them locally.
+			func(ctx context.Context) error {
+				return this.RequiredStateChanges(ctx, instanceUpdates[0], serviceConfigUpdates, requiredChanges)
+			},
+			func(ctx context.Context) error { return this.ApplyRequiredStateChanges(ctx, requiredChanges) },
+
+			// Start a DNS server so that the addresses of service instances can be resolved.
+			func(ctx context.Context) error { return this.StartDnsServer(ctx, instanceUpdates[1]) },
+
+			// Start an HTTP load balancer so that configured sites can be correctly served.
+			func(ctx context.Context) error { return this.StartLoadBalancer(ctx, instanceUpdates[2]) },
+
+			// Serve requests for the containers managed by this agent.
+			this.StartAgentHttpServer)
+	}()
+
+	agentLog.Info("Started", "node", this.nodeId, "host", this.hostIp, "agent", this.httpAddr)
+	select {
+	case err = <-result:
+		agentLog.Error("Component failed, stopping", "error", err, "onExit", this.onExit)
+	case <-ctx.Done():
+		agentLog.Info("Stopping", "onExit", this.onExit)
+		select {
+		case err = <-result:
+		case <-time.After(AgentShutdownTimeout * time.Second):
+			agentLog.Warn("Timed out waiting for components to stop")
+		}
+	}
+
+	// Remove this node's records so that other agents can take over promptly.
+	if leaveErr := this.LeaveCluster(this.onExit); leaveErr != nil {
+		agentLog.Error("Failed to leave cluster", "error", leaveErr)
+		if err == nil {
+			err = leaveErr
+		}
+	}
+	agentLog.Info("Stopped")
+	return
+}
+
+// Creates an event concerning an instance on this agent's node.
+func (this *Agent) newInstanceEvent(eventType EventType, group, service string, instance int, reason string) *Event {
+	return newInstanceEvent(this.nodeId, eventType, group, service, instance, reason)
+}
@@ -0,0 +1,121 @@
+// HTTP endpoint exposed by each agent.
+package daprdockr
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultAgentHttpPort    = "4280"
+	AgentStatePath          = "/state"
+	AgentLookupPath         = "/lookup" // Finds the instance which a host address and port belong to, eg: "/lookup?addr=10.0.0.1:49153".
+	AgentHttpShutdownPeriod = 5         // Seconds to wait for requests to complete when stopping.
+)
+
+var agentHttpLog = NewLogger("AgentHttp")
+
+// Start the agent's HTTP endpoint so that other hosts can query the containers which this agent manages and
+// so that the agent's view of the cluster can be inspected. Serves until the context is done or the listener fails.
+func (this *Agent) StartAgentHttpServer(ctx context.Context) (err error) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(ContainerLogsPath, createContainerLogsHandler(this.runtime, this.zone))
+	mux.HandleFunc(MetricsPath, this.serveMetrics)
+	mux.HandleFunc(AgentStatePath, this.createStateHandler(func(state *AgentStateSnapshot) interface{} { return state }))
+	mux.HandleFunc(AgentStatePath+"/instances", this.createStateHandler(func(state *AgentStateSnapshot) interface{} { return state.Instances }))
+	mux.HandleFunc(AgentStatePath+"/configs", this.createStateHandler(func(state *AgentStateSnapshot) interface{} { return state.ServiceConfigs }))
+	mux.HandleFunc(AgentStatePath+"/changes", this.createStateHandler(func(state *AgentStateSnapshot) interface{} { return state.RequiredChanges }))
+	mux.HandleFunc(AgentStatePath+"/containers", this.createStateHandler(func(state *AgentStateSnapshot) interface{} { return state.Containers }))
+	mux.HandleFunc(AgentStatePath+"/loadbalancer", this.createStateHandler(func(state *AgentStateSnapshot) interface{} { return state.LoadBalancer }))
+	mux.HandleFunc(AgentStatePath+"/dns", this.createStateHandler(func(state *AgentStateSnapshot) interface{} { return state.Dns }))
+	mux.HandleFunc(AgentLookupPath, this.handleLookup)
+
+	server := &http.Server{Addr: this.httpAddr, Handler: mux}
+	result := make(chan error, 1)
+	go func() {
+		agentHttpLog.Info("Listening", "addr", this.httpAddr)
+		result <- server.ListenAndServe()
+	}()
+
+	select {
+	case err = <-result:
+		return
+	case <-ctx.Done():
+	}
+
+	// Give in-flight requests a moment to complete, then close any which remain, such as followed logs.
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), AgentHttpShutdownPeriod*time.Second)
+	defer cancel()
+	if server.Shutdown(shutdownCtx) != nil {
+		server.Close()
+	}
+	if err = <-result; err == http.ErrServerClosed {
+		err = nil
+	}
+	return
+}
+
+// Creates a handler which responds with the selected part of the agent's state, encoded as JSON.
+func (this *Agent) createStateHandler(selector func(*AgentStateSnapshot) interface{}) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method != "GET" && request.Method != "HEAD" {
+			http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		state := this.state.Snapshot()
+		payload, err := json.MarshalIndent(selector(&state), "", "  ")
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Write(payload)
+	}
+}
+
+// Responds with the instance which the host address and port in the "addr" parameter are mapped to, encoded as JSON.
+// The "protocol" parameter selects UDP ports rather than TCP ports.
+func (this *Agent) handleLookup(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" && request.Method != "HEAD" {
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	host, port, err := net.SplitHostPort(request.FormValue("addr"))
+	ip := net.ParseIP(host)
+	if err != nil || ip == nil {
+		http.Error(writer, "The addr parameter must be an address and port, eg: 10.0.0.1:49153", http.StatusBadRequest)
+		return
+	}
+	protocol := strings.ToLower(request.FormValue("protocol"))
+	if len(protocol) == 0 {
+		protocol = "tcp"
+	}
+	if protocol != "tcp" && protocol != "udp" {
+		http.Error(writer, "The protocol parameter must be tcp or udp", http.StatusBadRequest)
+		return
+	}
+
+	index := this.currentDnsIndex()
+	if index == nil {
+		http.Error(writer, "Instances are not yet known", http.StatusServiceUnavailable)
+		return
+	}
+	owner := index.hostPort(ip, port, protocol)
+	if owner == nil {
+		http.Error(writer, "No instance is mapped to "+net.JoinHostPort(ip.String(), port)+"/"+protocol, http.StatusNotFound)
+		return
+	}
+	payload, err := json.MarshalIndent(owner, "", "  ")
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(payload)
+}
@@ -0,0 +1,127 @@
+package daprdockr
+
+import (
+	"sync"
+	"time"
+)
+
+// A locally managed container.
+type LocalContainer struct {
+	ID       string
+	Name     string
+	Runtime  string
+	Image    string
+	Status   string
+	Instance *Instance
+}
+
+type LoadBalancerStatus struct {
+	Running      bool
+	Pid          int
+	Started      time.Time
+	LastReload   time.Time
+	LastExit     time.Time
+	LastError    string
+	Sites        []SiteConfig
+	ConfigFile   string
+	ConfigUpdate time.Time
+}
+
+type DnsStatus struct {
+	Listening  map[string]bool // Map from address and network, eg: ":53/udp", to whether the server is listening on it.
+	Errors     map[string]string
+	Instances  int
+	Records    int // Static records.
+	LastUpdate time.Time
+}
+
+type RequiredStateChangeStatus struct {
+	Computed time.Time
+	Changes  map[string]*RequiredStateChange
+}
+
+// The agent's current view of the cluster and of its local components.
+type AgentStateSnapshot struct {
+	Instances       map[string]*Instance
+	ServiceConfigs  map[string]*ServiceConfig
+	RequiredChanges RequiredStateChangeStatus
+	Containers      []*LocalContainer
+	LoadBalancer    LoadBalancerStatus
+	Dns             DnsStatus
+}
+
+type agentState struct {
+	lock     sync.RWMutex
+	snapshot AgentStateSnapshot
+}
+
+func newAgentState() (state *agentState) {
+	state = &agentState{}
+	state.snapshot.Instances = make(map[string]*Instance)
+	state.snapshot.ServiceConfigs = make(map[string]*ServiceConfig)
+	state.snapshot.RequiredChanges.Changes = make(map[string]*RequiredStateChange)
+	state.snapshot.Containers = make([]*LocalContainer, 0)
+	state.snapshot.Dns.Listening = make(map[string]bool)
+	state.snapshot.Dns.Errors = make(map[string]string)
+	return
+}
+
+// Returns a copy of the current state.
+func (this *agentState) Snapshot() (snapshot AgentStateSnapshot) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	snapshot = this.snapshot
+	snapshot.Dns.Listening = make(map[string]bool)
+	for k, v := range this.snapshot.Dns.Listening {
+		snapshot.Dns.Listening[k] = v
+	}
+	snapshot.Dns.Errors = make(map[string]string)
+	for k, v := range this.snapshot.Dns.Errors {
+		snapshot.Dns.Errors[k] = v
+	}
+	return
+}
+
+func (this *agentState) setInstances(instances map[string]*Instance) {
+	copied := make(map[string]*Instance, len(instances))
+	for k, v := range instances {
+		copied[k] = v
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.snapshot.Instances = copied
+}
+
+func (this *agentState) setServiceConfigs(configs map[string]*ServiceConfig) {
+	copied := make(map[string]*ServiceConfig, len(configs))
+	for k, v := range configs {
+		copied[k] = v
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.snapshot.ServiceConfigs = copied
+}
+
+func (this *agentState) setRequiredChanges(changes map[string]*RequiredStateChange) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.snapshot.RequiredChanges = RequiredStateChangeStatus{Computed: time.Now(), Changes: changes}
+}
+
+func (this *agentState) setContainers(containers []*LocalContainer) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.snapshot.Containers = containers
+}
+
+func (this *agentState) updateLoadBalancer(update func(status *LoadBalancerStatus)) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	update(&this.snapshot.LoadBalancer)
+}
+
+func (this *agentState) updateDns(update func(status *DnsStatus)) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	update(&this.snapshot.Dns)
+}
@@ -0,0 +1,108 @@
+package daprdockr
+
+import (
+	goerrors "errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	ContainerLogsPath = "/logs/"
+)
+
+var containerLogsLog = NewLogger("ContainerLogs")
+
+type ContainerLogsOptions struct {
+	Tail   string // Number of lines to output from the end of the logs, or "all".
+	Follow bool   // Continue streaming new output until the container stops.
+}
+
+// Streams the logs of an instance from the agent which manages it. The name may be followed by the provided zone.
+func GetContainerLogs(store Store, name, zone string, options ContainerLogsOptions, output io.Writer) (err error) {
+	group, service, instanceNum, err := ParseInstanceQualifiedName(name, zone)
+	if err != nil {
+		return
+	}
+	instance, err := GetInstance(store, group, service, instanceNum)
+	if err != nil {
+		return
+	}
+	if len(instance.Agent) == 0 {
+		err = goerrors.New("Instance " + instance.QualifiedName() + " does not report the address of its agent")
+		return
+	}
+
+	query := url.Values{}
+	if len(options.Tail) > 0 {
+		query.Set("tail", options.Tail)
+	}
+	query.Set("follow", strconv.FormatBool(options.Follow))
+	response, err := http.Get("http://" + instance.Agent + ContainerLogsPath + instance.QualifiedName() + "?" + query.Encode())
+	if err != nil {
+		return
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(response.Body)
+		err = goerrors.New("Agent " + instance.Agent + " responded with " + response.Status + ": " + strings.TrimSpace(string(message)))
+		return
+	}
+
+	_, err = io.Copy(output, response.Body)
+	return
+}
+
+// Creates a handler which streams the logs of locally managed containers.
+func createContainerLogsHandler(runtime Runtime, zone string) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		group, service, instance, err := ParseInstanceQualifiedName(strings.TrimPrefix(request.URL.Path, ContainerLogsPath), zone)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		id := &ServiceIdentifier{Name: service, Group: group}
+		name := id.FullyQualifiedDomainName(instance, zone)
+		if _, err = runtime.InspectContainer(name); err != nil {
+			http.Error(writer, "Container "+name+" is not managed by this agent", http.StatusNotFound)
+			return
+		}
+
+		tail := request.FormValue("tail")
+		if len(tail) == 0 {
+			tail = "all"
+		}
+		follow, _ := strconv.ParseBool(request.FormValue("follow"))
+
+		writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		output := &flushingWriter{writer: writer}
+		output.flusher, _ = writer.(http.Flusher)
+		err = runtime.ContainerLogs(name, ContainerLogsOptions{Tail: tail, Follow: follow}, output)
+		if err != nil {
+			containerLogsLog.WithInstance(group, service, instance).Warn("Error streaming logs", "error", err)
+		}
+	}
+}
+
+// Writes to an HTTP response, flushing after each write so that followed logs are streamed promptly.
+type flushingWriter struct {
+	lock    sync.Mutex
+	writer  io.Writer
+	flusher http.Flusher
+}
+
+func (this *flushingWriter) Write(p []byte) (n int, err error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	n, err = this.writer.Write(p)
+	if this.flusher != nil {
+		this.flusher.Flush()
+	}
+	return
+}
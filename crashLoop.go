@@ -0,0 +1,176 @@
+// Crash-loop detection and restart backoff.
+package daprdockr
+
+import (
+	"encoding/json"
+	goerrors "errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	CrashLoopMinimumUptime  = 60      // Seconds. Containers which exit sooner are considered to have crashed.
+	CrashLoopThreshold      = 3       // Consecutive failures after which an instance is reported as crash-looping.
+	RestartBackoffInitial   = 15      // Seconds
+	RestartBackoffMaximum   = 15 * 60 // Seconds
+	RestartRecordTimeToLive = 60 * 60 // Seconds after the backoff ends at which the record is forgotten.
+	RestartRecordRetries    = 5       // Attempts to record a failure while other agents update the same record.
+	maxRecordedFailures     = 10
+)
+
+var crashLoopLog = NewLogger("CrashLoop")
+
+// The failure history of an instance.
+type RestartRecord struct {
+	Group        string      `json:"-"`
+	Service      string      `json:"-"`
+	Instance     int         `json:"-"`
+	Restarts     int         // Consecutive failures, each of which led to a restart.
+	Failures     []time.Time // Times of the most recent failures.
+	LastReason   string
+	BackoffUntil time.Time // The instance is not scheduled before this time.
+	index        uint64    // The store index of the record, or zero if it is not stored.
+}
+
+// Determines whether the instance keeps failing shortly after being started.
+func (this *RestartRecord) CrashLooping() bool {
+	return this.Restarts >= CrashLoopThreshold
+}
+
+// Determines whether the instance must not be scheduled at the provided time.
+func (this *RestartRecord) InBackoff(now time.Time) bool {
+	return now.Before(this.BackoffUntil)
+}
+
+// Returns the backoff which follows the provided number of consecutive failures.
+func restartBackoff(restarts int) time.Duration {
+	backoff := RestartBackoffInitial * time.Second
+	for i := 1; i < restarts && backoff < RestartBackoffMaximum*time.Second; i++ {
+		backoff *= 2
+	}
+	if backoff > RestartBackoffMaximum*time.Second {
+		backoff = RestartBackoffMaximum * time.Second
+	}
+	return backoff
+}
+
+func restartsPath(group, service string, instance int) string {
+	return "restarts/" + group + "/" + service + "/" + strconv.Itoa(instance)
+}
+
+// Gets the failure history of an instance, or nil if it has not failed recently.
+func GetRestartRecord(store Store, group, service string, instance int) (record *RestartRecord, err error) {
+	node, err := store.Get(restartsPath(group, service, instance))
+	if isStoreError(err, StoreKeyNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return
+	}
+	return parseRestartRecord(node)
+}
+
+// Gets the failure histories of all recently failed instances of a service, by instance.
+func GetRestartRecords(store Store, group, service string) (records map[int]*RestartRecord, err error) {
+	records = make(map[int]*RestartRecord)
+	nodes, err := store.List("restarts/" + group + "/" + service)
+	if err != nil {
+		return
+	}
+	for _, node := range nodes {
+		record, err := parseRestartRecord(node)
+		if err != nil {
+			crashLoopLog.Warn("Unable to parse restart record", "key", node.Key, "error", err)
+			continue
+		}
+		records[record.Instance] = record
+	}
+	return
+}
+
+// Records a failure of an instance on the provided node, extending its backoff. The record is updated with
+// compare-and-swap, and read again if another agent updated it first, so that no failure is lost.
+func RecordInstanceFailure(store Store, node, group, service string, instance int, reason string) (record *RestartRecord, err error) {
+	var backoff time.Duration
+	for attempt := 1; ; attempt++ {
+		record, err = GetRestartRecord(store, group, service, instance)
+		if err != nil {
+			return
+		}
+		if record == nil {
+			record = &RestartRecord{Group: group, Service: service, Instance: instance}
+		}
+
+		now := time.Now().UTC()
+		record.Restarts++
+		record.Failures = append(record.Failures, now)
+		if len(record.Failures) > maxRecordedFailures {
+			record.Failures = record.Failures[len(record.Failures)-maxRecordedFailures:]
+		}
+		record.LastReason = reason
+		backoff = restartBackoff(record.Restarts)
+		record.BackoffUntil = now.Add(backoff)
+
+		var payload []byte
+		if payload, err = json.Marshal(record); err != nil {
+			return
+		}
+		key := restartsPath(group, service, instance)
+		ttl := uint64(backoff/time.Second) + RestartRecordTimeToLive
+		if record.index > 0 {
+			record.index, err = store.CompareAndSwap(key, string(payload), ttl, record.index)
+		} else {
+			record.index, err = store.Create(key, string(payload), ttl)
+		}
+
+		// The record was written, expired or reset since it was read.
+		conflict := isStoreError(err, StoreTestFailed) || isStoreError(err, StoreNodeExists) || isStoreError(err, StoreKeyNotFound)
+		if !conflict || attempt >= RestartRecordRetries {
+			break
+		}
+	}
+	if err != nil {
+		return
+	}
+
+	logger := crashLoopLog.WithInstance(group, service, instance)
+	if record.CrashLooping() {
+		logger.Warn("Instance is crash-looping", "restarts", record.Restarts, "backoff", backoff, "reason", reason)
+		if record.Restarts == CrashLoopThreshold {
+			journal(store, newInstanceEvent(node, InstanceCrashLooping, group, service, instance, "Failed "+strconv.Itoa(record.Restarts)+" times: "+reason))
+		}
+	} else {
+		logger.Info("Instance failed", "restarts", record.Restarts, "backoff", backoff, "reason", reason)
+	}
+	return
+}
+
+// Forgets the failure history of an instance which has been running stably.
+func ResetInstanceFailures(store Store, group, service string, instance int) (err error) {
+	err = store.Delete(restartsPath(group, service, instance))
+	if isStoreError(err, StoreKeyNotFound) {
+		err = nil
+	}
+	return
+}
+
+func parseRestartRecord(node *StoreNode) (record *RestartRecord, err error) {
+	keyParts := strings.Split(node.Key, "/")
+	if len(keyParts) != 4 {
+		err = goerrors.New("Restart record key invalid: " + node.Key)
+		return
+	}
+	record = new(RestartRecord)
+	record.Group = keyParts[1]
+	record.Service = keyParts[2]
+	record.Instance, err = strconv.Atoi(keyParts[3])
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal([]byte(node.Value), record); err != nil {
+		return
+	}
+	record.index = node.Index
+	return
+}
@@ -0,0 +1,96 @@
+package daprdockr
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// Applies the changes, returning once they have all been applied.
+func applyChanges(agent *Agent, changes ...map[string]*RequiredStateChange) error {
+	requiredChanges := make(chan map[string]*RequiredStateChange, len(changes))
+	for _, change := range changes {
+		requiredChanges <- change
+	}
+	close(requiredChanges)
+	return agent.ApplyRequiredStateChanges(context.Background(), requiredChanges)
+}
+
+// A container which crashes before the watcher next polls is never seen running, so its exit must be recorded when
+// the instance is next started.
+func TestContainerCrashingWithinPollIntervalBacksOff(t *testing.T) {
+	store, runtime := NewMemoryStore(), NewFakeRuntime()
+	agent := newTestAgent(t, store, runtime, "node-1")
+	config := newTestServiceConfig(1)
+	container, err := runtime.CreateContainer(&ContainerSpec{Name: config.FullyQualifiedDomainName(0, agent.Zone()), Config: config.Container})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = runtime.StartContainer(container.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err = runtime.Crash(container.ID, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	add := map[string]*RequiredStateChange{"0.api.web": {ServiceConfig: config, Instance: 0, Operation: Add}}
+	if err = applyChanges(agent, add, add); err != nil {
+		t.Fatal(err)
+	}
+
+	record, err := GetRestartRecord(store, "web", "api", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record == nil || !record.InBackoff(time.Now()) {
+		t.Fatalf("Expected the instance to be backing off, got %+v", record)
+	}
+	if record.Restarts != 1 || record.LastReason != "Exited with code 1" {
+		t.Errorf("Expected one failure with exit code 1, got %d: %q", record.Restarts, record.LastReason)
+	}
+	if containers, _ := runtime.ListContainers(); len(containers) != 0 {
+		t.Errorf("Expected the instance not to be recreated while backing off, got %d running containers", len(containers))
+	}
+	if current, err := runtime.InspectContainer(container.ID); err != nil || current.Running {
+		t.Errorf("Expected the crashed container to be kept until the backoff ends, got %+v, %v", current, err)
+	}
+}
+
+// A store in which another agent records a failure of the same instance just before each of the first writes.
+type contendedRestartStore struct {
+	Store
+	contentions int
+}
+
+func (this *contendedRestartStore) contend() {
+	if this.contentions > 0 {
+		this.contentions--
+		RecordInstanceFailure(this.Store, "node-2", "web", "api", 0, "Exited with code 2")
+	}
+}
+
+func (this *contendedRestartStore) Create(key, value string, ttl uint64) (index uint64, err error) {
+	this.contend()
+	return this.Store.Create(key, value, ttl)
+}
+
+func (this *contendedRestartStore) CompareAndSwap(key, value string, ttl uint64, prevIndex uint64) (index uint64, err error) {
+	this.contend()
+	return this.Store.CompareAndSwap(key, value, ttl, prevIndex)
+}
+
+// Failures which agents record at the same time are all counted.
+func TestRecordInstanceFailureRetriesConflicts(t *testing.T) {
+	store := &contendedRestartStore{Store: NewMemoryStore(), contentions: 2}
+	record, err := RecordInstanceFailure(store, "node-1", "web", "api", 0, "Exited with code 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Restarts != 3 {
+		t.Errorf("Expected the failures recorded by the other agent to be counted, got %d restarts", record.Restarts)
+	}
+	stored, err := GetRestartRecord(store, "web", "api", 0)
+	if err != nil || stored == nil || stored.Restarts != 3 || stored.LastReason != "Exited with code 1" || len(stored.Failures) != 3 {
+		t.Errorf("Expected all three failures to be stored, got %+v, %v", stored, err)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/daprlabs/daprdockr"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Runs the named subcommand with the remaining commandline arguments.
+func runCommand(store daprdockr.Store, name string, args []string) error {
+	switch name {
+	case "logs":
+		return logsCommand(store, args)
+	case "events":
+		return eventsCommand(store, args)
+	case "status":
+		return statusCommand(store, args)
+	case "dns":
+		return dnsCommand(store, args)
+	}
+	return errors.New("Unknown command: " + name)
+}
+
+// Streams the logs of an instance from the agent which manages it.
+func logsCommand(store daprdockr.Store, args []string) error {
+	flags := flag.NewFlagSet("logs", flag.ExitOnError)
+	tail := flags.String("tail", "all", "Number of lines to show from the end of the logs, or \"all\".")
+	follow := flags.Bool("f", false, "Follow log output.")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s logs [options] <instance>.<service>.<group>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("Instance not specified")
+	}
+
+	options := daprdockr.ContainerLogsOptions{Tail: *tail, Follow: *follow}
+	return daprdockr.GetContainerLogs(store, flags.Arg(0), *zone, options, os.Stdout)
+}
+
+// Prints the journaled events of a service or instance.
+func eventsCommand(store daprdockr.Store, args []string) error {
+	flags := flag.NewFlagSet("events", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s events <service>.<group> | <instance>.<service>.<group>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("Service or instance not specified")
+	}
+
+	group, service, instance, err := daprdockr.ParseJournalQuery(flags.Arg(0), *zone)
+	if err != nil {
+		return err
+	}
+	events, err := daprdockr.GetEvents(store, group, service, instance)
+	if err != nil {
+		return err
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(writer, "TIME\tEVENT\tINSTANCE\tNODE\tREASON")
+	for _, event := range events {
+		id := &daprdockr.ServiceIdentifier{Name: event.Service, Group: event.Group}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n", event.Time.Local().Format(time.RFC3339), event.Type, id.InstanceQualifiedName(event.Instance), event.Node, event.Reason)
+	}
+	return writer.Flush()
+}
+
+// Prints the state of each instance of a service, including instances which are crash-looping.
+func statusCommand(store daprdockr.Store, args []string) error {
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s status <service>.<group>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("Service not specified")
+	}
+
+	group, service, instance, err := daprdockr.ParseJournalQuery(flags.Arg(0), *zone)
+	if err != nil {
+		return err
+	}
+	if instance >= 0 {
+		return errors.New("Expected <service>.<group>: " + flags.Arg(0))
+	}
+	config, err := daprdockr.GetServiceConfig(store, group, service)
+	if err != nil {
+		return err
+	}
+	records, err := daprdockr.GetRestartRecords(store, group, service)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(writer, "INSTANCE\tSTATE\tRESTARTS\tNEXT ATTEMPT\tDETAIL")
+	for i := 0; i < config.Instances; i++ {
+		name := config.InstanceQualifiedName(i)
+		record := records[i]
+		restarts, next, detail := 0, "-", ""
+		if record != nil {
+			restarts, detail = record.Restarts, record.LastReason
+			if record.InBackoff(now) {
+				next = record.BackoffUntil.Local().Format(time.RFC3339)
+			}
+		}
+
+		var state string
+		if current, err := daprdockr.GetInstance(store, group, service, i); err == nil {
+			state = "running"
+			if len(current.Addrs) > 0 {
+				detail = "on " + current.Addrs[0]
+			}
+		} else if record != nil && record.CrashLooping() {
+			state = "crash-looping"
+		} else if record != nil && record.InBackoff(now) {
+			state = "backing off"
+		} else {
+			state = "pending"
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%d\t%s\t%s\n", name, state, restarts, next, detail)
+	}
+	return writer.Flush()
+}
+
+// Adds, lists or removes the cluster's static DNS records.
+func dnsCommand(store daprdockr.Store, args []string) error {
+	flags := flag.NewFlagSet("dns", flag.ExitOnError)
+	ttl := flags.Uint("ttl", 0, "Seconds which resolvers may cache the record.")
+	priority := flags.Uint("priority", 0, "Priority of an SRV record.")
+	weight := flags.Uint("weight", 0, "Weight of an SRV record.")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s dns list\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s dns add [options] <name> A <address>...\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s dns add [options] <name> CNAME <target>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s dns add [options] <name> SRV <target> <port>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s dns rm <name>\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "Names are relative to the zone. Targets ending with a dot are fully qualified, others are relative to the zone.")
+		flags.PrintDefaults()
+	}
+	if len(args) == 0 {
+		flags.Usage()
+		return errors.New("DNS command not specified")
+	}
+	flags.Parse(args[1:])
+
+	switch args[0] {
+	case "list":
+		records, err := daprdockr.GetDnsRecords(store)
+		if err != nil {
+			return err
+		}
+		names := make([]string, 0, len(records))
+		for name := range records {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(writer, "NAME\tTYPE\tTTL\tDATA")
+		for _, name := range names {
+			record := records[name]
+			data := record.Target
+			switch record.Type {
+			case daprdockr.DnsRecordA:
+				data = strings.Join(record.Addrs, ",")
+			case daprdockr.DnsRecordSrv:
+				data = fmt.Sprintf("%d %d %d %s", record.Priority, record.Weight, record.Port, record.Target)
+			}
+			fmt.Fprintf(writer, "%s\t%s\t%d\t%s\n", record.Name, record.Type, record.Ttl, data)
+		}
+		return writer.Flush()
+	case "add":
+		if flags.NArg() < 3 {
+			flags.Usage()
+			return errors.New("Expected <name> <type> <data>")
+		}
+		record := &daprdockr.DnsRecord{
+			Name:     flags.Arg(0),
+			Type:     strings.ToUpper(flags.Arg(1)),
+			Ttl:      uint32(*ttl),
+			Priority: uint16(*priority),
+			Weight:   uint16(*weight),
+		}
+		data := flags.Args()[2:]
+		switch record.Type {
+		case daprdockr.DnsRecordA:
+			record.Addrs = data
+		case daprdockr.DnsRecordCname:
+			if len(data) != 1 {
+				return errors.New("Expected <name> CNAME <target>")
+			}
+			record.Target = data[0]
+		case daprdockr.DnsRecordSrv:
+			if len(data) != 2 {
+				return errors.New("Expected <name> SRV <target> <port>")
+			}
+			port, err := strconv.ParseUint(data[1], 10, 16)
+			if err != nil {
+				return errors.New("Invalid port: " + data[1])
+			}
+			record.Target, record.Port = data[0], uint16(port)
+		}
+		return daprdockr.SetDnsRecord(store, record)
+	case "rm":
+		if flags.NArg() != 1 {
+			flags.Usage()
+			return errors.New("Name not specified")
+		}
+		return daprdockr.DeleteDnsRecord(store, flags.Arg(0))
+	}
+	flags.Usage()
+	return errors.New("Unknown DNS command: " + args[0])
+}
@@ -4,13 +4,15 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
-	"github.com/coreos/go-etcd/etcd"
 	"github.com/daprlabs/daprdockr"
+	"github.com/dotcloud/docker"
 	"os"
 	"strings"
 )
 
 var etcdAddresses = flag.String("etcd", "http://localhost:5001,http://localhost:5002,http://localhost:5003", "Comma separated list of URLs of the cluster's etcd.")
+var etcdApi = flag.String("etcd-api", "v2", "Version of the etcd API to use, either \"v2\" or \"v3\".")
+var zone = flag.String("zone", daprdockr.DefaultZone, "The cluster's DNS zone, which may follow instance and service names.")
 var set = flag.Bool("set", false, "Set service configuration.")
 var get = flag.Bool("get", true, "Get service configuration.")
 var del = flag.Bool("del", false, "Delete service configuration.")
@@ -21,33 +23,71 @@ var service = flag.String("svc", "", "The service to operate on, in the form \"<
 
 var instances = flag.Int("instances", 0, "The target number of service instances.")
 var image = flag.String("image", "", "The service image in the form accepted by docker.")
-var cmd = flag.String("cmd", "", "The command to run in the container.")
+var cmd = flag.String("cmd", "", "The command to run in the container, or the command line of a process.")
+var runtime = flag.String("runtime", "", "How instances are run: \"docker\" (default) runs the image, \"process\" runs -cmd as a host process.")
+var env envFlag
 var httpPort = flag.String("http-port", "", "The HTTP port within the container for load balancing.")
 var httpHostName = flag.String("http-host", "", "The HTTP hostname used for load balancing this service.")
 var stdIn = flag.Bool("stdin", false, "Read JSON service definition from stdin.")
 
+func init() {
+	flag.Var(&env, "env", "An environment variable in the form NAME=VALUE. May be repeated.")
+}
+
+// Collects repeated flags.
+type envFlag []string
+
+func (this *envFlag) String() string {
+	return strings.Join(*this, ",")
+}
+
+func (this *envFlag) Set(value string) error {
+	*this = append(*this, value)
+	return nil
+}
+
 func main() {
+	os.Exit(run())
+}
+
+// Runs the command, returning the exit code. Deferred cleanup, such as closing the store, runs before the process
+// exits.
+func run() (exitCode int) {
 	flag.Parse()
 	config := new(daprdockr.ServiceConfig)
 	var err error
 
 	if *printIp {
-		ipAddr, err := daprdockr.InternetRoutedIp()
+		ipAddr, err := daprdockr.InternetRoutedIp(daprdockr.DefaultRoute4FilePath)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error: %s.\n", err)
-			return
+			return 0
 		}
 
 		fmt.Println(ipAddr)
-		return
+		return 0
 	}
 
 	etcdAddrs := strings.Split(*etcdAddresses, ",")
-	etcdClient := etcd.NewClient(etcdAddrs)
+	store, closeStore, err := daprdockr.ConnectEtcdStore(*etcdApi, etcdAddrs)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s.\n", err)
+		return -1
+	}
+	defer closeStore()
 	if *verbose {
 		fmt.Printf("Etcd nodes:\n\t%s\n", strings.Join(etcdAddrs, "\n\t"))
 	}
 
+	if flag.NArg() > 0 {
+		err = runCommand(store, flag.Arg(0), flag.Args()[1:])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Command failed: %s\n", err)
+			return -1
+		}
+		return 0
+	}
+
 	if *stdIn {
 		decoder := json.NewDecoder(os.Stdin)
 		err = decoder.Decode(config)
@@ -56,7 +96,7 @@ func main() {
 		if len(serviceNameParts) < 2 {
 
 			flag.Usage()
-			return
+			return 0
 		}
 
 		if *set || *del {
@@ -65,8 +105,18 @@ func main() {
 
 		config.Instances = *instances
 		config.Container.Image = *image //"troygoode/centos-node-hello"
+		config.Runtime = *runtime
 		if *cmd != "" {
-			config.Container.Cmd = []string{*cmd}
+			if *runtime == daprdockr.RuntimeProcess {
+				config.Container.Cmd = strings.Fields(*cmd)
+			} else {
+				config.Container.Cmd = []string{*cmd}
+			}
+		}
+		config.Container.Env = env
+		if *runtime == daprdockr.RuntimeProcess && *httpPort != "" {
+			// Processes have no image to expose their ports.
+			config.Container.ExposedPorts = map[docker.Port]struct{}{docker.Port(*httpPort + "/tcp"): {}}
 		}
 		config.Http.ContainerPort = *httpPort
 		config.Http.HostName = *httpHostName
@@ -80,12 +130,12 @@ func main() {
 			if *verbose {
 				fmt.Printf("POST %s/%s ...\n", config.Group, config.Name)
 			}
-			err = daprdockr.SetServiceConfig(etcdClient, config)
+			err = daprdockr.SetServiceConfig(store, config)
 		} else if *del {
 			if *verbose {
 				fmt.Printf("DELETE %s/%s\n", config.Group, config.Name)
 			}
-			err = daprdockr.DeleteService(etcdClient, &config.ServiceIdentifier)
+			err = daprdockr.DeleteService(store, &config.ServiceIdentifier)
 
 		}
 
@@ -93,7 +143,7 @@ func main() {
 			if *verbose {
 				fmt.Printf("GET %s/%s\n", config.Group, config.Name)
 			}
-			serviceConfig, err := daprdockr.GetServiceConfig(etcdClient, config.Group, config.Name)
+			serviceConfig, err := daprdockr.GetServiceConfig(store, config.Group, config.Name)
 			if err == nil {
 				var js []byte
 				js, err = json.MarshalIndent(serviceConfig, "", "  ")
@@ -106,6 +156,7 @@ func main() {
 
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Command failed: %s", err)
-		os.Exit(-1)
+		return -1
 	}
+	return 0
 }
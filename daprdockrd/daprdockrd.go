@@ -1,11 +1,10 @@
 package main
 
 import (
+	"context"
 	"flag"
-	"github.com/coreos/go-etcd/etcd"
 	"github.com/daprlabs/daprdockr"
 	"github.com/fsouza/go-dockerclient"
-	"log"
 	"net"
 	"os"
 	"os/signal"
@@ -21,20 +20,70 @@ const (
 	DockerSockEnv          = "DOCKER_SOCK"
 	EtcdHostsFlag          = "etcd"
 	EtcdHostsEnv           = "ETCD_HOSTS"
+	EtcdApiFlag            = "etcd-api"
+	EtcdApiEnv             = "ETCD_API"
 	HostIpFlag             = "host"
 	HostIpEnv              = "HOST_IP"
+	AgentPortFlag          = "port"
+	AgentPortEnv           = "AGENT_PORT"
+	NodeIdFlag             = "node"
+	NodeIdEnv              = "NODE_ID"
+	OnExitFlag             = "on-exit"
+	OnExitEnv              = "ON_EXIT"
+	LogLevelFlag           = "log-level"
+	LogLevelEnv            = "LOG_LEVEL"
+	LogFormatFlag          = "log-format"
+	LogFormatEnv           = "LOG_FORMAT"
+	DnsUpstreamFlag        = "dns-upstream"
+	DnsUpstreamEnv         = "DNS_UPSTREAM"
+	DnsAddrFlag            = "dns-addr"
+	DnsAddrEnv             = "DNS_ADDR"
+	ZoneFlag               = "zone"
+	ZoneEnv                = "ZONE"
+	DnsSecondariesFlag     = "dns-secondaries"
+	DnsSecondariesEnv      = "DNS_SECONDARIES"
 )
 
 var etcdHostsFlag = flag.String(EtcdHostsFlag,
 	"",
 	"\n\tComma separated list of URLs of the cluster's etcd.\n\tOverrides "+EtcdHostsEnv+" environment variable.\n\tExample: http://localhost:5001,http://localhost:5002,http://localhost:5003")
+var etcdApiFlag = flag.String(EtcdApiFlag,
+	"",
+	"Version of the etcd API to use, either \"v2\" or \"v3\". Overrides "+EtcdApiEnv+" environment variable. Default: v2")
 var dockerSockFlag = flag.String(DockerSockFlag,
 	"",
 	"Docker's remote API endpoint. Overrides "+DockerSockEnv+" environment variable.")
 var hostIpFlag = flag.String(HostIpFlag,
 	"",
 	"Docker host IP address. Overrides "+HostIpEnv+" environment variable.")
-var routeFile = flag.String("route", "/proc/net/route", "Location of the container host's route file.")
+var agentPortFlag = flag.String(AgentPortFlag,
+	"",
+	"Port of the agent's HTTP endpoint, bound to the host IP. Overrides "+AgentPortEnv+" environment variable. Default: "+daprdockr.DefaultAgentHttpPort)
+var nodeIdFlag = flag.String(NodeIdFlag,
+	"",
+	"Identifier of this node, unique within the cluster. Overrides "+NodeIdEnv+" environment variable. Default: the host IP address.")
+var onExitFlag = flag.String(OnExitFlag,
+	"",
+	"\n\tWhat to do with managed containers when the agent exits: \"stop\" them, \"leave\" them running, or \"handoff\"\n\tby stopping each once another agent has taken over its instance.\n\tOverrides "+OnExitEnv+" environment variable. Default: stop")
+var logLevelFlag = flag.String(LogLevelFlag,
+	"",
+	"\n\tComma separated log levels (debug, info, warn, error), optionally per component.\n\tOverrides "+LogLevelEnv+" environment variable.\n\tExample: info,Instances=debug,DNS=warn")
+var logFormatFlag = flag.String(LogFormatFlag,
+	"",
+	"Log output format, either \"text\" or \"json\". Overrides "+LogFormatEnv+" environment variable.")
+var dnsUpstreamFlag = flag.String(DnsUpstreamFlag,
+	"",
+	"\n\tComma separated list of DNS servers which queries outside the container domain are forwarded to.\n\tOverrides "+DnsUpstreamEnv+" environment variable. Default: the servers in "+daprdockr.DefaultResolvConf+"\n\tExample: 8.8.8.8,8.8.4.4:53")
+var dnsAddrFlag = flag.String(DnsAddrFlag,
+	"",
+	"\n\tComma separated list of addresses which the DNS server listens on over UDP and TCP.\n\tOverrides "+DnsAddrEnv+" environment variable. Default: "+daprdockr.DefaultDnsAddr+"\n\tExample: 10.0.0.1:53,127.0.0.1:5353")
+var zoneFlag = flag.String(ZoneFlag,
+	"",
+	"\n\tThe cluster's DNS zone, which instances and their containers are named within, eg: svc.prod.internal.\n\tMust be the same on every host. Overrides "+ZoneEnv+" environment variable. Default: "+daprdockr.DefaultZone)
+var dnsSecondariesFlag = flag.String(DnsSecondariesFlag,
+	"",
+	"\n\tComma separated list of secondary DNS servers which may transfer the zone and are notified when it changes.\n\tOverrides "+DnsSecondariesEnv+" environment variable.\n\tExample: 10.0.1.53,10.0.2.53:5353")
+var routeFile = flag.String("route", daprdockr.DefaultRoute4FilePath, "Location of the container host's route file.")
 var cpuprofile = flag.String("cpuprofile", "", "write cpu profile to file")
 
 func getFlagOrEnv(flagName, envName string) string {
@@ -46,13 +95,44 @@ func getFlagOrEnv(flagName, envName string) string {
 	return flagVal
 }
 
+var logger = daprdockr.NewLogger("DaprDockr")
+
 func main() {
+	os.Exit(run())
+}
+
+// Runs the agent until it is stopped, returning the exit code. Deferred cleanup, such as closing the store, runs
+// before the process exits.
+func run() (exitCode int) {
 	var err error
 	flag.Parse()
+
+	if logLevels := getFlagOrEnv(LogLevelFlag, LogLevelEnv); logLevels != "" {
+		if err = daprdockr.SetLogLevels(logLevels); err != nil {
+			logger.Error("Invalid log level", "error", err)
+			return 2
+		}
+	}
+	if logFormat := getFlagOrEnv(LogFormatFlag, LogFormatEnv); logFormat != "" {
+		if err = daprdockr.SetLogFormat(logFormat); err != nil {
+			logger.Error("Invalid log format", "error", err)
+			return 2
+		}
+	}
+
+	onExit := daprdockr.ExitStop
+	if mode := getFlagOrEnv(OnExitFlag, OnExitEnv); mode != "" {
+		if onExit, err = daprdockr.ParseExitMode(mode); err != nil {
+			logger.Error("Invalid exit mode", "error", err)
+			return 2
+		}
+	}
+
 	if *cpuprofile != "" {
 		f, err := os.Create(*cpuprofile)
 		if err != nil {
-			log.Fatal(err)
+			logger.Error("Failed to create CPU profile", "error", err)
+			return 1
 		}
 		pprof.StartCPUProfile(f)
 		defer pprof.StopCPUProfile()
@@ -60,73 +140,72 @@ func main() {
 
 	etcdHosts := getFlagOrEnv(EtcdHostsFlag, EtcdHostsEnv)
 	dockerSock := getFlagOrEnv(DockerSockFlag, DockerSockEnv)
-	hostIpStr := getFlagOrEnv(HostIpFlag, HostIpEnv)
-
-	var hostIp net.IP
-
-	if hostIpStr != "" {
-		hostIp = net.ParseIP(hostIpStr)
-	} else {
-		hostIp, err = daprdockr.InternetRoutedIp()
-		if err != nil {
-			log.Printf("[DaprDockr] Failed to discover host IP: %s.\n", err)
-			return
-		}
+	store, closeStore, err := daprdockr.ConnectEtcdStore(getFlagOrEnv(EtcdApiFlag, EtcdApiEnv), strings.Split(etcdHosts, ","))
+	if err != nil {
+		logger.Error("Failed to connect to etcd", "etcd", etcdHosts, "error", err)
+		return 2
 	}
-	daprdockr.SetHostIp(hostIp)
-
-	log.Print("[DaprDockr] etcd: ", etcdHosts)
-	log.Print("[DaprDockr] docker: ", dockerSock)
-	log.Print("[DaprDockr] host: ", hostIp)
-
-	etcdAddrs := strings.Split(etcdHosts, ",")
-	etcdClient := etcd.NewClient(etcdAddrs)
-
-	stop := make(chan bool)
-
-	dockerClient, err := docker.NewClient(dockerSock)
+	defer closeStore()
+	options := daprdockr.AgentOptions{
+		Store:                  store,
+		RouteFile:              *routeFile,
+		NodeId:                 getFlagOrEnv(NodeIdFlag, NodeIdEnv),
+		Zone:                   getFlagOrEnv(ZoneFlag, ZoneEnv),
+		HttpPort:               getFlagOrEnv(AgentPortFlag, AgentPortEnv),
+		UpdateThrottleInterval: UpdateThrottleInterval * time.Second,
+		OnExit:                 onExit,
+		Errors:                 make(chan error, 100),
+	}
+	if dnsUpstreams := getFlagOrEnv(DnsUpstreamFlag, DnsUpstreamEnv); dnsUpstreams != "" {
+		options.DnsUpstreams = strings.Split(dnsUpstreams, ",")
+	}
+	if dnsAddrs := getFlagOrEnv(DnsAddrFlag, DnsAddrEnv); dnsAddrs != "" {
+		options.DnsAddrs = strings.Split(dnsAddrs, ",")
+	}
+	if dnsSecondaries := getFlagOrEnv(DnsSecondariesFlag, DnsSecondariesEnv); dnsSecondaries != "" {
+		options.DnsSecondaries = strings.Split(dnsSecondaries, ",")
+	}
+	if hostIp := getFlagOrEnv(HostIpFlag, HostIpEnv); hostIp != "" {
+		options.HostIp = net.ParseIP(hostIp)
+	}
+	options.DockerClient, err = docker.NewClient(dockerSock)
 	if err != nil {
-		log.Printf("[DaprDockr] Failed to create Docker client at address %s: %s.\n", dockerSock, err)
-		return
+		logger.Error("Failed to create Docker client", "docker", dockerSock, "error", err)
+		return 1
 	}
 
-	daprdockr.Route4FilePath = *routeFile
-
-	// Push changes from the local Docker instance into etcd.
-	go daprdockr.PushStateChangesIntoStore(dockerClient, etcdClient, stop)
-
-	// Pull changes to the currently running instances and configurations.
-	instanceUpdates := daprdockr.LatestInstances(etcdClient, stop, 3, UpdateThrottleInterval*time.Second)
-	serviceConfigUpdates := daprdockr.LatestServiceConfigs(etcdClient, stop, UpdateThrottleInterval*time.Second)
-
-	// Pull required state changes from the store and attempt to apply them locally.
-	requiredChanges := daprdockr.RequiredStateChanges(instanceUpdates[0], serviceConfigUpdates, stop)
-	go daprdockr.ApplyRequiredStateChanges(dockerClient, etcdClient, requiredChanges, stop)
+	agent, err := daprdockr.NewAgent(options)
+	if err != nil {
+		logger.Error("Failed to create agent", "error", err)
+		return 1
+	}
+	daprdockr.SetLogNode(agent.NodeId())
+	logger.Info("Starting", "etcd", etcdHosts, "docker", dockerSock, "host", agent.HostIp(), "agent", agent.HttpAddr(), "zone", agent.Zone())
 
-	errors := make(chan error, 100)
 	go func() {
-		for err := range errors {
+		for err := range options.Errors {
 			if err != nil {
-				log.Printf("[DaprDockr] Error: %s.\n", err)
+				logger.Error("Error", "error", err)
 			}
 		}
 	}()
 
-	// Start a DNS server so that the addresses of service instances can be resolved.
-	go daprdockr.StartDnsServer(instanceUpdates[1], &errors)
-
-	// Start an HTTP load balancer so that configured sites can be correctly served.
-	go daprdockr.StartLoadBalancer(etcdClient, instanceUpdates[2], stop, &errors)
-
-	// Spin until killed.
-	sig := make(chan os.Signal)
+	// Stop on the first signal. A second signal exits immediately.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
-forever:
-	for {
-		select {
-		case s := <-sig:
-			log.Printf("Signal (%d) received, stopping.\n", s)
-			break forever
-		}
+	go func() {
+		s := <-sig
+		logger.Info("Signal received, stopping", "signal", s)
+		cancel()
+		s = <-sig
+		logger.Warn("Signal received, exiting without leaving the cluster", "signal", s)
+		os.Exit(1)
+	}()
+
+	if err = agent.Run(ctx); err != nil {
+		return 1
 	}
+	return 0
 }
@@ -2,89 +2,199 @@
 package daprdockr
 
 import (
+	"context"
 	"errors"
 	"github.com/miekg/dns"
-	"log"
 	"net"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
-	debugDnsServer           = false
-	compressDnsResponses     = false
-	ContainerDomainSuffix    = "container"
-	ContainerDomainSuffixLen = len(ContainerDomainSuffix) + 2
+	DefaultZone    = "container" // The zone which instances are named within, unless configured otherwise.
+	DefaultDnsAddr = ":53"
+	DnsSrvPriority = 10   // Priority of SRV records, which is the same for all instances.
+	DnsSrvWeight   = 10   // Weight of SRV records, so that clients share load equally between instances.
+	DnsUdpSize     = 1232 // Largest response sent over UDP, which is advertised to clients which use EDNS0.
+	DnsTsigFudge   = 300  // Seconds by which the clocks of the server and a client which signs its requests may differ.
 )
 
+var dnsLog = NewLogger("DNS")
+
 // Start a DNS server so that the addresses of service instances can be resolved.
-func StartDnsServer(currentInstances chan map[string]*Instance, errorChan *chan error) {
-	dns.HandleFunc(ContainerDomainSuffix+".", createContainerHandler(currentInstances, errorChan))
-	dns.HandleFunc(".", createDefaultHandler(errorChan))
-	go serve("tcp", errorChan)
-	go serve("udp", errorChan)
+// Listens on each of the agent's DNS addresses over both TCP and UDP.
+// Serves until the context is done or any listener fails, in which case the error is returned.
+func (this *Agent) StartDnsServer(ctx context.Context, currentInstances chan map[string]*Instance) (err error) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defaultHandler := this.createDefaultHandler()
+	reverseHandler := this.createReverseHandler(defaultHandler)
+	currentRecords := this.currentDnsRecords(ctx, &wg)
+	this.dnsMux.HandleFunc(this.zone+".", this.createContainerHandler(ctx, currentInstances, currentRecords, &wg))
+	this.dnsMux.HandleFunc("in-addr.arpa.", reverseHandler)
+	this.dnsMux.HandleFunc("ip6.arpa.", reverseHandler)
+	this.dnsMux.HandleFunc(".", defaultHandler)
 
-	// TODO: When https://github.com/miekg/dns implements .Stop(), leverage that here.
+	servers := make([]Component, 0, 2*len(this.dnsAddrs))
+	for _, addr := range this.dnsAddrs {
+		addr := addr
+		servers = append(servers,
+			func(ctx context.Context) error { return this.serveDns(ctx, "tcp", addr) },
+			func(ctx context.Context) error { return this.serveDns(ctx, "udp", addr) })
+	}
+	return RunComponents(ctx, servers...)
 }
 
-func serve(net string, errorChan *chan error) {
-	server := &dns.Server{Addr: ":53", Net: net}
-	err := server.ListenAndServe()
-	if err != nil && errorChan != nil {
-		*errorChan <- err
+// Serves DNS requests on the network address until the context is done.
+func (this *Agent) serveDns(ctx context.Context, net, addr string) (err error) {
+	started := make(chan bool)
+	listener := addr + "/" + net // Identifies the listener in the DNS status, eg: ":53/udp".
+	server := &dns.Server{Addr: addr, Net: net, Handler: this.dnsMux}
+	server.NotifyStartedFunc = func() {
+		this.state.updateDns(func(status *DnsStatus) {
+			status.Listening[listener] = true
+			delete(status.Errors, listener)
+		})
+		close(started)
 	}
-}
 
-// Creates a handler which proxies requests via the host system's configured DNS servers.
-func createDefaultHandler(errorChan *chan error) (handler func(dns.ResponseWriter, *dns.Msg)) {
-	resolvConf, err := dns.ClientConfigFromFile("/etc/resolv.conf")
-	if err != nil {
-		if errorChan != nil {
-			*errorChan <- err
+	result := make(chan error, 1)
+	go func() {
+		result <- server.ListenAndServe()
+	}()
+
+	// The server can only be shut down once it has started.
+	select {
+	case <-started:
+		select {
+		case <-ctx.Done():
+			server.Shutdown()
+			err = <-result
+		case err = <-result:
 		}
+	case err = <-result:
 	}
-	externalDns := new(dns.Client)
 
-	return func(writer dns.ResponseWriter, request *dns.Msg) {
+	this.state.updateDns(func(status *DnsStatus) {
+		status.Listening[listener] = false
+		if err != nil {
+			status.Errors[listener] = err.Error()
+		}
+	})
+	return
+}
 
-		for _, server := range resolvConf.Servers {
-			response, _, err := externalDns.Exchange(request, server+":"+resolvConf.Port)
-			if err != nil {
-				if debugDnsServer {
-					log.Printf("Error handling request: %s.\n", err)
-				}
-				if errorChan != nil {
-					*errorChan <- err
-				}
-				continue
+// Creates a handler which forwards requests to the upstream servers, or to the host system's configured DNS servers if
+// none are provided. Responds with SERVFAIL if no server responds.
+func (this *Agent) createDefaultHandler() (handler func(dns.ResponseWriter, *dns.Msg)) {
+	upstreams, errorChan := this.dnsUpstreams, this.errors
+	if len(upstreams) == 0 {
+		var err error
+		if upstreams, err = ResolvConfUpstreams(DefaultResolvConf); err != nil {
+			dnsLog.Error("Unable to read upstream DNS servers", "file", DefaultResolvConf, "error", err)
+			if errorChan != nil {
+				*errorChan <- err
 			}
+		}
+	}
+	dnsLog.Info("Forwarding to upstream servers", "servers", upstreams)
+	forwarder := newDnsForwarder(upstreams)
 
-			if debugDnsServer {
-				log.Printf("Default handler response: %s.\n", response.String())
+	return func(writer dns.ResponseWriter, request *dns.Msg) {
+		defer observeSince(this.metrics.dnsQueryDuration, time.Now(), "default")
+		response, cached, err := forwarder.forward(request)
+		result := "forwarded"
+		switch {
+		case err != nil:
+			result = "failed"
+			if errorChan != nil {
+				*errorChan <- err
 			}
-			writer.WriteMsg(response)
-			break
+			response = new(dns.Msg)
+			response.SetRcode(request, dns.RcodeServerFailure)
+		case cached:
+			result = "cached"
 		}
+		for _, question := range request.Question {
+			this.metrics.dnsQueries.Inc("default", dns.TypeToString[question.Qtype], result)
+		}
+		fitDnsResponse(writer, request, response)
+		writer.WriteMsg(response)
 	}
 }
 
-// Creates a handler for container domain requests.
-func createContainerHandler(currentInstances chan map[string]*Instance, errorChan *chan error) (handler func(dns.ResponseWriter, *dns.Msg)) {
-	var instances *map[string]*Instance
-	go func() {
-		for current := range currentInstances {
-			log.Printf("[DNS] Updating hosts. Hosts: %d.\n", len(current))
-			instances = &current
+// Creates a handler for requests within the zone, which answers for the current instances and static records.
+// The goroutine which tracks them is tracked by the wait group.
+func (this *Agent) createContainerHandler(ctx context.Context, currentInstances chan map[string]*Instance, currentRecords chan map[string]*DnsRecord, wg *sync.WaitGroup) (handler func(dns.ResponseWriter, *dns.Msg)) {
+	errorChan := this.errors
+	var rotation uint32 // Incremented for each query, so that answers for services and groups are rotated.
+	goTracked(wg, func() {
+		var serial uint32
+		var zone string // The text of the zone's records, which are only given a new serial when they change.
+		var instances map[string]*Instance
+		var records map[string]*DnsRecord
+		received := false // Whether the instances are known, as the zone is only answered for once they are.
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case current, ok := <-currentInstances:
+				if !ok {
+					return
+				}
+				dnsLog.Info("Updating hosts", "hosts", len(current))
+				instances, received = current, true
+			case current, ok := <-currentRecords:
+				if !ok {
+					return
+				}
+				dnsLog.Info("Updating records", "records", len(current))
+				records = current
+				if !received {
+					continue
+				}
+			}
+
+			// Heartbeats republish instances which have not changed, which must not make secondary servers transfer the zone.
+			index := newDnsIndex(instances, records, this.zone)
+			index.nameserverIp = this.hostIp
+			zoneRecords := index.zoneRecords()
+			changed := dnsRecordsText(zoneRecords) != zone
+			if changed {
+				serial, zone = nextDnsSerial(serial, time.Now()), dnsRecordsText(zoneRecords)
+			}
+			index.serial = serial
+			this.dnsIndex.Store(index)
+			if changed && len(this.dnsSecondaries) > 0 {
+				this.dnsZone.add(index, zoneRecords)
+				this.notifyDnsSecondaries(index.soa(), wg)
+			}
+			instanceCount, recordCount := len(instances), len(records)
+			this.state.updateDns(func(status *DnsStatus) {
+				status.Instances = instanceCount
+				status.Records = recordCount
+				status.LastUpdate = time.Now()
+			})
 		}
-	}()
+	})
 
 	return func(writer dns.ResponseWriter, request *dns.Msg) {
+		defer observeSince(this.metrics.dnsQueryDuration, time.Now(), "container")
 		response := new(dns.Msg)
 		response.SetReply(request)
-		response.Compress = compressDnsResponses
 
-		if instances == nil {
+		index := this.currentDnsIndex()
+		if index == nil {
+			for _, question := range request.Question {
+				this.metrics.dnsQueries.Inc("container", dns.TypeToString[question.Qtype], "unavailable")
+			}
+			// Fail rather than deny that names exist, so that resolvers do not cache the answer.
+			response.Rcode = dns.RcodeServerFailure
+			fitDnsResponse(writer, request, response)
 			writer.WriteMsg(response)
 			err := errors.New("DNS query made but instances is nil.")
 			if errorChan != nil {
@@ -93,89 +203,262 @@ func createContainerHandler(currentInstances chan map[string]*Instance, errorCha
 			return
 		}
 
-		instances := *instances
+		if len(request.Question) == 1 && (request.Question[0].Qtype == dns.TypeAXFR || request.Question[0].Qtype == dns.TypeIXFR) {
+			this.transferZone(writer, request)
+			return
+		}
+
+		// Answers are authoritative. Names which do not exist are denied, and names without records of the requested
+		// type have no answers, both with the zone's SOA record so that resolvers can cache the absence.
+		response.Authoritative = true
 		for _, question := range request.Question {
-			for _, instance := range getInstancesFromQuestion(question, instances) {
-				switch question.Qtype {
-				case dns.TypeSRV:
-					parts := strings.SplitN(question.Name, ".", 3)
-					if len(parts) >= 3 {
-						// Extract the service, which is the container port.
-						containerPort := parts[0]
-						// Determine the host port which the service is mapped to.
-						if hostPortStr, ok := instance.PortMappings[containerPort]; ok {
-							hostPort, err := strconv.ParseUint(hostPortStr, 10, 16)
-							if err == nil {
-								target := parts[2]
-								// Construct the response.
-								response.Answer = append(response.Answer, &dns.SRV{
-									Hdr:    dns.RR_Header{Name: question.Name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: 0},
-									Target: target,
-									Port:   uint16(hostPort),
-								})
-							}
-						}
-					}
-				case dns.TypeA, dns.TypeAAAA:
-					for _, addr := range instance.Addrs {
-						ip := net.ParseIP(addr)
-						switch {
-						case ip == nil:
-							continue
-						case ip.To4() != nil:
-							response.Answer = append(response.Answer, &dns.A{
-								Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 0},
-								A:   ip.To4(),
-							})
-						case ip.To16() != nil:
-							response.Answer = append(response.Answer, &dns.AAAA{
-								Hdr:  dns.RR_Header{Name: question.Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 0},
-								AAAA: ip.To16(),
-							})
-						}
-					}
-				}
+			name, _ := dnsRelativeName(question.Name, this.zone)
+			answers, extra, exists := index.answer(question, name, atomic.AddUint32(&rotation, 1))
+			response.Answer = append(response.Answer, answers...)
+			response.Extra = append(response.Extra, extra...)
+
+			result := "answered"
+			switch {
+			case !exists:
+				result = "nxdomain"
+				response.Rcode = dns.RcodeNameError
+			case len(answers) == 0:
+				result = "nodata"
+			}
+			if len(answers) == 0 && len(response.Ns) == 0 {
+				response.Ns = append(response.Ns, index.soa())
 			}
+			this.metrics.dnsQueries.Inc("container", dns.TypeToString[question.Qtype], result)
+		}
+
+		fitDnsResponse(writer, request, response)
+		writer.WriteMsg(response)
+	}
+}
+
+// Returns the index of the instances which the DNS server answers for, or nil if it has not received them yet.
+func (this *Agent) currentDnsIndex() *dnsIndex {
+	index, _ := this.dnsIndex.Load().(*dnsIndex)
+	return index
+}
+
+// Prepares a response to be sent to the client which made the request, as in RFC 6891. If the request used EDNS0, the
+// response does too, advertising the largest response which the server sends over UDP, and answers BADVERS for
+// versions other than 0. The response is compressed and truncated, setting the TC bit, if it is larger than the client
+// accepts: 512 bytes over UDP without EDNS0, or the smaller of the client's and the server's sizes with it, so that the
+// client retries over TCP. Responses to requests signed with a verified TSIG key are signed, as in RFC 2845, leaving
+// room for the signature when truncating.
+func fitDnsResponse(writer dns.ResponseWriter, request, response *dns.Msg) {
+	// Options from upstream servers do not apply to the client.
+	extra := response.Extra[:0]
+	for _, record := range response.Extra {
+		if record.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, record)
 		}
+	}
+	response.Extra = extra
 
-		if request.IsTsig() != nil {
-			if writer.TsigStatus() == nil {
-				response.SetTsig(request.Extra[len(request.Extra)-1].(*dns.TSIG).Hdr.Name, dns.HmacMD5, 300, time.Now().Unix())
-			} else if debugDnsServer {
-				log.Printf("[DNS] TsigStatus", writer.TsigStatus().Error())
+	size := dns.MinMsgSize
+	if opt := request.IsEdns0(); opt != nil {
+		if opt.Version() != 0 {
+			response.Answer, response.Ns, response.Extra = nil, nil, nil
+			response.Rcode = dns.RcodeBadVers
+		}
+		response.SetEdns0(DnsUdpSize, opt.Do())
+		size = int(opt.UDPSize())
+		if size > DnsUdpSize {
+			size = DnsUdpSize
+		}
+	}
+	if _, overTcp := writer.RemoteAddr().(*net.TCPAddr); overTcp {
+		size = dns.MaxMsgSize
+	}
+
+	var signature *dns.TSIG
+	if tsig := request.IsTsig(); tsig != nil {
+		if writer.TsigStatus() != nil {
+			dnsLog.Debug("TSIG verification failed", "error", writer.TsigStatus())
+		} else {
+			// The response is signed with the request's key and algorithm when it is written, so the MAC of the request
+			// stands in for that of the response, which has the same length.
+			signature = &dns.TSIG{Hdr: dns.RR_Header{Name: tsig.Hdr.Name}, Algorithm: tsig.Algorithm, MAC: tsig.MAC}
+		}
+	}
+	if signature == nil {
+		response.Truncate(size)
+		return
+	}
+
+	// Truncate fills at least 512 bytes, so records are dropped from the end until the signature fits too.
+	reserved := dns.Len(signature)
+	response.Truncate(size - reserved)
+	for response.Len()+reserved > size && dropLastDnsRecord(response) {
+		response.Truncated = true
+	}
+	response.SetTsig(signature.Hdr.Name, signature.Algorithm, DnsTsigFudge, time.Now().Unix())
+}
+
+// Removes the last record of a response other than its EDNS0 options, returning false if there are none.
+func dropLastDnsRecord(response *dns.Msg) bool {
+	for i := len(response.Extra) - 1; i >= 0; i-- {
+		if response.Extra[i].Header().Rrtype != dns.TypeOPT {
+			response.Extra = append(response.Extra[:i], response.Extra[i+1:]...)
+			return true
+		}
+	}
+	if len(response.Ns) > 0 {
+		response.Ns = response.Ns[:len(response.Ns)-1]
+		return true
+	}
+	if len(response.Answer) > 0 {
+		response.Answer = response.Answer[:len(response.Answer)-1]
+		return true
+	}
+	return false
+}
+
+// Creates a handler for reverse lookups, which answers with the names of the instances at an address and passes
+// queries for other addresses to the fallback handler.
+func (this *Agent) createReverseHandler(fallback func(dns.ResponseWriter, *dns.Msg)) (handler func(dns.ResponseWriter, *dns.Msg)) {
+	return func(writer dns.ResponseWriter, request *dns.Msg) {
+		index := this.currentDnsIndex()
+		if index == nil || len(request.Question) != 1 {
+			fallback(writer, request)
+			return
+		}
+		question := request.Question[0]
+		ip := reverseNameAddress(question.Name)
+		if ip == nil || len(index.reverse(ip)) == 0 {
+			fallback(writer, request)
+			return
+		}
+
+		defer observeSince(this.metrics.dnsQueryDuration, time.Now(), "reverse")
+		response := new(dns.Msg)
+		response.SetReply(request)
+		result := "empty"
+		if question.Qtype == dns.TypePTR || question.Qtype == dns.TypeANY {
+			for _, instance := range index.reverse(ip) {
+				response.Answer = append(response.Answer, &dns.PTR{
+					Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 0},
+					Ptr: index.domainName(instance),
+				})
 			}
+			result = "answered"
 		}
+		this.metrics.dnsQueries.Inc("reverse", dns.TypeToString[question.Qtype], result)
+		fitDnsResponse(writer, request, response)
 		writer.WriteMsg(response)
 	}
 }
 
-// TODO: Use a more optimal data structure for these kinds of operations.
-func getInstancesFromQuestion(question dns.Question, allInstances map[string]*Instance) (instances []*Instance) {
-	questionSansSentinel := question.Name[:len(question.Name)-ContainerDomainSuffixLen]
-	instances = make([]*Instance, 0, 4)
-	switch strings.Count(questionSansSentinel, ".") {
-	case 3: // <instance>.<service>.<group>.container
-		if instance, exists := allInstances[questionSansSentinel]; exists {
-			instances = append(instances, instance)
-		}
-	case 2: // <service>.<group>.container
-		// See TODO above. This is obviously a poor way to find matching instances.
-		for name, instance := range allInstances {
-			nameParts := strings.SplitN(name, ".", 2)
-			if len(nameParts) == 2 && nameParts[1] == question.Name {
-				instances = append(instances, instance)
+// Creates the SRV records answering a question for "_<port>._<protocol>.<name>", as in RFC 2782, where the port is a
+// container port or a service name such as "http", the protocol is "tcp" or "udp" and the name is relative to the
+// zone. There is a record for each instance which maps the port, targeting the instance's own name, and the
+// address records of the targets are returned as extra records. The underscores may be omitted.
+func srvRecords(question dns.Question, name string, index *dnsIndex, rotation uint32) (answers, extra []dns.RR) {
+	parts := strings.SplitN(name, ".", 3)
+	if len(parts) < 3 {
+		return
+	}
+	protocol := strings.TrimPrefix(parts[1], "_")
+	if protocol != "tcp" && protocol != "udp" {
+		return
+	}
+	port, err := net.LookupPort(protocol, strings.TrimPrefix(parts[0], "_"))
+	if err != nil {
+		return
+	}
+	key := portMappingKey(strconv.Itoa(port), protocol)
+	for _, instance := range rotateInstances(index.lookup(parts[2]), rotation) {
+		hostPort, err := strconv.ParseUint(instance.PortMappings[key], 10, 16)
+		if err != nil || len(instance.Addrs) == 0 {
+			continue
+		}
+		target := index.domainName(instance)
+		answers = append(answers, &dns.SRV{
+			Hdr:      dns.RR_Header{Name: question.Name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: 0},
+			Priority: DnsSrvPriority,
+			Weight:   DnsSrvWeight,
+			Port:     uint16(hostPort),
+			Target:   target,
+		})
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			extra = append(extra, addressRecords(dns.Question{Name: target, Qtype: qtype, Qclass: dns.ClassINET}, []*Instance{instance})...)
+		}
+	}
+	return
+}
+
+// Creates a TXT record for each instance holding its details as "key=value" strings, as in RFC 1464, eg:
+// "instance=0.api.web", "image=nginx", "port_80=49153" or "port_53_udp=49154". Details which are not known are omitted.
+func txtRecords(question dns.Question, instances []*Instance) (records []dns.RR) {
+	for _, instance := range instances {
+		details := []string{"instance=" + instance.QualifiedName()}
+		add := func(key, value string) {
+			if len(value) > 0 {
+				details = append(details, key+"="+value)
 			}
 		}
-	case 1: // <group>.container
-		// See TODO above. This is obviously a poor way to find matching instances.
-		for name, instance := range allInstances {
-			nameParts := strings.SplitN(name, ".", 3)
-			if len(nameParts) == 3 && nameParts[2] == question.Name {
-				instances = append(instances, instance)
+		add("image", instance.Image)
+		add("container", instance.ContainerId)
+		add("node", instance.Owner)
+		add("agent", instance.Agent)
+		if !instance.Started.IsZero() {
+			add("started", instance.Started.Format(time.RFC3339))
+		}
+		add("revision", instance.Revision)
+		for _, addr := range instance.Addrs {
+			add("addr", addr)
+		}
+		ports := make([]string, 0, len(instance.PortMappings))
+		for port := range instance.PortMappings {
+			ports = append(ports, port)
+		}
+		sort.Strings(ports)
+		for _, port := range ports {
+			add("port_"+strings.Replace(port, "/", "_", 1), instance.PortMappings[port])
+		}
+
+		// Each string in a TXT record is limited to 255 bytes.
+		for i, detail := range details {
+			if len(detail) > 255 {
+				details[i] = detail[:255]
 			}
 		}
-	default:
+		records = append(records, &dns.TXT{
+			Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 0},
+			Txt: details,
+		})
 	}
+	return
+}
 
+// Creates the A or AAAA records answering a question with the addresses of the instances, omitting repeated addresses.
+func addressRecords(question dns.Question, instances []*Instance) (records []dns.RR) {
+	seen := make(map[string]bool)
+	for _, instance := range instances {
+		for _, addr := range instance.Addrs {
+			ip := net.ParseIP(addr)
+			if ip == nil || seen[ip.String()] {
+				continue
+			}
+			switch {
+			case ip.To4() != nil && question.Qtype == dns.TypeA:
+				records = append(records, &dns.A{
+					Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 0},
+					A:   ip.To4(),
+				})
+			case ip.To4() == nil && question.Qtype == dns.TypeAAAA:
+				records = append(records, &dns.AAAA{
+					Hdr:  dns.RR_Header{Name: question.Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 0},
+					AAAA: ip.To16(),
+				})
+			default:
+				continue
+			}
+			seen[ip.String()] = true
+		}
+	}
 	return
 }
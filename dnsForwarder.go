@@ -0,0 +1,313 @@
+// Forwarding of queries outside the zone to upstream DNS servers.
+package daprdockr
+
+import (
+	"container/list"
+	goerrors "errors"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DnsUpstreamTimeout = 2    // Seconds to wait for an upstream server to respond.
+	DnsUpstreamStagger = 150  // Milliseconds to wait for an upstream server before also asking the next.
+	DnsCacheMaxTtl     = 3600 // Seconds which a response is cached for at most.
+	DnsCacheMaxEntries = 10000
+	DefaultDnsPort     = "53"
+	DefaultResolvConf  = "/etc/resolv.conf"
+)
+
+// Forwards queries to upstream servers, caching their responses for as long as their TTLs allow.
+// Servers are raced: each is asked in turn, without waiting for those before it to respond for longer than
+// DnsUpstreamStagger, and the first useful response wins.
+type dnsForwarder struct {
+	upstreams []string // Eg: "8.8.8.8:53".
+	udp       *dns.Client
+	tcp       *dns.Client
+	cache     *dnsCache
+}
+
+func newDnsForwarder(upstreams []string) *dnsForwarder {
+	return &dnsForwarder{
+		upstreams: upstreams,
+		udp:       &dns.Client{Net: "udp", Timeout: DnsUpstreamTimeout * time.Second},
+		tcp:       &dns.Client{Net: "tcp", Timeout: DnsUpstreamTimeout * time.Second},
+		cache:     newDnsCache(),
+	}
+}
+
+// Returns the upstream servers configured in a resolv.conf file.
+func ResolvConfUpstreams(path string) (upstreams []string, err error) {
+	config, err := dns.ClientConfigFromFile(path)
+	if err != nil {
+		return
+	}
+	for _, server := range config.Servers {
+		upstreams = append(upstreams, net.JoinHostPort(server, config.Port))
+	}
+	return
+}
+
+// Returns DNS server addresses with the default DNS port added to those which lack one.
+func dnsUpstreamAddrs(servers []string) (upstreams []string) {
+	for _, server := range servers {
+		server = strings.TrimSpace(server)
+		if len(server) == 0 {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(strings.Trim(server, "[]"), DefaultDnsPort)
+		}
+		upstreams = append(upstreams, server)
+	}
+	return
+}
+
+// Answers a request from the cache or from the upstream servers, returning whether it was cached.
+// Fails if no upstream server gives a useful response.
+func (this *dnsForwarder) forward(request *dns.Msg) (response *dns.Msg, cached bool, err error) {
+	key, cacheable := newDnsCacheKey(request)
+	if cacheable {
+		if response = this.cache.get(key, time.Now()); response != nil {
+			response.Id = request.Id
+			response.Question = request.Question
+			return response, true, nil
+		}
+	}
+
+	if response, err = this.exchange(newUpstreamDnsRequest(request)); err != nil {
+		return
+	}
+	if cacheable {
+		this.cache.put(key, response, time.Now())
+	}
+	return
+}
+
+// Returns a copy of a client's request to send to the upstream servers. The client's TSIG signature and EDNS0 options
+// apply only to this server, so they are replaced with options which advertise this server's UDP size and keep the
+// client's request for DNSSEC records.
+func newUpstreamDnsRequest(request *dns.Msg) (upstream *dns.Msg) {
+	upstream = request.Copy()
+	upstream.Extra = nil
+	for _, record := range request.Extra {
+		if rrtype := record.Header().Rrtype; rrtype != dns.TypeOPT && rrtype != dns.TypeTSIG {
+			upstream.Extra = append(upstream.Extra, dns.Copy(record))
+		}
+	}
+	if opt := request.IsEdns0(); opt != nil {
+		upstream.SetEdns0(DnsUdpSize, opt.Do())
+	}
+	return
+}
+
+type dnsExchangeResult struct {
+	upstream string
+	response *dns.Msg
+	err      error
+}
+
+// Races the upstream servers, returning the first response which is not a server failure.
+func (this *dnsForwarder) exchange(request *dns.Msg) (response *dns.Msg, err error) {
+	if len(this.upstreams) == 0 {
+		return nil, goerrors.New("No upstream DNS servers")
+	}
+
+	// Buffered so that servers which lose the race do not block.
+	results := make(chan dnsExchangeResult, len(this.upstreams))
+	next, pending := 0, 0
+	askNext := func() {
+		upstream := this.upstreams[next]
+		next++
+		pending++
+		go func() {
+			response, err := this.exchangeWith(upstream, request.Copy())
+			results <- dnsExchangeResult{upstream: upstream, response: response, err: err}
+		}()
+	}
+
+	askNext()
+	stagger := time.NewTimer(DnsUpstreamStagger * time.Millisecond)
+	defer stagger.Stop()
+	for pending > 0 {
+		select {
+		case result := <-results:
+			pending--
+			if result.err == nil && result.response.Rcode != dns.RcodeServerFailure {
+				return result.response, nil
+			}
+			if result.err == nil {
+				result.err = goerrors.New("Server failure from " + result.upstream)
+			}
+			dnsLog.Debug("Error forwarding request", "server", result.upstream, "error", result.err)
+			err = result.err
+
+			// Ask the next server straight away rather than waiting out the stagger.
+			if next < len(this.upstreams) {
+				askNext()
+			}
+		case <-stagger.C:
+			if next < len(this.upstreams) {
+				askNext()
+				stagger.Reset(DnsUpstreamStagger * time.Millisecond)
+			}
+		}
+	}
+	return
+}
+
+// Asks a single upstream server, retrying over TCP if the response was truncated.
+func (this *dnsForwarder) exchangeWith(upstream string, request *dns.Msg) (response *dns.Msg, err error) {
+	if response, _, err = this.udp.Exchange(request, upstream); err != nil || !response.Truncated {
+		return
+	}
+	response, _, err = this.tcp.Exchange(request, upstream)
+	return
+}
+
+// Identifies cached responses.
+type dnsCacheKey struct {
+	name   string // In lower case.
+	qtype  uint16
+	qclass uint16
+	dnssec bool // Whether DNSSEC records were requested.
+}
+
+// Returns the cache key of a request, or false if its response cannot be cached.
+func newDnsCacheKey(request *dns.Msg) (key dnsCacheKey, ok bool) {
+	if len(request.Question) != 1 || request.Opcode != dns.OpcodeQuery {
+		return
+	}
+	question := request.Question[0]
+	key = dnsCacheKey{name: strings.ToLower(question.Name), qtype: question.Qtype, qclass: question.Qclass}
+	if opt := request.IsEdns0(); opt != nil {
+		key.dnssec = opt.Do()
+	}
+	return key, true
+}
+
+// Responses from upstream servers, including negative responses, as in RFC 2308.
+type dnsCache struct {
+	lock    sync.Mutex
+	entries map[dnsCacheKey]*list.Element
+	recent  *list.List // Of *dnsCacheEntry, most recently stored or returned first.
+}
+
+type dnsCacheEntry struct {
+	key      dnsCacheKey
+	response *dns.Msg
+	stored   time.Time
+	expires  time.Time
+}
+
+func newDnsCache() *dnsCache {
+	return &dnsCache{entries: make(map[dnsCacheKey]*list.Element), recent: list.New()}
+}
+
+// Returns a copy of a cached response with its TTLs reduced by the time it has been cached, or nil if there is none.
+func (this *dnsCache) get(key dnsCacheKey, now time.Time) (response *dns.Msg) {
+	this.lock.Lock()
+	element, exists := this.entries[key]
+	var entry *dnsCacheEntry
+	if exists {
+		entry = element.Value.(*dnsCacheEntry)
+		if now.Before(entry.expires) {
+			this.recent.MoveToFront(element)
+		} else {
+			this.remove(element)
+			exists = false
+		}
+	}
+	this.lock.Unlock()
+	if !exists {
+		return nil
+	}
+
+	response = entry.response.Copy()
+	elapsed := uint32(now.Sub(entry.stored) / time.Second)
+	for _, section := range [][]dns.RR{response.Answer, response.Ns, response.Extra} {
+		for _, record := range section {
+			if header := record.Header(); header.Rrtype != dns.TypeOPT {
+				if header.Ttl > elapsed {
+					header.Ttl -= elapsed
+				} else {
+					header.Ttl = 0
+				}
+			}
+		}
+	}
+	return
+}
+
+// Caches a response for its TTL, if it can be cached. Once the cache is full, the least recently used response is
+// evicted, so that a burst of queries for new names does not evict frequently used ones.
+func (this *dnsCache) put(key dnsCacheKey, response *dns.Msg, now time.Time) {
+	ttl, ok := dnsCacheTtl(response)
+	if !ok {
+		return
+	}
+	entry := &dnsCacheEntry{key: key, response: response.Copy(), stored: now, expires: now.Add(time.Duration(ttl) * time.Second)}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if element, exists := this.entries[key]; exists {
+		element.Value = entry
+		this.recent.MoveToFront(element)
+		return
+	}
+	if this.recent.Len() >= DnsCacheMaxEntries {
+		this.remove(this.recent.Back())
+	}
+	this.entries[key] = this.recent.PushFront(entry)
+}
+
+// Removes an entry from the cache. The cache must be locked.
+func (this *dnsCache) remove(element *list.Element) {
+	this.recent.Remove(element)
+	delete(this.entries, element.Value.(*dnsCacheEntry).key)
+}
+
+// Returns the time which a response may be cached for, in seconds: the lowest TTL of its records or, for a negative
+// response, the TTL of the zone's SOA record, limited by its minimum TTL. Responses which are truncated, failed or
+// negative without an SOA record are not cached.
+func dnsCacheTtl(response *dns.Msg) (ttl uint32, ok bool) {
+	if response.Truncated {
+		return
+	}
+	ttl = DnsCacheMaxTtl
+	switch {
+	case response.Rcode == dns.RcodeSuccess && len(response.Answer) > 0:
+		for _, section := range [][]dns.RR{response.Answer, response.Ns, response.Extra} {
+			for _, record := range section {
+				if header := record.Header(); header.Rrtype != dns.TypeOPT && header.Ttl < ttl {
+					ttl = header.Ttl
+				}
+			}
+		}
+	case response.Rcode == dns.RcodeSuccess || response.Rcode == dns.RcodeNameError:
+		var soa *dns.SOA
+		for _, record := range response.Ns {
+			if found, isSoa := record.(*dns.SOA); isSoa {
+				soa = found
+				break
+			}
+		}
+		if soa == nil {
+			return 0, false
+		}
+		ttl = minUint32(ttl, minUint32(soa.Hdr.Ttl, soa.Minttl))
+	default:
+		return 0, false
+	}
+	return ttl, ttl > 0
+}
+
+func minUint32(a, b uint32) uint32 {
+	if a < b {
+		return a
+	}
+	return b
+}
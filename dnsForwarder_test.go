@@ -0,0 +1,96 @@
+package daprdockr
+
+import (
+	"github.com/miekg/dns"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newTestDnsResponse(name string, ttl uint32) (key dnsCacheKey, response *dns.Msg) {
+	response = new(dns.Msg)
+	response.SetQuestion(dns.Fqdn(name), dns.TypeA)
+	record, _ := dns.NewRR(dns.Fqdn(name) + " " + strconv.Itoa(int(ttl)) + " IN A 10.0.0.1")
+	response.Answer = append(response.Answer, record)
+	key, _ = newDnsCacheKey(response)
+	return
+}
+
+// Adds responses which live for a minute to the cache, one microsecond apart, returning their keys.
+func fillDnsCache(cache *dnsCache, count int, now time.Time) (keys []dnsCacheKey) {
+	for i := 0; i < count; i++ {
+		key, response := newTestDnsResponse("name"+strconv.Itoa(i)+".example.com", 60)
+		cache.put(key, response, now.Add(time.Duration(i)*time.Microsecond))
+		keys = append(keys, key)
+	}
+	return
+}
+
+func TestDnsCacheEvictsExpiredResponsesFirst(t *testing.T) {
+	cache := newDnsCache()
+	now := time.Now()
+	expiring, response := newTestDnsResponse("expiring.example.com", 1)
+	cache.put(expiring, response, now)
+	keys := fillDnsCache(cache, DnsCacheMaxEntries-1, now)
+
+	now = now.Add(2 * time.Second)
+	key, response := newTestDnsResponse("new.example.com", 60)
+	cache.put(key, response, now)
+	if cache.get(key, now) == nil {
+		t.Error("Expected the new response to be cached")
+	}
+	for _, existing := range keys {
+		if cache.get(existing, now) == nil {
+			t.Fatalf("Expected %s to be kept while an expired response could be evicted", existing.name)
+		}
+	}
+}
+
+func TestDnsCacheKeepsRecentlyUsedResponses(t *testing.T) {
+	cache := newDnsCache()
+	now := time.Now()
+	keys := fillDnsCache(cache, DnsCacheMaxEntries, now)
+	hot := keys[0]
+	now = now.Add(time.Second)
+	if cache.get(hot, now) == nil {
+		t.Fatal("Expected the response to be cached")
+	}
+
+	// A burst of new names evicts the responses which were not used since they were cached.
+	for i := 0; i < 100; i++ {
+		now = now.Add(time.Millisecond)
+		key, response := newTestDnsResponse("burst"+strconv.Itoa(i)+".example.com", 60)
+		cache.put(key, response, now)
+	}
+	if len(cache.entries) != DnsCacheMaxEntries {
+		t.Errorf("Expected the cache to hold %d responses, got %d", DnsCacheMaxEntries, len(cache.entries))
+	}
+	if cache.get(hot, now) == nil {
+		t.Error("Expected the recently used response to be kept")
+	}
+	if cache.get(keys[1], now) != nil {
+		t.Error("Expected the least recently used response to be evicted")
+	}
+}
+
+// The client's signature and EDNS0 options are not sent upstream, though its request for DNSSEC records is.
+func TestUpstreamDnsRequestDropsClientOptions(t *testing.T) {
+	for _, dnssec := range []bool{false, true} {
+		request := new(dns.Msg)
+		request.SetQuestion("example.com.", dns.TypeA)
+		request.SetEdns0(512, dnssec)
+		request.SetTsig("key.", dns.HmacSHA256, DnsTsigFudge, time.Now().Unix())
+
+		upstream := newUpstreamDnsRequest(request)
+		if upstream.IsTsig() != nil {
+			t.Error("Expected the client's signature not to be forwarded")
+		}
+		opt := upstream.IsEdns0()
+		if opt == nil || opt.UDPSize() != DnsUdpSize || opt.Do() != dnssec {
+			t.Errorf("Expected the server's options with DNSSEC %v, got %v", dnssec, opt)
+		}
+		if request.IsTsig() == nil || request.IsEdns0().UDPSize() != 512 {
+			t.Error("Expected the client's request to be unchanged")
+		}
+	}
+}
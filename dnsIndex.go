@@ -0,0 +1,184 @@
+package daprdockr
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The instances and static records which the DNS server answers for, indexed by name. Rebuilt whenever they change.
+// Names are relative to the zone and in lower case, eg: "0.api.web", "api.web" or "web".
+type dnsIndex struct {
+	zone         string
+	serial       uint32                    // Serial number of this version of the zone.
+	nameserverIp net.IP                    // Address of the zone's nameserver.
+	instances    map[string]*Instance      // By instance name.
+	services     map[string][]*Instance    // By service name, ordered by instance number.
+	groups       map[string][]*Instance    // By group name, ordered by service name and instance number.
+	addresses    map[string][]*Instance    // By canonical IP address, eg: "10.0.0.1".
+	hostPorts    map[string]*HostPortOwner // By host address, port and protocol, eg: "10.0.0.1:49153/tcp".
+	records      map[string]*DnsRecord     // Static records by name.
+	parents      map[string]bool           // Names which only exist as parents of static records, eg: "_tcp.db".
+}
+
+// The instance which a host port is mapped to.
+type HostPortOwner struct {
+	Instance      string    // Eg: "0.api.web".
+	Name          string    // Eg: "0.api.web.container".
+	ContainerPort string    // The port within the instance, as in the instance's port mappings, eg: "80" or "53/udp".
+	Record        *Instance // The instance's record.
+}
+
+func newDnsIndex(instances map[string]*Instance, records map[string]*DnsRecord, zone string) (index *dnsIndex) {
+	index = &dnsIndex{
+		zone:      zone,
+		instances: make(map[string]*Instance, len(instances)),
+		services:  make(map[string][]*Instance),
+		groups:    make(map[string][]*Instance),
+		addresses: make(map[string][]*Instance),
+		hostPorts: make(map[string]*HostPortOwner),
+		records:   records,
+		parents:   make(map[string]bool),
+	}
+	for name := range records {
+		for labels := strings.Split(name, "."); len(labels) > 1; labels = labels[1:] {
+			index.parents[strings.Join(labels[1:], ".")] = true
+		}
+	}
+	sorted := make([]*Instance, 0, len(instances))
+	for _, instance := range instances {
+		sorted = append(sorted, instance)
+	}
+	sort.Sort(instancesByName(sorted))
+	for _, instance := range sorted {
+		group := strings.ToLower(instance.Group)
+		service := strings.ToLower(instance.Service) + "." + group
+		index.instances[strings.ToLower(instance.QualifiedName())] = instance
+		index.services[service] = append(index.services[service], instance)
+		index.groups[group] = append(index.groups[group], instance)
+		for _, addr := range instance.Addrs {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				continue
+			}
+			index.addresses[ip.String()] = append(index.addresses[ip.String()], instance)
+			for containerPort, hostPort := range instance.PortMappings {
+				_, protocol := splitPortMappingKey(containerPort)
+				index.hostPorts[hostPortKey(ip, hostPort, protocol)] = &HostPortOwner{
+					Instance:      instance.QualifiedName(),
+					Name:          instance.FullyQualifiedDomainName(zone),
+					ContainerPort: containerPort,
+					Record:        instance,
+				}
+			}
+		}
+	}
+	return
+}
+
+// Returns the instances which a name refers to: a single instance, all instances of a service or all instances of a group.
+func (this *dnsIndex) lookup(name string) (instances []*Instance) {
+	switch strings.Count(name, ".") {
+	case 2: // <instance>.<service>.<group>
+		if instance, exists := this.instances[name]; exists {
+			instances = []*Instance{instance}
+		}
+	case 1: // <service>.<group>
+		instances = this.services[name]
+	case 0: // <group>
+		instances = this.groups[name]
+	}
+	return
+}
+
+// Returns the instances which run at an address.
+func (this *dnsIndex) reverse(ip net.IP) (instances []*Instance) {
+	return this.addresses[ip.String()]
+}
+
+// Returns the instance which a host port is mapped to, or nil if it is not mapped. The protocol is "tcp" or "udp".
+func (this *dnsIndex) hostPort(ip net.IP, port, protocol string) *HostPortOwner {
+	return this.hostPorts[hostPortKey(ip, port, protocol)]
+}
+
+func hostPortKey(ip net.IP, port, protocol string) string {
+	return net.JoinHostPort(ip.String(), port) + "/" + strings.ToLower(protocol)
+}
+
+// Returns the address which a reverse lookup name refers to, eg: 10.0.0.1 for "1.0.0.10.in-addr.arpa.", or nil if
+// the name is not a complete IPv4 or IPv6 reverse lookup name.
+func reverseNameAddress(name string) (ip net.IP) {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	switch {
+	case strings.HasSuffix(name, ".in-addr.arpa"):
+		labels := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa"), ".")
+		if len(labels) != net.IPv4len {
+			return nil
+		}
+		for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+			labels[i], labels[j] = labels[j], labels[i]
+		}
+		return net.ParseIP(strings.Join(labels, ".")).To4()
+	case strings.HasSuffix(name, ".ip6.arpa"):
+		nibbles := strings.Split(strings.TrimSuffix(name, ".ip6.arpa"), ".")
+		if len(nibbles) != 2*net.IPv6len {
+			return nil
+		}
+		ip = make(net.IP, net.IPv6len)
+		for i, nibble := range nibbles {
+			value, err := strconv.ParseUint(nibble, 16, 8)
+			if err != nil || len(nibble) != 1 {
+				return nil
+			}
+			// The least significant nibble comes first.
+			position := len(nibbles) - 1 - i
+			ip[position/2] |= byte(value) << (4 * uint(1-position%2))
+		}
+		return
+	}
+	return nil
+}
+
+// Returns the absolute domain name of an instance, eg: "0.api.web.container.".
+func (this *dnsIndex) domainName(instance *Instance) string {
+	return instance.FullyQualifiedDomainName(this.zone) + "."
+}
+
+// Returns the name of a query relative to the zone in lower case, eg: "0.api.web" for "0.API.web.container." in the
+// "container" zone, "" for the zone itself, or false if the name is not within the zone.
+func dnsRelativeName(name, zone string) (relative string, ok bool) {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	if name == zone {
+		return "", true
+	}
+	if !strings.HasSuffix(name, "."+zone) {
+		return "", false
+	}
+	return strings.TrimSuffix(name, "."+zone), true
+}
+
+// Returns the instances starting at the provided offset, wrapping around, so that successive answers are rotated.
+func rotateInstances(instances []*Instance, offset uint32) (rotated []*Instance) {
+	if len(instances) == 0 {
+		return
+	}
+	start := int(offset % uint32(len(instances)))
+	rotated = make([]*Instance, 0, len(instances))
+	rotated = append(rotated, instances[start:]...)
+	return append(rotated, instances[:start]...)
+}
+
+type instancesByName []*Instance
+
+func (this instancesByName) Len() int      { return len(this) }
+func (this instancesByName) Swap(i, j int) { this[i], this[j] = this[j], this[i] }
+func (this instancesByName) Less(i, j int) bool {
+	if this[i].Group != this[j].Group {
+		return this[i].Group < this[j].Group
+	}
+	if this[i].Service != this[j].Service {
+		return this[i].Service < this[j].Service
+	}
+	return this[i].Instance < this[j].Instance
+}
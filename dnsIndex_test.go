@@ -0,0 +1,112 @@
+package daprdockr
+
+import (
+	"github.com/miekg/dns"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Returns two instances of a service, one of them with an IPv6 address, and another service in the same group on the
+// first instance's host.
+func newTestDnsInstances() map[string]*Instance {
+	return map[string]*Instance{
+		"0.api.web": {
+			Group: "web", Service: "api", Instance: 0, Addrs: []string{"10.0.0.1"},
+			PortMappings: map[string]string{"80": "49153", "53/udp": "49154"},
+			Image:        "nginx", ContainerId: "c0", Owner: "node-1", Agent: "10.0.0.1:2375",
+			Started: time.Date(2014, 3, 1, 12, 0, 0, 0, time.UTC), Revision: "r1",
+		},
+		"1.api.web": {Group: "web", Service: "api", Instance: 1, Addrs: []string{"10.0.0.2", "2001:db8::2"}, PortMappings: map[string]string{"80": "49155"}},
+		"0.db.web":  {Group: "web", Service: "db", Instance: 0, Addrs: []string{"10.0.0.1"}, PortMappings: map[string]string{"5432": "49156"}},
+	}
+}
+
+func newTestDnsIndex() *dnsIndex {
+	return newDnsIndex(newTestDnsInstances(), nil, DefaultZone)
+}
+
+// Returns the data of each record, without its header, eg: "10.0.0.1" for an A record.
+func dnsRecordData(records []dns.RR) (data []string) {
+	data = make([]string, 0, len(records))
+	for _, record := range records {
+		data = append(data, strings.TrimPrefix(record.String(), record.Header().String()))
+	}
+	return
+}
+
+// Answers to the question for a name relative to the test zone, returning the data of the answers and extra records.
+func answerTestDnsQuestion(index *dnsIndex, name string, qtype uint16, rotation uint32) (answers, extra []string, exists bool) {
+	question := dns.Question{Name: name + "." + DefaultZone + ".", Qtype: qtype, Qclass: dns.ClassINET}
+	answerRecords, extraRecords, exists := index.answer(question, name, rotation)
+	for _, record := range answerRecords {
+		if record.Header().Name != question.Name {
+			answers = append(answers, "wrong name: "+record.String())
+		}
+	}
+	return append(answers, dnsRecordData(answerRecords)...), dnsRecordData(extraRecords), exists
+}
+
+func TestDnsAddressAnswers(t *testing.T) {
+	index := newTestDnsIndex()
+	tests := []struct {
+		name     string
+		qtype    uint16
+		rotation uint32
+		answers  []string
+		exists   bool
+	}{
+		{"0.api.web", dns.TypeA, 0, []string{"10.0.0.1"}, true},
+		{"0.api.web", dns.TypeA, 1, []string{"10.0.0.1"}, true},
+		{"0.api.web", dns.TypeAAAA, 0, []string{}, true},
+		{"1.api.web", dns.TypeAAAA, 0, []string{"2001:db8::2"}, true},
+		{"1.api.web", dns.TypeANY, 0, []string{"10.0.0.2", "2001:db8::2", `"instance=1.api.web" "addr=10.0.0.2" "addr=2001:db8::2" "port_80=49155"`}, true},
+
+		// Services and groups rotate through their instances, omitting repeated addresses.
+		{"api.web", dns.TypeA, 0, []string{"10.0.0.1", "10.0.0.2"}, true},
+		{"api.web", dns.TypeA, 1, []string{"10.0.0.2", "10.0.0.1"}, true},
+		{"api.web", dns.TypeA, 2, []string{"10.0.0.1", "10.0.0.2"}, true},
+		{"api.web", dns.TypeAAAA, 1, []string{"2001:db8::2"}, true},
+		{"web", dns.TypeA, 0, []string{"10.0.0.1", "10.0.0.2"}, true},
+		{"web", dns.TypeA, 1, []string{"10.0.0.2", "10.0.0.1"}, true},
+		{"web", dns.TypeA, 2, []string{"10.0.0.1", "10.0.0.2"}, true},
+
+		{"2.api.web", dns.TypeA, 0, []string{}, false},
+		{"cache.web", dns.TypeA, 0, []string{}, false},
+		{"mail", dns.TypeA, 0, []string{}, false},
+	}
+	for _, test := range tests {
+		answers, _, exists := answerTestDnsQuestion(index, test.name, test.qtype, test.rotation)
+		if exists != test.exists || strings.Join(answers, ",") != strings.Join(test.answers, ",") {
+			t.Errorf("%s %s, rotation %d: expected %v, exists: %v, got %v, exists: %v", test.name, dns.TypeToString[test.qtype], test.rotation, test.answers, test.exists, answers, exists)
+		}
+	}
+}
+
+func TestReverseNameAddress(t *testing.T) {
+	ip6, _ := dns.ReverseAddr("2001:db8::2")
+	tests := []struct {
+		name string
+		ip   string // Empty if the name is not a reverse lookup name.
+	}{
+		{"1.0.0.10.in-addr.arpa.", "10.0.0.1"},
+		{"1.0.0.10.IN-ADDR.ARPA", "10.0.0.1"},
+		{ip6, "2001:db8::2"},
+		{strings.ToUpper(ip6), "2001:db8::2"},
+		{"0.0.10.in-addr.arpa.", ""},
+		{"1.1.0.0.10.in-addr.arpa.", ""},
+		{"256.0.0.10.in-addr.arpa.", ""},
+		{"x.0.0.10.in-addr.arpa.", ""},
+		{strings.TrimPrefix(ip6, "2."), ""},
+		{"g." + strings.TrimPrefix(ip6, "2."), ""},
+		{"12." + strings.TrimPrefix(ip6, "2."), ""},
+		{"1.0.0.10.in-addr.example.", ""},
+		{"in-addr.arpa.", ""},
+	}
+	for _, test := range tests {
+		ip := reverseNameAddress(test.name)
+		if (ip == nil) != (len(test.ip) == 0) || (ip != nil && ip.String() != test.ip) {
+			t.Errorf("%s: expected %q, got %v", test.name, test.ip, ip)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+// Static DNS records within the zone, for hosts which the cluster does not run and for aliases of its services.
+package daprdockr
+
+import (
+	"context"
+	"encoding/json"
+	goerrors "errors"
+	"github.com/miekg/dns"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DnsRecordsKey             = "config/dns" // Holds a static record at "config/dns/<name>" for each name.
+	FullDnsRecordSyncInterval = 65           // Seconds
+)
+
+// Types of static records.
+const (
+	DnsRecordA     = "A"     // Addresses, which are answered as A or AAAA records according to their family.
+	DnsRecordCname = "CNAME" // An alias of another name, such as a service or a host outside the zone.
+	DnsRecordSrv   = "SRV"   // A service at a port of another name.
+)
+
+// A static record of a name within the zone. Targets ending with a dot are fully qualified, eg: "db.example.com.",
+// and others are relative to the zone, eg: "api.web".
+type DnsRecord struct {
+	Name     string   `json:"-"` // Relative to the zone and in lower case, eg: "db" or "_postgres._tcp.db".
+	Type     string   // DnsRecordA, DnsRecordCname or DnsRecordSrv.
+	Addrs    []string `json:",omitempty"` // IPv4 or IPv6 addresses of an A record.
+	Target   string   `json:",omitempty"` // The name which a CNAME or SRV record refers to.
+	Port     uint16   `json:",omitempty"`
+	Priority uint16   `json:",omitempty"`
+	Weight   uint16   `json:",omitempty"`
+	Ttl      uint32   `json:",omitempty"` // Seconds which resolvers may cache the record. Default: 0, as for instances.
+}
+
+func (this *DnsRecord) Key() string {
+	return DnsRecordsKey + "/" + this.Name
+}
+
+// Checks that the record can be served, normalizing its name and type.
+func (this *DnsRecord) Validate() (err error) {
+	this.Name = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(this.Name)), ".")
+	this.Type = strings.ToUpper(this.Type)
+	if _, ok := dns.IsDomainName(this.Name); !ok || len(this.Name) == 0 || strings.Contains(this.Name, "/") {
+		return goerrors.New("Invalid DNS record name: " + this.Name)
+	}
+	if this.Name == DnsNameserverLabel {
+		return goerrors.New("DNS record name is reserved for the nameserver: " + this.Name)
+	}
+	switch this.Type {
+	case DnsRecordA:
+		if len(this.Addrs) == 0 {
+			return goerrors.New("DNS record has no addresses: " + this.Name)
+		}
+		for _, addr := range this.Addrs {
+			if net.ParseIP(addr) == nil {
+				return goerrors.New("Invalid address in DNS record " + this.Name + ": " + addr)
+			}
+		}
+	case DnsRecordCname, DnsRecordSrv:
+		if _, ok := dns.IsDomainName(this.Target); !ok || len(strings.TrimSuffix(this.Target, ".")) == 0 {
+			return goerrors.New("Invalid target of DNS record " + this.Name + ": " + this.Target)
+		}
+		if this.Type == DnsRecordSrv && this.Port == 0 {
+			return goerrors.New("DNS record has no port: " + this.Name)
+		}
+	default:
+		return goerrors.New("Invalid DNS record type, expected A, CNAME or SRV: " + this.Type)
+	}
+	return
+}
+
+// Adds or replaces the static record of a name.
+func SetDnsRecord(store Store, record *DnsRecord) (err error) {
+	if err = record.Validate(); err != nil {
+		return
+	}
+	encoded, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	_, err = store.Set(record.Key(), string(encoded), 0)
+	return
+}
+
+// Removes the static record of a name.
+func DeleteDnsRecord(store Store, name string) (err error) {
+	record := &DnsRecord{Name: strings.TrimSuffix(strings.ToLower(name), ".")}
+	return store.Delete(record.Key())
+}
+
+// Returns the static records by name. Records which cannot be parsed are skipped.
+func GetDnsRecords(store Store) (records map[string]*DnsRecord, err error) {
+	nodes, err := store.List(DnsRecordsKey)
+	if err != nil {
+		return
+	}
+	records = make(map[string]*DnsRecord, len(nodes))
+	for _, node := range nodes {
+		record, err := parseDnsRecord(node)
+		if err != nil {
+			dnsLog.Warn("Unable to parse DNS record", "key", node.Key, "error", err)
+			continue
+		}
+		records[record.Name] = record
+	}
+	return records, nil
+}
+
+func parseDnsRecord(node *StoreNode) (record *DnsRecord, err error) {
+	record = new(DnsRecord)
+	if err = json.Unmarshal([]byte(node.Value), record); err != nil {
+		return
+	}
+	record.Name = strings.TrimPrefix(node.Key, DnsRecordsKey+"/")
+	err = record.Validate()
+	return
+}
+
+// Returns a channel publishing the static records whenever they change, which is closed once the context is done.
+// The goroutines are tracked by the wait group.
+func (this *Agent) currentDnsRecords(ctx context.Context, wg *sync.WaitGroup) (current chan map[string]*DnsRecord) {
+	current = make(chan map[string]*DnsRecord)
+	changes := this.watchPrefix(ctx, DnsRecordsKey, wg)
+	goTracked(wg, func() {
+		defer close(current)
+		var published map[string]*DnsRecord
+		fullSync := time.NewTicker(FullDnsRecordSyncInterval * time.Second)
+		defer fullSync.Stop()
+		for {
+			// Records are few, so each change is applied by reading them all again.
+			if records, err := GetDnsRecords(this.store); err != nil {
+				dnsLog.Error("Unable to get DNS records", "error", err)
+			} else if published == nil || !reflect.DeepEqual(records, published) {
+				published = records
+				select {
+				case current <- records:
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-fullSync.C:
+			case <-changes:
+			}
+		}
+	})
+	return
+}
+
+// Returns the records of a static record's name of the requested type, or all of them for TypeANY. The addresses
+// of A records are rotated.
+func (this *dnsIndex) staticRecords(name string, record *DnsRecord, qtype uint16, rotation uint32) (records []dns.RR) {
+	header := dns.RR_Header{Name: name, Class: dns.ClassINET, Ttl: record.Ttl}
+	switch record.Type {
+	case DnsRecordA:
+		addrs := make([]*Instance, 0, len(record.Addrs))
+		for _, addr := range record.Addrs {
+			addrs = append(addrs, &Instance{Addrs: []string{addr}})
+		}
+		for _, addressType := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			if qtype == addressType || qtype == dns.TypeANY {
+				for _, address := range addressRecords(dns.Question{Name: name, Qtype: addressType}, rotateInstances(addrs, rotation)) {
+					address.Header().Ttl = record.Ttl
+					records = append(records, address)
+				}
+			}
+		}
+	case DnsRecordCname:
+		header.Rrtype = dns.TypeCNAME
+		records = append(records, &dns.CNAME{Hdr: header, Target: this.staticTarget(record.Target)})
+	case DnsRecordSrv:
+		if qtype == dns.TypeSRV || qtype == dns.TypeANY {
+			header.Rrtype = dns.TypeSRV
+			records = append(records, &dns.SRV{
+				Hdr:      header,
+				Priority: record.Priority,
+				Weight:   record.Weight,
+				Port:     record.Port,
+				Target:   this.staticTarget(record.Target),
+			})
+		}
+	}
+	return
+}
+
+// Returns the fully qualified name of a static record's target.
+func (this *dnsIndex) staticTarget(target string) string {
+	if strings.HasSuffix(target, ".") {
+		return strings.ToLower(target)
+	}
+	return strings.ToLower(target) + "." + this.zone + "."
+}
+
+// Returns the names of the static records, sorted, omitting those which the nameserver or instances take precedence over.
+func (this *dnsIndex) staticNames() (names []string) {
+	for name := range this.records {
+		if !this.staticRecordHidden(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return
+}
+
+// Determines whether the static record of a name is hidden by the nameserver, by instances, or by the SRV records of
+// their ports, including named ports such as "_http._tcp.api.web", which queries answer in preference to it.
+func (this *dnsIndex) staticRecordHidden(name string) bool {
+	if name == DnsNameserverLabel || len(this.lookup(name)) > 0 {
+		return true
+	}
+	answers, _ := srvRecords(dns.Question{Name: name + "." + this.zone + ".", Qtype: dns.TypeSRV}, name, this, 0)
+	return len(answers) > 0
+}
@@ -0,0 +1,203 @@
+// Transfers of the zone to secondary DNS servers, as in RFC 5936 (AXFR), RFC 1995 (IXFR) and RFC 1996 (NOTIFY).
+package daprdockr
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	DnsZoneHistory   = 16  // Versions of the zone kept so that secondary servers can transfer only what changed.
+	DnsTransferChunk = 100 // Records sent in each message of a zone transfer.
+	DnsNotifyTimeout = 2   // Seconds to wait for a secondary server to acknowledge a notification.
+)
+
+// The recent versions of the zone, oldest first.
+type dnsZoneVersions struct {
+	lock     sync.Mutex
+	versions []*dnsZoneVersion
+}
+
+type dnsZoneVersion struct {
+	soa     dns.RR
+	serial  uint32
+	records []dns.RR          // Excluding the SOA record.
+	keys    map[string]dns.RR // The records by their text.
+}
+
+func newDnsZoneVersions() *dnsZoneVersions {
+	return &dnsZoneVersions{}
+}
+
+// Records the current version of the zone, given its records.
+func (this *dnsZoneVersions) add(index *dnsIndex, records []dns.RR) {
+	version := &dnsZoneVersion{soa: index.soa(), serial: index.serial, records: records}
+	version.keys = make(map[string]dns.RR, len(version.records))
+	for _, record := range version.records {
+		version.keys[record.String()] = record
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.versions = append(this.versions, version)
+	if len(this.versions) > DnsZoneHistory {
+		this.versions = this.versions[len(this.versions)-DnsZoneHistory:]
+	}
+}
+
+// Returns the records which transfer the whole zone: the SOA record, the other records, then the SOA record again.
+func (this *dnsZoneVersions) full() (records []dns.RR) {
+	current := this.latest()
+	if current == nil {
+		return
+	}
+	records = append(records, current.soa)
+	records = append(records, current.records...)
+	return append(records, current.soa)
+}
+
+// Returns the records which transfer the changes to the zone since the version with the provided serial, condensed
+// into a single difference: the current SOA record, the old SOA record and the deleted records, then the current SOA
+// record and the added records, then the current SOA record again. Only the current SOA record is returned if the zone
+// has not changed. Returns nil if the version is no longer known.
+func (this *dnsZoneVersions) since(serial uint32) (records []dns.RR) {
+	this.lock.Lock()
+	var previous, current *dnsZoneVersion
+	for _, version := range this.versions {
+		if version.serial == serial {
+			previous = version
+		}
+	}
+	if len(this.versions) > 0 {
+		current = this.versions[len(this.versions)-1]
+	}
+	this.lock.Unlock()
+	if previous == nil || current == nil {
+		return nil
+	}
+	if previous == current {
+		return []dns.RR{current.soa}
+	}
+
+	records = append(records, current.soa, previous.soa)
+	for _, record := range previous.records {
+		if _, kept := current.keys[record.String()]; !kept {
+			records = append(records, record)
+		}
+	}
+	records = append(records, current.soa)
+	for _, record := range current.records {
+		if _, existed := previous.keys[record.String()]; !existed {
+			records = append(records, record)
+		}
+	}
+	return append(records, current.soa)
+}
+
+func (this *dnsZoneVersions) latest() *dnsZoneVersion {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if len(this.versions) == 0 {
+		return nil
+	}
+	return this.versions[len(this.versions)-1]
+}
+
+// Answers an AXFR or IXFR request from a secondary server. Transfers are refused unless the server is one of the
+// agent's secondaries and the request was made over TCP, except that an IXFR over UDP is answered with the current SOA
+// record, which tells the server whether it must transfer the zone over TCP.
+func (this *Agent) transferZone(writer dns.ResponseWriter, request *dns.Msg) {
+	question := request.Question[0]
+	response := new(dns.Msg)
+	response.SetReply(request)
+	response.Authoritative = true
+	_, overTcp := writer.RemoteAddr().(*net.TCPAddr)
+	if !this.isDnsSecondary(writer.RemoteAddr()) || (!overTcp && question.Qtype == dns.TypeAXFR) {
+		dnsLog.Info("Refused zone transfer", "client", writer.RemoteAddr(), "type", dns.TypeToString[question.Qtype])
+		this.metrics.dnsQueries.Inc("container", dns.TypeToString[question.Qtype], "refused")
+		response.Rcode = dns.RcodeRefused
+		fitDnsResponse(writer, request, response)
+		writer.WriteMsg(response)
+		return
+	}
+
+	current := this.dnsZone.latest()
+	if current == nil {
+		this.metrics.dnsQueries.Inc("container", dns.TypeToString[question.Qtype], "unavailable")
+		response.Rcode = dns.RcodeServerFailure
+		fitDnsResponse(writer, request, response)
+		writer.WriteMsg(response)
+		return
+	}
+	if !overTcp {
+		this.metrics.dnsQueries.Inc("container", dns.TypeToString[question.Qtype], "answered")
+		response.Answer = []dns.RR{current.soa}
+		fitDnsResponse(writer, request, response)
+		writer.WriteMsg(response)
+		return
+	}
+
+	var records []dns.RR
+	if question.Qtype == dns.TypeIXFR {
+		// The secondary server's version of the zone is given by the SOA record in the authority section.
+		for _, record := range request.Ns {
+			if soa, ok := record.(*dns.SOA); ok {
+				records = this.dnsZone.since(soa.Serial)
+			}
+		}
+	}
+	if records == nil {
+		records = this.dnsZone.full()
+	}
+	dnsLog.Debug("Transferring zone", "client", writer.RemoteAddr(), "type", dns.TypeToString[question.Qtype], "records", len(records))
+	this.metrics.dnsQueries.Inc("container", dns.TypeToString[question.Qtype], "transferred")
+	for start := 0; start < len(records); start += DnsTransferChunk {
+		end := start + DnsTransferChunk
+		if end > len(records) {
+			end = len(records)
+		}
+		message := new(dns.Msg)
+		message.SetReply(request)
+		message.Authoritative = true
+		message.Compress = true
+		message.Answer = records[start:end]
+		if err := writer.WriteMsg(message); err != nil {
+			dnsLog.Warn("Error transferring zone", "client", writer.RemoteAddr(), "error", err)
+			return
+		}
+	}
+}
+
+// Returns whether the address belongs to one of the agent's secondary servers.
+func (this *Agent) isDnsSecondary(addr net.Addr) bool {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	for _, secondary := range this.dnsSecondaries {
+		if secondaryHost, _, err := net.SplitHostPort(secondary); err == nil && ip.Equal(net.ParseIP(secondaryHost)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Notifies each secondary server that the zone has changed, so that it transfers the changes without waiting to
+// refresh. The notifications are tracked by the wait group.
+func (this *Agent) notifyDnsSecondaries(soa dns.RR, wg *sync.WaitGroup) {
+	for _, secondary := range this.dnsSecondaries {
+		secondary := secondary
+		goTracked(wg, func() {
+			notify := new(dns.Msg)
+			notify.SetNotify(this.zone + ".")
+			notify.Answer = []dns.RR{soa}
+			client := &dns.Client{Net: "udp", Timeout: DnsNotifyTimeout * time.Second}
+			if _, _, err := client.Exchange(notify, secondary); err != nil {
+				dnsLog.Warn("Error notifying secondary server", "server", secondary, "error", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,234 @@
+package daprdockr
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Returns the instances of a service.
+func newTestZoneInstances(count int) (instances map[string]*Instance) {
+	instances = make(map[string]*Instance)
+	for i := 0; i < count; i++ {
+		instance := &Instance{Group: "web", Service: "api", Instance: i, Addrs: []string{"10.0.1." + strconv.Itoa(i)}, PortMappings: map[string]string{"80": strconv.Itoa(49153 + i)}}
+		instances[instance.QualifiedName()] = instance
+	}
+	return
+}
+
+// Adds a version of the zone holding the instances, returning its index.
+func addTestZoneVersion(versions *dnsZoneVersions, instances map[string]*Instance, serial uint32) (index *dnsIndex) {
+	index = newDnsIndex(instances, nil, DefaultZone)
+	index.serial = serial
+	versions.add(index, index.zoneRecords())
+	return
+}
+
+// Returns the serial of an SOA record, or 0 if the record is not an SOA record.
+func soaSerial(record dns.RR) uint32 {
+	if soa, ok := record.(*dns.SOA); ok {
+		return soa.Serial
+	}
+	return 0
+}
+
+// Checks that the records transfer the changes from one version of the zone to another, failing the test if they do not.
+func checkZoneDifference(t *testing.T, description string, records []dns.RR, from, to *dnsIndex) {
+	if len(records) < 4 || soaSerial(records[0]) != to.serial || soaSerial(records[1]) != from.serial || soaSerial(records[len(records)-1]) != to.serial {
+		t.Errorf("%s: expected the changes from serial %d to %d, got %v", description, from.serial, to.serial, records)
+		return
+	}
+	zone := make(map[string]bool)
+	for _, record := range from.zoneRecords() {
+		zone[record.String()] = true
+	}
+	adding := false
+	for _, record := range records[2 : len(records)-1] {
+		_, isSoa := record.(*dns.SOA)
+		switch {
+		case isSoa:
+			adding = true
+		case adding:
+			zone[record.String()] = true
+		default:
+			delete(zone, record.String())
+		}
+	}
+	expected := to.zoneRecords()
+	for _, record := range expected {
+		if !zone[record.String()] {
+			t.Errorf("%s: expected %q to be added", description, record.String())
+		}
+	}
+	if len(zone) != len(expected) {
+		t.Errorf("%s: expected %d records once the changes are applied, got %d", description, len(expected), len(zone))
+	}
+}
+
+func TestDnsZoneVersionsSince(t *testing.T) {
+	versions := newDnsZoneVersions()
+	first := addTestZoneVersion(versions, newTestZoneInstances(3), 1000)
+	second := addTestZoneVersion(versions, newTestZoneInstances(2), 1001)
+
+	checkZoneDifference(t, "known serial", versions.since(first.serial), first, second)
+	if records := versions.since(second.serial); len(records) != 1 || soaSerial(records[0]) != second.serial {
+		t.Errorf("Expected only the SOA record for the current serial, got %v", records)
+	}
+	if records := versions.since(999); records != nil {
+		t.Errorf("Expected no changes from an unknown serial, got %v", records)
+	}
+
+	// The serial wraps around after 2^32 - 1, as in RFC 1982.
+	wrapped := addTestZoneVersion(versions, newTestZoneInstances(4), 1<<32-1)
+	if serial := nextDnsSerial(wrapped.serial, time.Unix(1000, 0)); serial != 0 {
+		t.Fatalf("Expected the serial to wrap around to 0, got %d", serial)
+	}
+	current := addTestZoneVersion(versions, newTestZoneInstances(1), 0)
+	checkZoneDifference(t, "wrapped serial", versions.since(wrapped.serial), wrapped, current)
+	checkZoneDifference(t, "serial before wrapping", versions.since(first.serial), first, current)
+
+	// Only the most recent versions are kept.
+	for i := 0; i < DnsZoneHistory; i++ {
+		addTestZoneVersion(versions, newTestZoneInstances(i+1), uint32(i+1))
+	}
+	if records := versions.since(first.serial); records != nil {
+		t.Errorf("Expected no changes from a version which is no longer kept, got %v", records)
+	}
+}
+
+func TestTransferZone(t *testing.T) {
+	agent, err := NewAgent(AgentOptions{Store: NewMemoryStore(), Runtime: NewFakeRuntime(), HostIp: net.ParseIP("10.0.0.1"), DnsSecondaries: []string{"10.0.0.9"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := addTestZoneVersion(agent.dnsZone, newTestZoneInstances(60), 1000)
+	current := addTestZoneVersion(agent.dnsZone, newTestZoneInstances(59), 1001)
+	full := len(current.zoneRecords()) + 2
+	if full <= DnsTransferChunk {
+		t.Fatalf("Expected the zone to be transferred in several messages, got %d records", full)
+	}
+
+	secondary, other := net.ParseIP("10.0.0.9"), net.ParseIP("10.0.0.8")
+	tests := []struct {
+		name    string
+		qtype   uint16
+		serial  uint32 // Of the secondary server's version of the zone, for IXFR.
+		remote  net.Addr
+		rcode   int
+		records int // Zero for the changes since the secondary server's version.
+	}{
+		{"AXFR", dns.TypeAXFR, 0, &net.TCPAddr{IP: secondary, Port: 5353}, dns.RcodeSuccess, full},
+		{"IXFR", dns.TypeIXFR, first.serial, &net.TCPAddr{IP: secondary, Port: 5353}, dns.RcodeSuccess, 0},
+		{"IXFR from the current serial", dns.TypeIXFR, current.serial, &net.TCPAddr{IP: secondary, Port: 5353}, dns.RcodeSuccess, 1},
+		{"IXFR from an unknown serial", dns.TypeIXFR, 999, &net.TCPAddr{IP: secondary, Port: 5353}, dns.RcodeSuccess, full},
+		{"IXFR over UDP", dns.TypeIXFR, first.serial, &net.UDPAddr{IP: secondary, Port: 5353}, dns.RcodeSuccess, 1},
+		{"AXFR over UDP", dns.TypeAXFR, 0, &net.UDPAddr{IP: secondary, Port: 5353}, dns.RcodeRefused, 0},
+		{"AXFR from another server", dns.TypeAXFR, 0, &net.TCPAddr{IP: other, Port: 5353}, dns.RcodeRefused, 0},
+		{"IXFR from another server", dns.TypeIXFR, first.serial, &net.TCPAddr{IP: other, Port: 5353}, dns.RcodeRefused, 0},
+		{"IXFR over UDP from another server", dns.TypeIXFR, first.serial, &net.UDPAddr{IP: other, Port: 5353}, dns.RcodeRefused, 0},
+	}
+	for _, test := range tests {
+		request := new(dns.Msg)
+		request.SetQuestion(DefaultZone+".", test.qtype)
+		if test.qtype == dns.TypeIXFR {
+			request.Ns = []dns.RR{&dns.SOA{Hdr: dns.RR_Header{Name: DefaultZone + ".", Rrtype: dns.TypeSOA, Class: dns.ClassINET}, Serial: test.serial}}
+		}
+		writer := &testDnsWriter{remote: test.remote}
+		agent.transferZone(writer, request)
+
+		var records []dns.RR
+		for _, message := range writer.messages {
+			if message.Rcode != test.rcode || len(message.Answer) > DnsTransferChunk {
+				t.Errorf("%s: expected %s in messages of at most %d records, got %s with %d records", test.name, dns.RcodeToString[test.rcode], DnsTransferChunk, dns.RcodeToString[message.Rcode], len(message.Answer))
+			}
+			records = append(records, message.Answer...)
+		}
+		switch {
+		case test.rcode != dns.RcodeSuccess && len(records) > 0:
+			t.Errorf("%s: expected no records, got %d", test.name, len(records))
+		case test.rcode == dns.RcodeSuccess && test.records == 0:
+			checkZoneDifference(t, test.name, records, first, current)
+		case test.rcode == dns.RcodeSuccess && (len(records) != test.records || soaSerial(records[0]) != current.serial || soaSerial(records[len(records)-1]) != current.serial):
+			t.Errorf("%s: expected %d records between the current SOA records, got %d", test.name, test.records, len(records))
+		}
+	}
+}
+
+// The zone's serial changes, and secondary servers are notified, only when the zone's records change, rather than
+// whenever the instances are republished.
+func TestDnsSerialChangesWithZone(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	notifications := make(chan uint32, 10)
+	go func() {
+		buffer := make([]byte, dns.MaxMsgSize)
+		for {
+			n, addr, err := listener.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			notify := new(dns.Msg)
+			if notify.Unpack(buffer[:n]) != nil || notify.Opcode != dns.OpcodeNotify || len(notify.Answer) != 1 {
+				continue
+			}
+			notifications <- soaSerial(notify.Answer[0])
+			reply := new(dns.Msg)
+			reply.SetReply(notify)
+			packed, _ := reply.Pack()
+			listener.WriteTo(packed, addr)
+		}
+	}()
+
+	agent, err := NewAgent(AgentOptions{Store: NewMemoryStore(), Runtime: NewFakeRuntime(), HostIp: net.ParseIP("10.0.0.1"), DnsSecondaries: []string{listener.LocalAddr().String()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	defer wg.Wait()
+	defer cancel()
+	currentInstances := make(chan map[string]*Instance)
+	agent.createContainerHandler(ctx, currentInstances, make(chan map[string]*DnsRecord), &wg)
+	publish := func(instances map[string]*Instance) *dnsIndex {
+		previous := agent.currentDnsIndex()
+		currentInstances <- instances
+		waitFor(t, "the DNS index", func() bool { return agent.currentDnsIndex() != previous })
+		return agent.currentDnsIndex()
+	}
+	expectNotification := func(serial uint32) {
+		select {
+		case notified := <-notifications:
+			if notified != serial {
+				t.Errorf("Expected a notification of serial %d, got %d", serial, notified)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for a notification of serial %d", serial)
+		}
+	}
+
+	first := publish(newTestZoneInstances(2))
+	expectNotification(first.serial)
+	if republished := publish(newTestZoneInstances(2)); republished.serial != first.serial {
+		t.Errorf("Expected the serial to be kept while the zone is unchanged, got %d then %d", first.serial, republished.serial)
+	}
+	changed := publish(newTestZoneInstances(3))
+	if changed.serial == first.serial {
+		t.Errorf("Expected the serial to change with the zone, got %d", changed.serial)
+	}
+	expectNotification(changed.serial)
+	if records := agent.dnsZone.since(first.serial); records == nil {
+		t.Error("Expected the previous version of the zone to be kept")
+	}
+	select {
+	case serial := <-notifications:
+		t.Errorf("Expected no notification while the zone was unchanged, got serial %d", serial)
+	default:
+	}
+}
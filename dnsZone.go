@@ -0,0 +1,206 @@
+// Authoritative answers for the zone which instances are named within.
+package daprdockr
+
+import (
+	"github.com/miekg/dns"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	DnsNameserverLabel = "ns"  // Name of the zone's nameserver relative to the zone, which is the answering agent.
+	DnsNegativeTtl     = 5     // Seconds which resolvers may cache the absence of a name or record, which changes often.
+	DnsSoaRefresh      = 60    // Seconds after which secondary servers check for changes to the zone.
+	DnsSoaRetry        = 10    // Seconds after which secondary servers retry a failed check.
+	DnsSoaExpire       = 86400 // Seconds after which secondary servers stop answering if they cannot check for changes.
+)
+
+// Answers a question for a name relative to the zone, returning whether the name exists. A name which exists without
+// records of the requested type has no answers. Instances and the SRV records of their ports take precedence over
+// static records of the same name, which zone transfers omit likewise, as in staticRecordHidden.
+func (this *dnsIndex) answer(question dns.Question, name string, rotation uint32) (answers, extra []dns.RR, exists bool) {
+	return this.resolve(question, name, rotation, make(map[string]bool))
+}
+
+// Answers a question as answer does, following aliases within the zone unless they were already followed.
+func (this *dnsIndex) resolve(question dns.Question, name string, rotation uint32, followed map[string]bool) (answers, extra []dns.RR, exists bool) {
+	qtype := question.Qtype
+	switch name {
+	case "":
+		if qtype == dns.TypeSOA || qtype == dns.TypeANY {
+			answers = append(answers, this.soa())
+		}
+		if qtype == dns.TypeNS || qtype == dns.TypeANY {
+			answers = append(answers, this.nameserver())
+			extra = this.nameserverAddresses(this.nameserverName(), dns.TypeANY)
+		}
+		return answers, extra, true
+	case DnsNameserverLabel:
+		return this.nameserverAddresses(question.Name, qtype), nil, true
+	}
+
+	if instances := this.lookup(name); len(instances) > 0 {
+		if qtype == dns.TypeA || qtype == dns.TypeANY {
+			answers = append(answers, addressRecords(dns.Question{Name: question.Name, Qtype: dns.TypeA}, rotateInstances(instances, rotation))...)
+		}
+		if qtype == dns.TypeAAAA || qtype == dns.TypeANY {
+			answers = append(answers, addressRecords(dns.Question{Name: question.Name, Qtype: dns.TypeAAAA}, rotateInstances(instances, rotation))...)
+		}
+		if qtype == dns.TypeTXT || qtype == dns.TypeANY {
+			answers = append(answers, txtRecords(question, instances)...)
+		}
+		return answers, nil, true
+	}
+
+	// Service records exist for each port which an instance maps, and their parents, eg: "_tcp.api.web", exist too.
+	if answers, extra = srvRecords(question, name, this, rotation); len(answers) > 0 {
+		if qtype != dns.TypeSRV && qtype != dns.TypeANY {
+			answers, extra = nil, nil
+		}
+		return answers, extra, true
+	}
+	if record, exists := this.records[name]; exists {
+		if followed[name] {
+			// The alias leads back to a name which was already answered.
+			return nil, nil, true
+		}
+		followed[name] = true
+		answers = this.staticRecords(question.Name, record, qtype, rotation)
+		targetName := this.staticTarget(record.Target)
+		target, withinZone := dnsRelativeName(targetName, this.zone)
+		if !withinZone {
+			return answers, nil, true
+		}
+		switch {
+		case record.Type == DnsRecordCname && qtype != dns.TypeCNAME && qtype != dns.TypeANY:
+			// Answer for the alias's target as well, since it is within the zone.
+			targetAnswers, targetExtra, _ := this.resolve(dns.Question{Name: targetName, Qtype: qtype, Qclass: question.Qclass}, target, rotation, followed)
+			answers = append(answers, targetAnswers...)
+			extra = targetExtra
+		case record.Type == DnsRecordSrv && len(answers) > 0:
+			for _, addressType := range []uint16{dns.TypeA, dns.TypeAAAA} {
+				targetAnswers, _, _ := this.resolve(dns.Question{Name: targetName, Qtype: addressType, Qclass: question.Qclass}, target, rotation, map[string]bool{name: true})
+				extra = append(extra, targetAnswers...)
+			}
+		}
+		return answers, extra, true
+	}
+	parts := strings.SplitN(name, ".", 2)
+	if protocol := strings.TrimPrefix(parts[0], "_"); len(parts) == 2 && (protocol == "tcp" || protocol == "udp") {
+		if len(this.lookup(parts[1])) > 0 {
+			return nil, nil, true
+		}
+	}
+	return nil, nil, this.parents[name]
+}
+
+// Returns every record in the zone other than its SOA record, in a stable order: the nameserver, then the address and
+// TXT records of each group, service and instance, and SRV records for each port which they map, then the static
+// records. Named ports, such as "_http._tcp", are only answered by queries.
+func (this *dnsIndex) zoneRecords() (records []dns.RR) {
+	records = append(records, this.nameserver())
+	records = append(records, this.nameserverAddresses(this.nameserverName(), dns.TypeANY)...)
+
+	names := make([]string, 0, len(this.groups)+len(this.services)+len(this.instances))
+	for _, byName := range []map[string][]*Instance{this.groups, this.services} {
+		for name := range byName {
+			names = append(names, name)
+		}
+	}
+	for name := range this.instances {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if name == DnsNameserverLabel {
+			// The nameserver's name takes precedence over a group of the same name, as when answering.
+			continue
+		}
+		instances := this.lookup(name)
+		domainName := name + "." + this.zone + "."
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			records = append(records, addressRecords(dns.Question{Name: domainName, Qtype: qtype}, instances)...)
+		}
+		records = append(records, txtRecords(dns.Question{Name: domainName, Qtype: dns.TypeTXT}, instances)...)
+
+		ports := make([]string, 0)
+		seen := make(map[string]bool)
+		for _, instance := range instances {
+			for port := range instance.PortMappings {
+				if !seen[port] {
+					seen[port] = true
+					ports = append(ports, port)
+				}
+			}
+		}
+		sort.Strings(ports)
+		for _, key := range ports {
+			port, protocol := splitPortMappingKey(key)
+			srvName := "_" + port + "._" + protocol + "." + name
+			answers, _ := srvRecords(dns.Question{Name: srvName + "." + this.zone + ".", Qtype: dns.TypeSRV}, srvName, this, 0)
+			records = append(records, answers...)
+		}
+	}
+	for _, name := range this.staticNames() {
+		records = append(records, this.staticRecords(name+"."+this.zone+".", this.records[name], dns.TypeANY, 0)...)
+	}
+	return
+}
+
+// Returns the text of records, one per line, so that versions of the zone can be compared.
+func dnsRecordsText(records []dns.RR) string {
+	lines := make([]string, 0, len(records))
+	for _, record := range records {
+		lines = append(lines, record.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Returns the zone's start of authority, whose TTL and minimum TTL limit how long negative answers are cached.
+func (this *dnsIndex) soa() dns.RR {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: this.zone + ".", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: DnsNegativeTtl},
+		Ns:      this.nameserverName(),
+		Mbox:    "hostmaster." + this.zone + ".",
+		Serial:  this.serial,
+		Refresh: DnsSoaRefresh,
+		Retry:   DnsSoaRetry,
+		Expire:  DnsSoaExpire,
+		Minttl:  DnsNegativeTtl,
+	}
+}
+
+func (this *dnsIndex) nameserver() dns.RR {
+	return &dns.NS{
+		Hdr: dns.RR_Header{Name: this.zone + ".", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: DnsNegativeTtl},
+		Ns:  this.nameserverName(),
+	}
+}
+
+func (this *dnsIndex) nameserverName() string {
+	return DnsNameserverLabel + "." + this.zone + "."
+}
+
+// Returns the A or AAAA record of the nameserver's address, or both for TypeANY.
+func (this *dnsIndex) nameserverAddresses(name string, qtype uint16) (records []dns.RR) {
+	if this.nameserverIp == nil {
+		return
+	}
+	nameserver := []*Instance{{Addrs: []string{this.nameserverIp.String()}}}
+	for _, addressType := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		if qtype == addressType || qtype == dns.TypeANY {
+			records = append(records, addressRecords(dns.Question{Name: name, Qtype: addressType}, nameserver)...)
+		}
+	}
+	return
+}
+
+// Returns the serial number of the next version of the zone, which is the current time unless the zone changed more
+// recently than that, so that secondary servers see each change.
+func nextDnsSerial(previous uint32, now time.Time) uint32 {
+	if serial := uint32(now.Unix()); serial > previous {
+		return serial
+	}
+	return previous + 1
+}
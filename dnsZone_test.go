@@ -0,0 +1,115 @@
+package daprdockr
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"sync"
+	"testing"
+)
+
+// Zone transfers hold the same records for each static name as queries answer, so that secondary servers agree with
+// the agents about which records take precedence.
+func TestZoneTransferPrecedenceMatchesQueries(t *testing.T) {
+	instances := map[string]*Instance{
+		"0.api.web": {Group: "web", Service: "api", Instance: 0, Addrs: []string{"10.0.0.1"}, PortMappings: map[string]string{"80": "49153"}},
+	}
+	records := map[string]*DnsRecord{
+		"0.api.web":          {Name: "0.api.web", Type: DnsRecordA, Addrs: []string{"10.0.9.1"}},
+		"_80._tcp.api.web":   {Name: "_80._tcp.api.web", Type: DnsRecordSrv, Target: "db", Port: 5432},
+		"_http._tcp.api.web": {Name: "_http._tcp.api.web", Type: DnsRecordSrv, Target: "db", Port: 5432},
+		"_tcp.api.web":       {Name: "_tcp.api.web", Type: DnsRecordCname, Target: "api.web"},
+		"db":                 {Name: "db", Type: DnsRecordA, Addrs: []string{"10.0.9.2"}},
+	}
+	hidden := map[string]bool{"0.api.web": true, "_80._tcp.api.web": true, "_http._tcp.api.web": true}
+	index := newDnsIndex(instances, records, DefaultZone)
+
+	transferred := make(map[string][]string)
+	for _, record := range index.zoneRecords() {
+		transferred[record.Header().Name] = append(transferred[record.Header().Name], record.String())
+	}
+	for name := range records {
+		domainName := name + "." + DefaultZone + "."
+		answers, _, exists := index.answer(dns.Question{Name: domainName, Qtype: dns.TypeANY, Qclass: dns.ClassINET}, name, 0)
+		answered := make(map[string]bool)
+		for _, answer := range answers {
+			answered[answer.String()] = true
+		}
+		if !exists {
+			t.Errorf("Expected %s to exist", name)
+		}
+		for _, record := range transferred[domainName] {
+			if !answered[record] {
+				t.Errorf("Expected %s to be answered as it is transferred, but %q is not answered", name, record)
+			}
+		}
+		static := index.staticRecords(domainName, records[name], dns.TypeANY, 0)
+		if hidden[name] == answered[static[0].String()] {
+			t.Errorf("Expected the static record of %s to be hidden: %v, got %v", name, hidden[name], answers)
+		}
+		if index.staticRecordHidden(name) != hidden[name] {
+			t.Errorf("Expected the static record of %s to be hidden: %v", name, hidden[name])
+		}
+	}
+}
+
+// Answers within the zone are authoritative. Names which do not exist are denied, and names which exist without records
+// of the requested type are answered without records, both with the zone's SOA record.
+func TestDnsAuthoritativeAnswers(t *testing.T) {
+	agent := newTestAgent(t, NewMemoryStore(), NewFakeRuntime(), "node-1")
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	defer wg.Wait()
+	defer cancel()
+	currentInstances := make(chan map[string]*Instance)
+	handler := agent.createContainerHandler(ctx, currentInstances, make(chan map[string]*DnsRecord), &wg)
+	currentInstances <- newTestDnsInstances()
+	waitFor(t, "the DNS index", func() bool { return agent.currentDnsIndex() != nil })
+
+	tests := []struct {
+		name    string
+		qtype   uint16
+		rcode   int
+		answers int
+	}{
+		{"0.api.web.container.", dns.TypeA, dns.RcodeSuccess, 1},
+		{"api.web.container.", dns.TypeA, dns.RcodeSuccess, 2},
+		{"container.", dns.TypeSOA, dns.RcodeSuccess, 1},
+		{"container.", dns.TypeNS, dns.RcodeSuccess, 1},
+		{"ns.container.", dns.TypeA, dns.RcodeSuccess, 1},
+
+		// NODATA: the name exists without records of the type.
+		{"0.api.web.container.", dns.TypeAAAA, dns.RcodeSuccess, 0},
+		{"_80._tcp.api.web.container.", dns.TypeA, dns.RcodeSuccess, 0},
+		{"_tcp.api.web.container.", dns.TypeSRV, dns.RcodeSuccess, 0},
+		{"container.", dns.TypeA, dns.RcodeSuccess, 0},
+
+		// NXDOMAIN: the name does not exist.
+		{"2.api.web.container.", dns.TypeA, dns.RcodeNameError, 0},
+		{"cache.web.container.", dns.TypeAAAA, dns.RcodeNameError, 0},
+		{"_8080._tcp.api.web.container.", dns.TypeSRV, dns.RcodeNameError, 0},
+		{"mail.container.", dns.TypeA, dns.RcodeNameError, 0},
+	}
+	for _, test := range tests {
+		request := new(dns.Msg)
+		request.SetQuestion(test.name, test.qtype)
+		writer := &testDnsWriter{}
+		handler(writer, request)
+		response := writer.written
+		if response == nil {
+			t.Fatalf("%s %s: expected a response", test.name, dns.TypeToString[test.qtype])
+		}
+		if !response.Authoritative || response.Rcode != test.rcode || len(response.Answer) != test.answers {
+			t.Errorf("%s %s: expected an authoritative %s with %d answers, got %s with %d answers, authoritative: %v", test.name, dns.TypeToString[test.qtype], dns.RcodeToString[test.rcode], test.answers, dns.RcodeToString[response.Rcode], len(response.Answer), response.Authoritative)
+		}
+		var soa *dns.SOA
+		if len(response.Ns) == 1 {
+			soa, _ = response.Ns[0].(*dns.SOA)
+		}
+		if test.answers > 0 && len(response.Ns) > 0 {
+			t.Errorf("%s %s: expected no authority records with the answers, got %v", test.name, dns.TypeToString[test.qtype], response.Ns)
+		}
+		if test.answers == 0 && (soa == nil || soa.Hdr.Name != "container." || soa.Minttl != DnsNegativeTtl || soa.Serial == 0) {
+			t.Errorf("%s %s: expected the zone's SOA record in the authority section, got %v", test.name, dns.TypeToString[test.qtype], response.Ns)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package daprdockr
+
+import (
+	"encoding/base64"
+	"github.com/miekg/dns"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Responds to a client whose request was verified with the TSIG status, over UDP unless its address is given, keeping
+// the messages written.
+type testDnsWriter struct {
+	tsigStatus error
+	remote     net.Addr
+	messages   []*dns.Msg
+	written    *dns.Msg // The last message written.
+}
+
+func (this *testDnsWriter) LocalAddr() net.Addr { return &net.UDPAddr{Port: 53} }
+func (this *testDnsWriter) RemoteAddr() net.Addr {
+	if this.remote == nil {
+		return &net.UDPAddr{Port: 5353}
+	}
+	return this.remote
+}
+func (this *testDnsWriter) WriteMsg(m *dns.Msg) error {
+	this.messages, this.written = append(this.messages, m), m
+	return nil
+}
+func (this *testDnsWriter) Write([]byte) (int, error) { return 0, nil }
+func (this *testDnsWriter) Close() error              { return nil }
+func (this *testDnsWriter) TsigStatus() error         { return this.tsigStatus }
+func (this *testDnsWriter) TsigTimersOnly(bool)       {}
+func (this *testDnsWriter) Hijack()                   {}
+
+// Returns a message as it is sent once signed with its TSIG record, as the server does when writing it.
+func signDnsMessage(t *testing.T, message *dns.Msg, secret, requestMac string) (signed *dns.Msg) {
+	packed, _, err := dns.TsigGenerate(message, secret, requestMac, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed = new(dns.Msg)
+	if err = signed.Unpack(packed); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// Returns a response to the request with more A records than fit in a UDP response.
+func newLargeDnsResponse(request *dns.Msg) (response *dns.Msg) {
+	response = new(dns.Msg)
+	response.SetReply(request)
+	for i := 0; i < 100; i++ {
+		record, _ := dns.NewRR("api.web.container. 30 IN A 10.0.0." + strconv.Itoa(i))
+		response.Answer = append(response.Answer, record)
+	}
+	return
+}
+
+// Responses to signed requests are truncated to leave room for their signature within the client's buffer.
+func TestFitDnsResponseLeavesRoomForSignature(t *testing.T) {
+	secret := base64.StdEncoding.EncodeToString([]byte("secret"))
+	for _, size := range []uint16{0, dns.MinMsgSize, DnsUdpSize} {
+		request := new(dns.Msg)
+		request.SetQuestion("api.web.container.", dns.TypeA)
+		limit := dns.MinMsgSize
+		if size > 0 {
+			request.SetEdns0(size, false)
+			limit = int(size)
+		}
+		request.SetTsig("key.", dns.HmacSHA256, DnsTsigFudge, time.Now().Unix())
+		request = signDnsMessage(t, request, secret, "")
+
+		response := newLargeDnsResponse(request)
+		fitDnsResponse(&testDnsWriter{}, request, response)
+		if response.IsTsig() == nil {
+			t.Fatalf("Expected the response to a signed request to be signed, buffer size %d", size)
+		}
+		if response.IsTsig().Algorithm != dns.HmacSHA256 {
+			t.Errorf("Expected the response to be signed with the request's algorithm, got %s", response.IsTsig().Algorithm)
+		}
+		signed, _, err := dns.TsigGenerate(response, secret, request.IsTsig().MAC, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(signed) > limit || !response.Truncated {
+			t.Errorf("Expected the signed response to be truncated to %d bytes, got %d bytes, truncated: %v", limit, len(signed), response.Truncated)
+		}
+		if len(signed) < limit*3/4 {
+			t.Errorf("Expected the signed response to fill most of %d bytes, got %d bytes", limit, len(signed))
+		}
+	}
+}
+
+func TestFitDnsResponseDoesNotSignUnverifiedRequests(t *testing.T) {
+	request := new(dns.Msg)
+	request.SetQuestion("api.web.container.", dns.TypeA)
+	request.SetTsig("key.", dns.HmacSHA256, DnsTsigFudge, time.Now().Unix())
+	request = signDnsMessage(t, request, base64.StdEncoding.EncodeToString([]byte("secret")), "")
+	response := newLargeDnsResponse(request)
+	fitDnsResponse(&testDnsWriter{tsigStatus: dns.ErrSig}, request, response)
+	if response.IsTsig() != nil {
+		t.Error("Expected the response to a request which failed verification not to be signed")
+	}
+	if packed, _ := response.Pack(); len(packed) > dns.MinMsgSize || len(packed) < dns.MinMsgSize-16 {
+		t.Errorf("Expected the response to fill %d bytes, got %d bytes", dns.MinMsgSize, len(packed))
+	}
+}
+
+func TestDnsSrvAnswers(t *testing.T) {
+	index := newTestDnsIndex()
+	srv := func(port, target string) string {
+		return strconv.Itoa(DnsSrvPriority) + " " + strconv.Itoa(DnsSrvWeight) + " " + port + " " + target + "." + DefaultZone + "."
+	}
+	api0, api1 := srv("49153", "0.api.web"), srv("49155", "1.api.web")
+	addresses := []string{"10.0.0.1", "10.0.0.2", "2001:db8::2"}
+	tests := []struct {
+		name     string
+		qtype    uint16
+		rotation uint32
+		answers  []string
+		extra    []string
+		exists   bool
+	}{
+		{"_80._tcp.api.web", dns.TypeSRV, 0, []string{api0, api1}, addresses, true},
+		{"_80._tcp.api.web", dns.TypeSRV, 1, []string{api1, api0}, []string{"10.0.0.2", "2001:db8::2", "10.0.0.1"}, true},
+		{"_http._tcp.api.web", dns.TypeSRV, 0, []string{api0, api1}, addresses, true},
+		{"_80._tcp.1.api.web", dns.TypeSRV, 0, []string{api1}, []string{"10.0.0.2", "2001:db8::2"}, true},
+		{"_80._tcp.web", dns.TypeSRV, 0, []string{api0, api1}, addresses, true},
+		{"_53._udp.api.web", dns.TypeSRV, 0, []string{srv("49154", "0.api.web")}, []string{"10.0.0.1"}, true},
+		{"_80._tcp.api.web", dns.TypeANY, 0, []string{api0, api1}, addresses, true},
+
+		// The legacy names omit the underscores.
+		{"80.tcp.api.web", dns.TypeSRV, 0, []string{api0, api1}, addresses, true},
+		{"http.tcp.api.web", dns.TypeSRV, 0, []string{api0, api1}, addresses, true},
+		{"5432.tcp.db.web", dns.TypeSRV, 0, []string{srv("49156", "0.db.web")}, []string{"10.0.0.1"}, true},
+
+		// Names with SRV records, and the protocols of services, exist without records of other types.
+		{"_80._tcp.api.web", dns.TypeA, 0, []string{}, []string{}, true},
+		{"_tcp.api.web", dns.TypeSRV, 0, []string{}, []string{}, true},
+		{"_53._tcp.api.web", dns.TypeSRV, 0, []string{}, []string{}, false},
+		{"_8080._tcp.api.web", dns.TypeSRV, 0, []string{}, []string{}, false},
+		{"_80._sctp.api.web", dns.TypeSRV, 0, []string{}, []string{}, false},
+		{"_80._tcp.cache.web", dns.TypeSRV, 0, []string{}, []string{}, false},
+	}
+	for _, test := range tests {
+		answers, extra, exists := answerTestDnsQuestion(index, test.name, test.qtype, test.rotation)
+		if exists != test.exists || strings.Join(answers, ",") != strings.Join(test.answers, ",") || strings.Join(extra, ",") != strings.Join(test.extra, ",") {
+			t.Errorf("%s %s, rotation %d: expected %v with %v, exists: %v, got %v with %v, exists: %v", test.name, dns.TypeToString[test.qtype], test.rotation, test.answers, test.extra, test.exists, answers, extra, exists)
+		}
+	}
+}
+
+func TestDnsReverseAnswers(t *testing.T) {
+	agent := newTestAgent(t, NewMemoryStore(), NewFakeRuntime(), "node-1")
+	agent.dnsIndex.Store(newTestDnsIndex())
+	fallback := &dns.Msg{}
+	handler := agent.createReverseHandler(func(writer dns.ResponseWriter, request *dns.Msg) { writer.WriteMsg(fallback) })
+	ip6, _ := dns.ReverseAddr("2001:db8::2")
+	tests := []struct {
+		name     string
+		qtype    uint16
+		answers  []string
+		fallback bool
+	}{
+		{"1.0.0.10.in-addr.arpa.", dns.TypePTR, []string{"0.api.web.container.", "0.db.web.container."}, false},
+		{"2.0.0.10.in-addr.arpa.", dns.TypeANY, []string{"1.api.web.container."}, false},
+		{ip6, dns.TypePTR, []string{"1.api.web.container."}, false},
+		{"1.0.0.10.in-addr.arpa.", dns.TypeTXT, []string{}, false},
+
+		// Other addresses are answered by the fallback handler.
+		{"3.0.0.10.in-addr.arpa.", dns.TypePTR, nil, true},
+		{"0.0.10.in-addr.arpa.", dns.TypePTR, nil, true},
+	}
+	for _, test := range tests {
+		request := new(dns.Msg)
+		request.SetQuestion(test.name, test.qtype)
+		writer := &testDnsWriter{}
+		handler(writer, request)
+		if (writer.written == fallback) != test.fallback {
+			t.Errorf("%s %s: expected fallback: %v", test.name, dns.TypeToString[test.qtype], test.fallback)
+			continue
+		}
+		if test.fallback {
+			continue
+		}
+		if answers := dnsRecordData(writer.written.Answer); strings.Join(answers, ",") != strings.Join(test.answers, ",") || writer.written.Rcode != dns.RcodeSuccess {
+			t.Errorf("%s %s: expected %v, got %v, %s", test.name, dns.TypeToString[test.qtype], test.answers, answers, dns.RcodeToString[writer.written.Rcode])
+		}
+	}
+}
+
+func TestDnsTxtAnswers(t *testing.T) {
+	index := newTestDnsIndex()
+	api0 := `"instance=0.api.web" "image=nginx" "container=c0" "node=node-1" "agent=10.0.0.1:2375" "started=2014-03-01T12:00:00Z" "revision=r1" "addr=10.0.0.1" "port_53_udp=49154" "port_80=49153"`
+	api1 := `"instance=1.api.web" "addr=10.0.0.2" "addr=2001:db8::2" "port_80=49155"`
+	db0 := `"instance=0.db.web" "addr=10.0.0.1" "port_5432=49156"`
+	tests := []struct {
+		name    string
+		answers []string
+		exists  bool
+	}{
+		{"0.api.web", []string{api0}, true},
+		{"1.api.web", []string{api1}, true},
+		{"api.web", []string{api0, api1}, true},
+		{"web", []string{api0, api1, db0}, true},
+		{"_80._tcp.api.web", []string{}, true},
+		{"2.api.web", []string{}, false},
+	}
+	for _, test := range tests {
+		// TXT records are not rotated, so that each instance's details are found in the same place.
+		answers, _, exists := answerTestDnsQuestion(index, test.name, dns.TypeTXT, 1)
+		if exists != test.exists || strings.Join(answers, "\n") != strings.Join(test.answers, "\n") {
+			t.Errorf("%s: expected %v, exists: %v, got %v, exists: %v", test.name, test.answers, test.exists, answers, exists)
+		}
+	}
+
+	// Each string is limited to 255 bytes.
+	long := &Instance{Group: "web", Service: "api", Instance: 0, Image: strings.Repeat("i", 300)}
+	records := txtRecords(dns.Question{Name: "0.api.web.container.", Qtype: dns.TypeTXT}, []*Instance{long})
+	if txt := records[0].(*dns.TXT).Txt; len(txt) != 2 || len(txt[1]) != 255 || !strings.HasPrefix(txt[1], "image=iii") {
+		t.Errorf("Expected the image to be truncated to 255 bytes, got %v", txt)
+	}
+	if _, err := (&dns.Msg{Answer: records}).Pack(); err != nil {
+		t.Errorf("Expected the record to be packed, got %v", err)
+	}
+}
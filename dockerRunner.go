@@ -1,24 +1,43 @@
 package daprdockr
 
 import (
-	"github.com/coreos/go-etcd/etcd"
+	"context"
 	"github.com/dotcloud/docker"
 	dockerclient "github.com/fsouza/go-dockerclient"
-	"log"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 const (
 	ContainerStopTimeout = 30 // seconds
 )
 
-// Pull required state changes from the store and attempt to apply them locally.
-func ApplyRequiredStateChanges(dockerClient *dockerclient.Client, etcdClient *etcd.Client, requiredChanges chan map[string]*RequiredStateChange, stop chan bool) {
+var runnerLog = NewLogger("DockerRunner")
+
+// Pull required state changes from the store and attempt to apply them locally, until the context is done or the
+// required changes channel is closed.
+func (this *Agent) ApplyRequiredStateChanges(ctx context.Context, requiredChanges chan map[string]*RequiredStateChange) (err error) {
+	store := this.store
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	goTracked(&wg, func() { this.stopDuplicateInstances(ctx) })
+
+apply:
 	for requiredChange := range requiredChanges {
 		for _, change := range requiredChange {
-			instanceName := change.ServiceConfig.InstanceQualifiedName(change.Instance)
+			// Do not start or remove anything once the agent is stopping.
+			select {
+			case <-ctx.Done():
+				break apply
+			default:
+			}
+
+			logger := runnerLog.WithInstance(change.ServiceConfig.Group, change.ServiceConfig.Name, change.Instance)
 			switch change.Operation {
 			case Add:
 				/*err := <-prepareForService(dockerClient, change.ServiceConfig)
@@ -29,29 +48,98 @@ func ApplyRequiredStateChanges(dockerClient *dockerclient.Client, etcdClient *et
 					continue
 				}*/
 
-				if err := LockInstance(etcdClient, change.Instance, change.ServiceConfig); err == nil {
-					log.Printf("[DockerRunner] Acquired lock on instance %s\n", change.ServiceConfig.InstanceQualifiedName(change.Instance))
-					err = instantiateService(dockerClient, change.ServiceConfig, change.Instance)
+				// Instances which failed recently are not scheduled until their backoff has elapsed.
+				this.recordExitedContainer(change.ServiceConfig, change.Instance)
+				record, err := GetRestartRecord(store, change.ServiceConfig.Group, change.ServiceConfig.Name, change.Instance)
+				if err != nil {
+					logger.Warn("Unable to get restart record", "error", err)
+				} else if record != nil && record.InBackoff(time.Now()) {
+					logger.Debug("Instance is backing off", "restarts", record.Restarts, "until", record.BackoffUntil)
+					continue
+				}
+
+				if lock, err := LockInstance(store, this.nodeId, change.Instance, change.ServiceConfig); err == nil {
+					logger.Info("Acquired lock on instance")
+
+					// The work finder may not have seen the record of an instance which another agent started.
+					if owner := this.instanceOwner(change.ServiceConfig, change.Instance); len(owner) > 0 {
+						logger.Info("Instance is already running", "owner", owner)
+						if err = ReleaseInstanceLock(store, lock, "Instance is running on "+owner); err != nil {
+							logger.Warn("Unable to release lock", "error", err)
+						}
+						continue
+					}
+
+					start := time.Now()
+					instance, err := this.instantiateService(change.ServiceConfig, change.Instance)
+					observeSince(this.metrics.containerStartDuration, start, change.ServiceConfig.Name, change.ServiceConfig.Group)
 					if err != nil {
-						log.Printf("[DockerRunner] Failed to instantiate %s: %s.\n", instanceName, err)
+						this.metrics.containerStartFailures.Inc(change.ServiceConfig.Name, change.ServiceConfig.Group)
+						logger.Error("Failed to instantiate", "error", err)
+
+						// Let other agents attempt the instance without waiting for the lock to expire.
+						if releaseErr := ReleaseInstanceLock(store, lock, err.Error()); releaseErr != nil {
+							logger.Warn("Unable to release lock", "error", releaseErr)
+						}
+						journal(store, this.newInstanceEvent(InstanceStartFailed, change.ServiceConfig.Group, change.ServiceConfig.Name, change.Instance, err.Error()))
+						if _, err = RecordInstanceFailure(store, this.nodeId, change.ServiceConfig.Group, change.ServiceConfig.Name, change.Instance, err.Error()); err != nil {
+							logger.Warn("Unable to record failure", "error", err)
+						}
 					} else {
-						log.Printf("[DockerRunner] Instantiated %s.\n", instanceName)
+						this.metrics.containerStarts.Inc(change.ServiceConfig.Name, change.ServiceConfig.Group)
+						logger.Info("Instantiated")
+
+						// The lock is kept until it expires, so that agents which have not yet seen the instance record do not
+						// start the instance too, and so that the lock still protects the instance if the record is not written.
+						if _, err = updateInstanceInStore(store, instance, 0); err != nil {
+							logger.Warn("Unable to record instance", "error", err)
+						}
+						this.instances.heartbeat(instance)
+						journal(store, this.newInstanceEvent(InstanceStarted, change.ServiceConfig.Group, change.ServiceConfig.Name, change.Instance, change.Reason))
 					}
 				} else {
-					log.Printf("[DockerRunner] Could not acquire lock: %s.\n", err)
+					if isStoreError(err, StoreNodeExists) {
+						this.metrics.instanceLockConflicts.Inc(change.ServiceConfig.Name, change.ServiceConfig.Group)
+					}
+					logger.Debug("Could not acquire lock", "error", err)
 				}
 			case Remove:
-				log.Printf("[DockerRunner] Attempting to remove instance %s.\n", instanceName)
-				err := removeContainer(dockerClient, change.ServiceConfig, change.Instance)
+				logger.Info("Attempting to remove instance")
+				err := this.removeContainer(change.ServiceConfig, change.Instance)
 				if err != nil {
-					log.Printf("[DockerRunner] Failed to remove instance %s. Instance might not exist locally. %s\n", instanceName, err)
+					logger.Debug("Failed to remove instance. Instance might not exist locally", "error", err)
 				} else {
-					log.Printf("[DockerRunner] Removed instance %s.\n", instanceName)
+					this.metrics.containerRemovals.Inc(change.ServiceConfig.Name, change.ServiceConfig.Group)
+					logger.Info("Removed instance", "reason", change.Reason)
+					journal(store, this.newInstanceEvent(InstanceRemoved, change.ServiceConfig.Group, change.ServiceConfig.Name, change.Instance, change.Reason))
+					releaseHeldLock(store, &Instance{Group: change.ServiceConfig.Group, Service: change.ServiceConfig.Name, Instance: change.Instance, Owner: this.nodeId}, change.Reason)
 				}
 			}
 		}
 	}
-	log.Printf("[DockerRunner] Exiting.\n")
+	runnerLog.Info("Exiting")
+	return
+}
+
+// Stops local containers whose instances are owned by another node, as reported by failed heartbeats.
+func (this *Agent) stopDuplicateInstances(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case conflict := <-this.instances.Conflicts:
+			instance := conflict.Instance
+			logger := runnerLog.WithInstance(instance.Group, instance.Service, instance.Instance)
+			config := &ServiceConfig{ServiceIdentifier: ServiceIdentifier{Name: instance.Service, Group: instance.Group}}
+			if err := this.removeContainer(config, instance.Instance); err != nil {
+				logger.Warn("Failed to stop duplicate instance", "error", err)
+				continue
+			}
+			this.metrics.containerRemovals.Inc(instance.Service, instance.Group)
+			logger.Warn("Stopped duplicate instance", "owner", conflict.Owner)
+			journal(this.store, this.newInstanceEvent(InstanceDuplicate, instance.Group, instance.Service, instance.Instance, "Instance is owned by "+conflict.Owner))
+		}
+	}
 }
 
 // Prepares for a service to be instantiated by pulling the container's image.
@@ -93,10 +181,10 @@ func prepareForService(client *dockerclient.Client, config *ServiceConfig) (err
 }
 
 // Instantiate a service from the provided configuration.
-func instantiateService(client *dockerclient.Client, config *ServiceConfig, instanceNum int) (err error) {
-	name := config.FullyQualifiedDomainName(instanceNum)
-	creationOptions := dockerclient.CreateContainerOptions{Name: name}
-	containerConfig := &docker.Config{
+func (this *Agent) instantiateService(config *ServiceConfig, instanceNum int) (instance *Instance, err error) {
+	runtime := this.runtime
+	name := config.FullyQualifiedDomainName(instanceNum, this.zone)
+	containerConfig := docker.Config{
 		AttachStderr:    config.Container.AttachStderr,
 		AttachStdin:     config.Container.AttachStdin,
 		AttachStdout:    config.Container.AttachStdout,
@@ -105,7 +193,7 @@ func instantiateService(client *dockerclient.Client, config *ServiceConfig, inst
 		Dns:             config.Container.Dns,
 		Domainname:      config.Container.Domainname,
 		Entrypoint:      config.Container.Entrypoint,
-		Env:             config.Container.Env,
+		Env:             append(append([]string(nil), config.Container.Env...), ServiceRevisionEnv+"="+config.Revision()),
 		ExposedPorts:    config.Container.ExposedPorts,
 		Hostname:        config.Container.Hostname + "i" + strconv.Itoa(instanceNum),
 		Image:           config.Container.Image,
@@ -123,66 +211,89 @@ func instantiateService(client *dockerclient.Client, config *ServiceConfig, inst
 	}
 
 	// Add internal DNS
-	dnsAddrs, err := HostIp()
-	if err != nil {
-		return
-	}
-	containerConfig.Dns = append(containerConfig.Dns, dnsAddrs.String())
+	containerConfig.Dns = append(containerConfig.Dns, this.hostIp.String())
 
 	// Check if the container already exists and therefore whether it needs to be stopped.
-	removeContainer(client, config, instanceNum)
+	this.removeContainer(config, instanceNum)
 
 	// Create the new container with the new configuration
-	container, err := client.CreateContainer(creationOptions, containerConfig)
+	container, err := runtime.CreateContainer(&ContainerSpec{Name: name, Runtime: config.Runtime, Config: containerConfig})
 	if err != nil {
 		return
 	}
 
-	hostConfig := &docker.HostConfig{PublishAllPorts: true}
-
 	// Start the new container.
-	err = client.StartContainer(container.ID, hostConfig)
+	err = runtime.StartContainer(container.ID)
 	if err != nil {
 		return
 	}
 
-	// Heartbeat the container.
-	instance, err := instanceFromContainer(name, container)
-	if err != nil {
+	// Ports are only published once the container has started.
+	if started, err := runtime.InspectContainer(container.ID); err == nil {
+		container = started
+	}
+	instance, err = this.instanceFromContainer(container)
+	return
+}
+
+// Returns the node which runs an instance, or an empty string if it is not running. An instance recorded as owned by
+// this node is only running if its container is, since the record of a container which exited may not have expired.
+func (this *Agent) instanceOwner(config *ServiceConfig, instanceNum int) (owner string) {
+	instance, err := GetInstance(this.store, config.Group, config.Name, instanceNum)
+	if err != nil || len(instance.Owner) == 0 {
 		return
 	}
+	if instance.Owner == this.nodeId {
+		if container, err := this.runtime.InspectContainer(config.FullyQualifiedDomainName(instanceNum, this.zone)); err != nil || !container.Running {
+			return
+		}
+	}
+	return instance.Owner
+}
 
-	Instances.Heartbeats <- instance
-	return
+// Records the exit of an instance's container which has exited, which the watcher misses if the container exits
+// between polls, so that instances which crash straight after starting are backed off too.
+func (this *Agent) recordExitedContainer(config *ServiceConfig, instanceNum int) {
+	container, err := this.runtime.InspectContainer(config.FullyQualifiedDomainName(instanceNum, this.zone))
+	if err != nil || container.Running || container.StartedAt.IsZero() {
+		return
+	}
+	instance, err := this.instanceFromContainer(container)
+	if err != nil {
+		return
+	}
+	this.recordContainerExit(container, instance)
 }
 
-func removeContainer(client *dockerclient.Client, config *ServiceConfig, instanceNum int) (err error) {
-	name := config.FullyQualifiedDomainName(instanceNum)
-	container, err := client.InspectContainer(name)
+func (this *Agent) removeContainer(config *ServiceConfig, instanceNum int) (err error) {
+	runtime := this.runtime
+	name := config.FullyQualifiedDomainName(instanceNum, this.zone)
+	container, err := runtime.InspectContainer(name)
 	if err != nil {
 		return
 	}
 	// Stop or kill the named container.
-	err = client.StopContainer(name, ContainerStopTimeout)
+	err = runtime.StopContainer(name, ContainerStopTimeout)
 	if err != nil {
-		err = client.KillContainer(name)
+		err = runtime.KillContainer(name)
 		if err != nil {
 			return
 		}
 	}
 
 	// Remove the stopped container, ignoring any potential error.
-	err = client.RemoveContainer(name)
+	err = runtime.RemoveContainer(name)
 	if err != nil {
 		return
 	}
+	this.exits.forget(container.ID)
 
 	// Notify that the instance has stopped.
-	instance, err := instanceFromContainer(name, container)
+	instance, err := this.instanceFromContainer(container)
 	if err != nil {
 		return
 	}
 
-	Instances.Flatlines <- instance
+	this.instances.flatline(instance)
 	return
 }
@@ -0,0 +1,185 @@
+package daprdockr
+
+import (
+	"context"
+	"encoding/json"
+	goerrors "errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Polls the condition until it holds, failing the test if it does not hold within a few seconds.
+func waitFor(t *testing.T, description string, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for " + description)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// The runner creates the instances which are required, recreates crashed instances once their backoff has elapsed, and
+// stops local instances whose records are owned by another node.
+func TestApplyRequiredStateChanges(t *testing.T) {
+	store, runtime := NewMemoryStore(), NewFakeRuntime()
+	agent := newTestAgent(t, store, runtime, "node-1")
+	config := newTestServiceConfig(2)
+	running := func(instance int) *RuntimeContainer {
+		container, err := runtime.InspectContainer(config.FullyQualifiedDomainName(instance, agent.Zone()))
+		if err != nil || !container.Running {
+			return nil
+		}
+		return container
+	}
+
+	// Process heartbeats and flatlines, as the agent does, while the runner applies changes.
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	currentInstances := agent.currentInstances(ctx, &wg)
+	go func() {
+		for range currentInstances {
+		}
+	}()
+	requiredChanges := make(chan map[string]*RequiredStateChange)
+	applied := make(chan error, 1)
+	go func() { applied <- agent.ApplyRequiredStateChanges(ctx, requiredChanges) }()
+	defer func() {
+		close(requiredChanges)
+		if err := <-applied; err != nil {
+			t.Error(err)
+		}
+		cancel()
+		wg.Wait()
+	}()
+
+	// The runner takes the next changes only once it has applied the previous ones.
+	apply := func(instances ...int) {
+		changes := make(map[string]*RequiredStateChange)
+		for _, i := range instances {
+			changes[config.InstanceQualifiedName(i)] = &RequiredStateChange{ServiceConfig: config, Instance: i, Operation: Add}
+		}
+		requiredChanges <- changes
+		requiredChanges <- nil
+	}
+
+	// Required instances are created.
+	apply(0, 1)
+	first := running(0)
+	if first == nil || running(1) == nil {
+		t.Fatal("Expected both instances to be running")
+	}
+
+	// A crashed instance is not recreated until its backoff has elapsed.
+	if err := runtime.Crash(first.ID, 1); err != nil {
+		t.Fatal(err)
+	}
+	apply(0)
+	if running(0) != nil {
+		t.Fatal("Expected the crashed instance not to be recreated while backing off")
+	}
+	record, err := GetRestartRecord(store, "web", "api", 0)
+	if err != nil || record == nil {
+		t.Fatalf("Expected the crash to be recorded, got %+v, %v", record, err)
+	}
+	record.BackoffUntil = time.Now().Add(-time.Second)
+	payload, _ := json.Marshal(record)
+	if _, err = store.Set(restartsPath("web", "api", 0), string(payload), 0); err != nil {
+		t.Fatal(err)
+	}
+	apply(0)
+	if recreated := running(0); recreated == nil || recreated.ID == first.ID {
+		t.Fatalf("Expected the crashed instance to be recreated, got %+v", recreated)
+	}
+	if record, _ = GetRestartRecord(store, "web", "api", 0); record == nil || record.Restarts != 1 {
+		t.Errorf("Expected the crash to be recorded once, got %+v", record)
+	}
+	if events, _ := GetEvents(store, "web", "api", 0); !hasEvent(events, ContainerExited) || !hasEvent(events, InstanceStarted) {
+		t.Errorf("Expected the crash and restart to be journaled, got %v", events)
+	}
+
+	// A local instance whose record another node took over is stopped on its next heartbeat.
+	duplicate := &Instance{Group: "web", Service: "api", Instance: 1, Owner: "node-2"}
+	payload, _ = json.Marshal(duplicate)
+	if _, err = store.Set(instancePath("web", "api", 1), string(payload), UpdateTimeToLive); err != nil {
+		t.Fatal(err)
+	}
+	local, err := agent.instanceFromContainer(running(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent.instances.heartbeat(local)
+	waitFor(t, "the duplicate instance to be stopped", func() bool {
+		events, _ := GetEvents(store, "web", "api", 1)
+		return hasEvent(events, InstanceDuplicate)
+	})
+	if _, err = runtime.InspectContainer(local.ContainerId); err == nil {
+		t.Error("Expected the duplicate container to be removed")
+	}
+	if owner, _, err := getInstanceOwner(store, instancePath("web", "api", 1)); err != nil || owner != "node-2" {
+		t.Errorf("Expected the other node's record to be kept, got owner %q, %v", owner, err)
+	}
+	if running(0) == nil {
+		t.Error("Expected the other instance to keep running")
+	}
+}
+
+// A store which cannot write instance records.
+type unrecordableStore struct {
+	Store
+}
+
+func (this *unrecordableStore) Create(key, value string, ttl uint64) (index uint64, err error) {
+	if strings.HasPrefix(key, "instances/") {
+		return 0, goerrors.New("Unavailable")
+	}
+	return this.Store.Create(key, value, ttl)
+}
+
+// The runner keeps the lock on an instance which it started, even if its record could not be written, and releases it
+// once the instance is removed.
+func TestApplyRequiredStateChangesKeepsLock(t *testing.T) {
+	store, runtime := NewMemoryStore(), NewFakeRuntime()
+	agent := newTestAgent(t, &unrecordableStore{store}, runtime, "node-1")
+	config := newTestServiceConfig(1)
+	add := map[string]*RequiredStateChange{config.InstanceQualifiedName(0): {ServiceConfig: config, Instance: 0, Operation: Add}}
+	if err := applyChanges(agent, add); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := runtime.InspectContainer(config.FullyQualifiedDomainName(0, agent.Zone())); err != nil {
+		t.Fatal("Expected the instance to be started")
+	}
+	if lock, err := GetInstanceLock(store, "web", "api", 0); err != nil || lock.Node != "node-1" || lock.Released {
+		t.Errorf("Expected the lock to be kept while the instance is not recorded, got %+v, %v", lock, err)
+	}
+
+	remove := map[string]*RequiredStateChange{config.InstanceQualifiedName(0): {ServiceConfig: config, Instance: 0, Operation: Remove, Reason: "Scaled down"}}
+	if err := applyChanges(agent, remove); err != nil {
+		t.Fatal(err)
+	}
+	if lock, err := GetInstanceLock(store, "web", "api", 0); err != nil || !lock.Released || lock.Reason != "Scaled down" {
+		t.Errorf("Expected the lock to be released once the instance was removed, got %+v, %v", lock, err)
+	}
+}
+
+// The runner does not start an instance which another agent recorded after the work finder last saw the instances.
+func TestApplyRequiredStateChangesSkipsRecordedInstances(t *testing.T) {
+	store, runtime := NewMemoryStore(), NewFakeRuntime()
+	agent := newTestAgent(t, store, runtime, "node-1")
+	config := newTestServiceConfig(1)
+	if _, err := updateInstanceInStore(store, &Instance{Group: "web", Service: "api", Instance: 0, Owner: "node-2"}, 0); err != nil {
+		t.Fatal(err)
+	}
+	add := map[string]*RequiredStateChange{config.InstanceQualifiedName(0): {ServiceConfig: config, Instance: 0, Operation: Add}}
+	if err := applyChanges(agent, add); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := runtime.InspectContainer(config.FullyQualifiedDomainName(0, agent.Zone())); err == nil {
+		t.Error("Expected the instance recorded by another agent not to be started")
+	}
+	if lock, err := GetInstanceLock(store, "web", "api", 0); err != nil || !lock.Released || lock.Reason != "Instance is running on node-2" {
+		t.Errorf("Expected the lock to be released with the owner of the instance, got %+v, %v", lock, err)
+	}
+}
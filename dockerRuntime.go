@@ -0,0 +1,151 @@
+// Runtime backed by a Docker daemon.
+package daprdockr
+
+import (
+	"github.com/dotcloud/docker"
+	dockerclient "github.com/fsouza/go-dockerclient"
+	"io"
+	"strconv"
+	"strings"
+)
+
+type dockerRuntime struct {
+	client *dockerclient.Client
+}
+
+// Creates a runtime which runs containers using the provided Docker client.
+func NewDockerRuntime(client *dockerclient.Client) Runtime {
+	return &dockerRuntime{client: client}
+}
+
+func (this *dockerRuntime) CreateContainer(spec *ContainerSpec) (container *RuntimeContainer, err error) {
+	config := spec.Config
+	created, err := this.client.CreateContainer(dockerclient.CreateContainerOptions{Name: spec.Name}, &config)
+	if err != nil {
+		return
+	}
+	container = fromDockerContainer(created)
+	if len(container.Name) == 0 {
+		container.Name = spec.Name
+	}
+	return
+}
+
+func (this *dockerRuntime) StartContainer(id string) (err error) {
+	return this.client.StartContainer(id, &docker.HostConfig{PublishAllPorts: true})
+}
+
+func (this *dockerRuntime) StopContainer(id string, timeout uint) (err error) {
+	return this.client.StopContainer(id, timeout)
+}
+
+func (this *dockerRuntime) KillContainer(id string) (err error) {
+	return this.client.KillContainer(id)
+}
+
+func (this *dockerRuntime) RemoveContainer(id string) (err error) {
+	return this.client.RemoveContainer(id)
+}
+
+func (this *dockerRuntime) ListContainers() (containers []*RuntimeContainer, err error) {
+	apiContainers, err := this.client.ListContainers(dockerclient.ListContainersOptions{})
+	if err != nil {
+		return
+	}
+	containers = make([]*RuntimeContainer, 0, len(apiContainers))
+	for i := range apiContainers {
+		containers = append(containers, fromDockerAPIContainer(&apiContainers[i]))
+	}
+	return
+}
+
+func (this *dockerRuntime) InspectContainer(id string) (container *RuntimeContainer, err error) {
+	inspected, err := this.client.InspectContainer(id)
+	if err != nil {
+		return
+	}
+	container = fromDockerContainer(inspected)
+	return
+}
+
+func (this *dockerRuntime) ContainerLogs(id string, options ContainerLogsOptions, output io.Writer) (err error) {
+	tail := options.Tail
+	if len(tail) == 0 {
+		tail = "all"
+	}
+	return this.client.Logs(dockerclient.LogsOptions{
+		Container:    id,
+		OutputStream: output,
+		ErrorStream:  output,
+		Stdout:       true,
+		Stderr:       true,
+		Follow:       options.Follow,
+		Tail:         tail,
+	})
+}
+
+func fromDockerContainer(container *docker.Container) (result *RuntimeContainer) {
+	result = &RuntimeContainer{
+		ID:         container.ID,
+		Name:       strings.TrimPrefix(container.Name, "/"),
+		Image:      container.Image,
+		Running:    container.State.Running,
+		ExitCode:   container.State.ExitCode,
+		StartedAt:  container.State.StartedAt,
+		FinishedAt: container.State.FinishedAt,
+	}
+	if container.Config != nil {
+		if len(container.Config.Image) > 0 {
+			// The container's image is reported as an image ID, whereas its configuration names the image.
+			result.Image = container.Config.Image
+		}
+		result.Env = container.Config.Env
+	}
+	if result.Running {
+		result.Status = "Up"
+	} else {
+		result.Status = "Exited (" + strconv.Itoa(result.ExitCode) + ")"
+	}
+	var ports []docker.APIPort
+	if container.NetworkSettings != nil {
+		ports = container.NetworkSettings.PortMappingAPI()
+	}
+	result.PortMappings = fromDockerPorts(ports)
+	return
+}
+
+// Converts a container listed by Docker, which lists only running containers by default.
+func fromDockerAPIContainer(container *docker.APIContainers) *RuntimeContainer {
+	return &RuntimeContainer{
+		ID:           container.ID,
+		Name:         dockerContainerName(container.Names),
+		Image:        container.Image,
+		Status:       container.Status,
+		Running:      true,
+		PortMappings: fromDockerPorts(container.Ports),
+	}
+}
+
+func fromDockerPorts(ports []docker.APIPort) (portMappings map[string]string) {
+	portMappings = make(map[string]string)
+	for _, portMapping := range ports {
+		private := strconv.FormatInt(portMapping.PrivatePort, 10)
+		public := strconv.FormatInt(portMapping.PublicPort, 10)
+		portMappings[portMappingKey(private, portMapping.Type)] = public
+	}
+	return
+}
+
+// Returns the container's own name rather than a name by which it is linked into another container, eg:
+// "/web/db". Docker prefixes names with a slash.
+func dockerContainerName(names []string) (result string) {
+	for _, name := range names {
+		if !strings.Contains(strings.TrimPrefix(name, "/"), "/") {
+			return strings.TrimPrefix(name, "/")
+		}
+	}
+	if len(names) > 0 {
+		result = strings.TrimPrefix(names[0], "/")
+	}
+	return
+}
@@ -1,12 +1,11 @@
 package daprdockr
 
 import (
-	"github.com/coreos/go-etcd/etcd"
-	"github.com/dotcloud/docker"
-	dockerclient "github.com/fsouza/go-dockerclient"
-	"log"
+	"context"
+	goerrors "errors"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -14,90 +13,190 @@ const (
 	DockerWatcherPollInterval = 5 // Seconds.
 )
 
-func PushStateChangesIntoStore(dockerClient *dockerclient.Client, etcdClient *etcd.Client, stop chan bool) {
+var watcherLog = NewLogger("DockerWatcher")
+
+// Polls the local Docker instance and heartbeats its managed containers until the context is done.
+func (this *Agent) PushStateChangesIntoStore(ctx context.Context) (err error) {
+	runtime, store := this.runtime, this.store
+	// Managed containers which were running at the previous poll, by container ID.
+	running := make(map[string]*Instance)
+
+	// When each running container was first seen, and whether it has run long enough to be considered stable.
+	firstSeen := make(map[string]time.Time)
+	stable := make(map[string]bool)
+
+	// Running containers are listed without some of the details which their instance records carry, so each is
+	// inspected once.
+	inspected := make(map[string]*RuntimeContainer)
+poll:
 	for {
 		select {
-		case <-stop:
-			break
+		case <-ctx.Done():
+			break poll
 		case <-time.After(DockerWatcherPollInterval * time.Second):
-			containers, err := getContainers(dockerClient)
+			containers, err := runtime.ListContainers()
 
 			if err != nil {
-				log.Printf("[DockerWatcher] Error getting containers: %s.\n", err)
+				watcherLog.Error("Error getting containers", "error", err)
 				continue
 			}
+			managed := make([]*LocalContainer, 0, len(containers))
+			stillRunning := make(map[string]*Instance, len(running))
 			for _, container := range containers {
-				if !containerIsManaged(container.Names) {
+				if !containerIsManaged(container.Name, this.zone) {
 					// This container isn't managed by this system.
 					continue
 				}
-				instance, err := instanceFromAPIContainer(&container)
+				if _, exists := inspected[container.ID]; !exists {
+					if details, err := runtime.InspectContainer(container.ID); err == nil {
+						inspected[container.ID] = details
+					}
+				}
+				if details := inspected[container.ID]; details != nil {
+					container.Image, container.StartedAt, container.Env = details.Image, details.StartedAt, details.Env
+				}
+				instance, err := this.instanceFromContainer(container)
 				if err != nil {
-					log.Printf("[DockerWatcher] Updated deriving instance from container %s for %s.\n", container, err)
+					watcherLog.Warn("Error deriving instance from container", "container", container.ID, "name", container.Name, "error", err)
 					continue
 				}
-				Instances.Heartbeats <- instance
+				managed = append(managed, &LocalContainer{
+					ID:       container.ID,
+					Name:     container.Name,
+					Runtime:  container.Runtime,
+					Image:    container.Image,
+					Status:   container.Status,
+					Instance: instance,
+				})
+				stillRunning[container.ID] = instance
+				this.instances.heartbeat(instance)
+
+				// Forget the failures of instances which have been running stably.
+				if _, seen := firstSeen[container.ID]; !seen {
+					firstSeen[container.ID] = time.Now()
+				}
+				if !stable[container.ID] && time.Since(firstSeen[container.ID]) >= CrashLoopMinimumUptime*time.Second {
+					if err := ResetInstanceFailures(store, instance.Group, instance.Service, instance.Instance); err == nil {
+						stable[container.ID] = true
+					}
+				}
+			}
+			this.state.setContainers(managed)
+
+			for id, instance := range running {
+				if _, exists := stillRunning[id]; !exists {
+					this.handleContainerExit(id, instance)
+					delete(firstSeen, id)
+					delete(stable, id)
+				}
+			}
+			running = stillRunning
+			for id := range inspected {
+				if _, exists := stillRunning[id]; !exists {
+					delete(inspected, id)
+				}
 			}
 		}
 	}
 
-	log.Printf("[DockerWatcher] Exiting.\n")
+	watcherLog.Info("Exiting")
+	return
 }
 
-func containerInstanceName(names []string) (result string) {
-	for _, name := range names {
-		if strings.HasSuffix(name, ContainerDomainSuffix) {
-			result = name[1:]
-			break
-		}
+// The containers whose exits have been recorded, so that each exit is recorded once, whether the watcher or the
+// runner notices it first.
+type containerExits struct {
+	lock     sync.Mutex
+	recorded map[string]bool // By container ID.
+}
+
+func newContainerExits() *containerExits {
+	return &containerExits{recorded: make(map[string]bool)}
+}
+
+// Marks the exit of a container as recorded, returning false if it already was.
+func (this *containerExits) mark(id string) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.recorded[id] {
+		return false
 	}
-	return
+	this.recorded[id] = true
+	return true
+}
+
+// Forgets a container which has been removed.
+func (this *containerExits) forget(id string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	delete(this.recorded, id)
 }
-func instanceFromContainer(name string, container *docker.Container) (instance *Instance, err error) {
-	networkSettings := container.NetworkSettings
-	if networkSettings == nil {
-		networkSettings = new(docker.NetworkSettings)
+
+// Records the exit of a container which is no longer running, unless it was removed by the runner.
+func (this *Agent) handleContainerExit(id string, instance *Instance) {
+	container, err := this.runtime.InspectContainer(id)
+	if err != nil || container.Running {
+		// The container was removed, which the runner journals.
+		return
 	}
+	this.recordContainerExit(container, instance)
+}
 
-	apiContainer := &docker.APIContainers{
-		ID:    container.ID,
-		Image: container.Image,
-		Names: []string{name},
-		Ports: networkSettings.PortMappingAPI(),
+// Journals the exit of a container, unless it was already recorded. Containers which exit soon after starting are
+// recorded as failures so that the instance is backed off.
+func (this *Agent) recordContainerExit(container *RuntimeContainer, instance *Instance) {
+	if !this.exits.mark(container.ID) {
+		return
+	}
+	store, id := this.store, container.ID
+	logger := watcherLog.WithInstance(instance.Group, instance.Service, instance.Instance)
+	reason := "Exited with code " + strconv.Itoa(container.ExitCode)
+	event := this.newInstanceEvent(ContainerExited, instance.Group, instance.Service, instance.Instance, reason)
+	if !container.FinishedAt.IsZero() {
+		event.Time = container.FinishedAt.UTC()
+	}
+	logger.Warn("Container exited", "container", id, "exitCode", container.ExitCode)
+	journal(store, event)
+
+	uptime := container.FinishedAt.Sub(container.StartedAt)
+	if uptime < CrashLoopMinimumUptime*time.Second {
+		if _, err := RecordInstanceFailure(store, this.nodeId, instance.Group, instance.Service, instance.Instance, reason); err != nil {
+			logger.Warn("Unable to record failure", "error", err)
+		}
 	}
-	return instanceFromAPIContainer(apiContainer)
 }
-func instanceFromAPIContainer(apiContainer *docker.APIContainers) (instance *Instance, err error) {
-	name := strings.Split(containerInstanceName(apiContainer.Names), ".")
+
+func (this *Agent) instanceFromContainer(container *RuntimeContainer) (instance *Instance, err error) {
+	name := strings.Split(container.Name, ".")
+	if len(name) < 3 {
+		err = goerrors.New("Container is not named for an instance: " + container.Name)
+		return
+	}
 	instance = new(Instance)
 
 	instance.Instance, err = strconv.Atoi(name[0])
-	instance.Service = name[1]
-	instance.Group = name[2]
-	hostIp, err := HostIp()
 	if err != nil {
 		return
 	}
-	instance.Addrs = []string{hostIp.String()}
+	instance.Service = name[1]
+	instance.Group = name[2]
+	instance.Addrs = []string{this.hostIp.String()}
+	instance.Agent = this.httpAddr
+	instance.Owner = this.nodeId
 	instance.PortMappings = make(map[string]string)
-	for _, portMapping := range apiContainer.Ports {
-		private := strconv.FormatInt(portMapping.PrivatePort, 10)
-		public := strconv.FormatInt(portMapping.PublicPort, 10)
+	for private, public := range container.PortMappings {
 		instance.PortMappings[private] = public
 	}
-	return
-}
-
-func containerIsManaged(names []string) bool {
-	for _, name := range names {
-		if strings.HasSuffix(name, ContainerDomainSuffix) {
-			return true
-		}
+	instance.Image = container.Image
+	instance.ContainerId = container.ID
+	if !container.StartedAt.IsZero() {
+		instance.Started = container.StartedAt.UTC()
 	}
-	return false
+	instance.Revision = revisionFromEnv(container.Env)
+	return
 }
 
-func getContainers(client *dockerclient.Client) (containers []docker.APIContainers, err error) {
-	listContainersOptions := dockerclient.ListContainersOptions{}
-	return client.ListContainers(listContainersOptions)
+// Returns whether a container is named for an instance within the zone, as "<instance>.<service>.<group>.<zone>".
+func containerIsManaged(name, zone string) bool {
+	return strings.HasSuffix(name, "."+zone) && strings.Count(strings.TrimSuffix(name, "."+zone), ".") == 2
 }
@@ -0,0 +1,193 @@
+// Store backed by etcd's v2 API.
+package daprdockr
+
+import (
+	"github.com/coreos/go-etcd/etcd"
+	"strings"
+)
+
+const (
+	etcdErrorKeyNotFound = 100
+	etcdErrorTestFailed  = 101
+	etcdErrorNodeExists  = 105
+)
+
+type etcdStore struct {
+	client *etcd.Client
+}
+
+// Creates a store which uses the provided etcd client.
+func NewEtcdStore(client *etcd.Client) Store {
+	return &etcdStore{client: client}
+}
+
+func (this *etcdStore) Get(key string) (node *StoreNode, err error) {
+	response, err := this.client.Get(etcdKey(key), false, false)
+	if err != nil {
+		return nil, fromEtcdError(key, err)
+	}
+	return fromEtcdNode(response.Node), nil
+}
+
+func (this *etcdStore) List(prefix string) (nodes []*StoreNode, err error) {
+	nodes = make([]*StoreNode, 0)
+	response, err := this.client.Get(etcdKey(prefix), false, true)
+	if isEtcdError(err, etcdErrorKeyNotFound) {
+		return nodes, nil
+	}
+	if err != nil {
+		return nil, fromEtcdError(prefix, err)
+	}
+
+	var collect func(node *etcd.Node)
+	collect = func(node *etcd.Node) {
+		if !node.Dir {
+			nodes = append(nodes, fromEtcdNode(node))
+			return
+		}
+		for i := range node.Nodes {
+			collect(&node.Nodes[i])
+		}
+	}
+	collect(response.Node)
+	return
+}
+
+func (this *etcdStore) Set(key, value string, ttl uint64) (index uint64, err error) {
+	response, err := this.client.Set(etcdKey(key), value, ttl)
+	return modifiedIndex(key, response, err)
+}
+
+func (this *etcdStore) Create(key, value string, ttl uint64) (index uint64, err error) {
+	response, err := this.client.Create(etcdKey(key), value, ttl)
+	return modifiedIndex(key, response, err)
+}
+
+func (this *etcdStore) CompareAndSwap(key, value string, ttl uint64, prevIndex uint64) (index uint64, err error) {
+	response, err := this.client.CompareAndSwap(etcdKey(key), value, ttl, "", prevIndex)
+	return modifiedIndex(key, response, err)
+}
+
+func (this *etcdStore) CompareAndDelete(key string, prevIndex uint64) (err error) {
+	_, err = this.client.CompareAndDelete(etcdKey(key), "", prevIndex)
+	return fromEtcdError(key, err)
+}
+
+func (this *etcdStore) Delete(key string) (err error) {
+	_, err = this.client.Delete(etcdKey(key), false)
+	return fromEtcdError(key, err)
+}
+
+func (this *etcdStore) Watch(prefix string, receiver chan *StoreEvent, stop chan bool) (err error) {
+	// The client may close the channel when the watch ends, so each watch uses its own.
+	responses := make(chan *etcd.Response)
+	result := make(chan error, 1)
+	go func() {
+		_, err := this.client.Watch(etcdKey(prefix), 0, true, responses, stop)
+		result <- err
+	}()
+
+	for {
+		select {
+		case err = <-result:
+			select {
+			case <-stop:
+				err = nil
+			default:
+				err = fromEtcdError(prefix, err)
+			}
+			return
+		case response, ok := <-responses:
+			if !ok {
+				responses = nil
+				continue
+			}
+			event := fromEtcdResponse(response)
+			if event == nil {
+				continue
+			}
+			select {
+			case receiver <- event:
+			case <-stop:
+				// Keep consuming responses until the watch returns, so that the client is not blocked.
+			}
+		}
+	}
+}
+
+func etcdKey(key string) string {
+	return "/" + strings.TrimPrefix(key, "/")
+}
+
+func modifiedIndex(key string, response *etcd.Response, err error) (index uint64, _ error) {
+	if err != nil {
+		return 0, fromEtcdError(key, err)
+	}
+	return response.Node.ModifiedIndex, nil
+}
+
+func fromEtcdNode(node *etcd.Node) *StoreNode {
+	if node == nil {
+		return nil
+	}
+	return &StoreNode{Key: strings.TrimPrefix(node.Key, "/"), Value: node.Value, Index: node.ModifiedIndex}
+}
+
+// Converts a watch response into an event, or returns nil if the action is not relevant to watchers.
+func fromEtcdResponse(response *etcd.Response) (event *StoreEvent) {
+	if response == nil || response.Node == nil {
+		return nil
+	}
+	event = &StoreEvent{Node: fromEtcdNode(response.Node), PrevNode: fromEtcdNode(response.PrevNode)}
+	switch response.Action {
+	case "set", "update", "create", "compareAndSwap":
+		event.Action = StoreSet
+	case "delete", "compareAndDelete":
+		event.Action = StoreDelete
+	case "expire":
+		event.Action = StoreExpire
+	default:
+		return nil
+	}
+	return
+}
+
+// Determines whether the error is an etcd error with the provided code.
+func isEtcdError(err error, code int) bool {
+	switch etcdErr := err.(type) {
+	case etcd.EtcdError:
+		return etcdErr.ErrorCode == code
+	case *etcd.EtcdError:
+		return etcdErr != nil && etcdErr.ErrorCode == code
+	}
+	return false
+}
+
+// Converts etcd errors concerning the key which callers act on into store errors.
+func fromEtcdError(key string, err error) error {
+	var etcdErr etcd.EtcdError
+	switch typed := err.(type) {
+	case etcd.EtcdError:
+		etcdErr = typed
+	case *etcd.EtcdError:
+		if typed == nil {
+			return err
+		}
+		etcdErr = *typed
+	default:
+		return err
+	}
+
+	storeErr := &StoreError{Key: key, Message: etcdErr.Message}
+	switch etcdErr.ErrorCode {
+	case etcdErrorKeyNotFound:
+		storeErr.Code = StoreKeyNotFound
+	case etcdErrorTestFailed:
+		storeErr.Code = StoreTestFailed
+	case etcdErrorNodeExists:
+		storeErr.Code = StoreNodeExists
+	default:
+		return err
+	}
+	return storeErr
+}
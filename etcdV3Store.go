@@ -0,0 +1,364 @@
+// Store backed by etcd's v3 API.
+package daprdockr
+
+import (
+	"context"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	EtcdV3RequestTimeout = 5                // Seconds
+	SessionTimeToLive    = UpdateTimeToLive // Seconds after which the values of an agent which stopped renewing its lease are removed.
+)
+
+// Prefixes of the keys which are attached to the store's session lease.
+var DefaultSessionPrefixes = []string{"instances/", "locks/"}
+
+var etcdV3Log = NewLogger("EtcdV3")
+
+// A store which is kept alive as long as it is open, rather than by rewriting its values.
+type LeasedStore interface {
+	Store
+
+	// Returns the identifier of the lease which keeps the key alive, or zero if the key is not kept alive by the store.
+	// The identifier changes if the lease is lost, in which case the values which it kept alive were removed.
+	LeaseFor(key string) int64
+}
+
+// A store which uses etcd's v3 API.
+// Values under the session prefixes are attached to a single lease, which is kept alive until the store is closed.
+// Hence, the values of an agent which stops are removed together once the lease expires, regardless of their time to live.
+// Other values with a time to live are attached to a lease of their own, which is not renewed.
+type EtcdV3Store struct {
+	client          *clientv3.Client
+	sessionPrefixes []string
+	lock            sync.Mutex
+	lease           clientv3.LeaseID          // The session lease, or zero if none is held.
+	lostLeases      map[clientv3.LeaseID]bool // Session leases which expired before the store was closed.
+	ctx             context.Context
+	cancel          context.CancelFunc
+	keepAlives      sync.WaitGroup
+}
+
+// Creates a store which uses the provided etcd v3 client. The store must be closed to release its lease.
+func NewEtcdV3Store(client *clientv3.Client) *EtcdV3Store {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &EtcdV3Store{
+		client:          client,
+		sessionPrefixes: DefaultSessionPrefixes,
+		lostLeases:      make(map[clientv3.LeaseID]bool),
+		ctx:             ctx,
+		cancel:          cancel,
+	}
+}
+
+// Stops renewing the session lease and revokes it, which removes the values attached to it.
+func (this *EtcdV3Store) Close() (err error) {
+	this.cancel()
+	this.keepAlives.Wait()
+
+	this.lock.Lock()
+	lease := this.lease
+	this.lease = 0
+	this.lock.Unlock()
+	if lease != 0 {
+		ctx, cancel := requestContext()
+		defer cancel()
+		_, err = this.client.Revoke(ctx, lease)
+	}
+	return
+}
+
+func (this *EtcdV3Store) LeaseFor(key string) int64 {
+	if !this.isSessionKey(etcdV3Key(key)) {
+		return 0
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return int64(this.lease)
+}
+
+func (this *EtcdV3Store) Get(key string) (node *StoreNode, err error) {
+	key = etcdV3Key(key)
+	ctx, cancel := requestContext()
+	defer cancel()
+	response, err := this.client.Get(ctx, key)
+	if err != nil {
+		return
+	}
+	if len(response.Kvs) == 0 {
+		return nil, &StoreError{Code: StoreKeyNotFound, Key: key, Message: "Key not found"}
+	}
+	kv := response.Kvs[0]
+	return &StoreNode{Key: string(kv.Key), Value: string(kv.Value), Index: uint64(kv.ModRevision)}, nil
+}
+
+func (this *EtcdV3Store) List(prefix string) (nodes []*StoreNode, err error) {
+	ctx, cancel := requestContext()
+	defer cancel()
+	response, err := this.client.Get(ctx, etcdV3Prefix(prefix), clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
+	if err != nil {
+		return
+	}
+	nodes = make([]*StoreNode, 0, len(response.Kvs))
+	for _, kv := range response.Kvs {
+		nodes = append(nodes, &StoreNode{Key: string(kv.Key), Value: string(kv.Value), Index: uint64(kv.ModRevision)})
+	}
+	return
+}
+
+func (this *EtcdV3Store) Set(key, value string, ttl uint64) (index uint64, err error) {
+	key = etcdV3Key(key)
+	put, err := this.put(key, value, ttl)
+	if err != nil {
+		return
+	}
+	ctx, cancel := requestContext()
+	defer cancel()
+	response, err := this.client.Do(ctx, put)
+	if err != nil {
+		return
+	}
+	return uint64(response.Put().Header.Revision), nil
+}
+
+func (this *EtcdV3Store) Create(key, value string, ttl uint64) (index uint64, err error) {
+	key = etcdV3Key(key)
+	put, err := this.put(key, value, ttl)
+	if err != nil {
+		return
+	}
+	ctx, cancel := requestContext()
+	defer cancel()
+	response, err := this.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(put).
+		Commit()
+	if err != nil {
+		return
+	}
+	if !response.Succeeded {
+		return 0, &StoreError{Code: StoreNodeExists, Key: key, Message: "Key already exists"}
+	}
+	return uint64(response.Header.Revision), nil
+}
+
+func (this *EtcdV3Store) CompareAndSwap(key, value string, ttl uint64, prevIndex uint64) (index uint64, err error) {
+	key = etcdV3Key(key)
+	put, err := this.put(key, value, ttl)
+	if err != nil {
+		return
+	}
+	ctx, cancel := requestContext()
+	defer cancel()
+	response, err := this.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(key), "=", int64(prevIndex))).
+		Then(put).
+		Else(clientv3.OpGet(key)).
+		Commit()
+	if err != nil {
+		return
+	}
+	if !response.Succeeded {
+		return 0, compareFailure(key, response)
+	}
+	return uint64(response.Header.Revision), nil
+}
+
+func (this *EtcdV3Store) CompareAndDelete(key string, prevIndex uint64) (err error) {
+	key = etcdV3Key(key)
+	ctx, cancel := requestContext()
+	defer cancel()
+	response, err := this.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(key), "=", int64(prevIndex))).
+		Then(clientv3.OpDelete(key)).
+		Else(clientv3.OpGet(key)).
+		Commit()
+	if err != nil {
+		return
+	}
+	if !response.Succeeded {
+		return compareFailure(key, response)
+	}
+	return
+}
+
+func (this *EtcdV3Store) Delete(key string) (err error) {
+	key = etcdV3Key(key)
+	ctx, cancel := requestContext()
+	defer cancel()
+	response, err := this.client.Delete(ctx, key)
+	if err != nil {
+		return
+	}
+	if response.Deleted == 0 {
+		return &StoreError{Code: StoreKeyNotFound, Key: key, Message: "Key not found"}
+	}
+	return
+}
+
+// Deletions of values whose lease has ended are reported as expiries.
+func (this *EtcdV3Store) Watch(prefix string, receiver chan *StoreEvent, stop chan bool) (err error) {
+	ctx, cancel := context.WithCancel(this.ctx)
+	defer cancel()
+	watch := this.client.Watch(ctx, etcdV3Prefix(prefix), clientv3.WithPrefix(), clientv3.WithPrevKV())
+	for {
+		select {
+		case <-stop:
+			return nil
+		case response, ok := <-watch:
+			if !ok {
+				return ctx.Err()
+			}
+			if err = response.Err(); err != nil {
+				return
+			}
+			// A lease which ends removes all of its values at once, so other agents' leases are looked up once for each
+			// batch of events rather than once for each deletion.
+			ended := make(map[clientv3.LeaseID]bool)
+			for _, change := range response.Events {
+				event := &StoreEvent{
+					Action: StoreSet,
+					Node:   &StoreNode{Key: string(change.Kv.Key), Value: string(change.Kv.Value), Index: uint64(change.Kv.ModRevision)},
+				}
+				if change.PrevKv != nil {
+					event.PrevNode = &StoreNode{Key: string(change.PrevKv.Key), Value: string(change.PrevKv.Value), Index: uint64(change.PrevKv.ModRevision)}
+				}
+				if change.Type == clientv3.EventTypeDelete {
+					event.Action = StoreDelete
+					event.Node.Index = uint64(response.Header.Revision)
+					if change.PrevKv != nil && change.PrevKv.Lease != 0 && this.leaseEnded(clientv3.LeaseID(change.PrevKv.Lease), ended) {
+						event.Action = StoreExpire
+					}
+				}
+				select {
+				case receiver <- event:
+				case <-stop:
+					return nil
+				}
+			}
+		}
+	}
+}
+
+// Creates the operation which stores a value, attaching it to the appropriate lease.
+func (this *EtcdV3Store) put(key, value string, ttl uint64) (op clientv3.Op, err error) {
+	if ttl == 0 {
+		return clientv3.OpPut(key, value), nil
+	}
+
+	var lease clientv3.LeaseID
+	if this.isSessionKey(key) {
+		lease, err = this.sessionLease()
+	} else {
+		ctx, cancel := requestContext()
+		defer cancel()
+		var response *clientv3.LeaseGrantResponse
+		if response, err = this.client.Grant(ctx, int64(ttl)); err == nil {
+			lease = response.ID
+		}
+	}
+	if err != nil {
+		return
+	}
+	return clientv3.OpPut(key, value, clientv3.WithLease(lease)), nil
+}
+
+func (this *EtcdV3Store) isSessionKey(key string) bool {
+	for _, prefix := range this.sessionPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the session lease, granting it and starting its renewal if it is not held.
+func (this *EtcdV3Store) sessionLease() (lease clientv3.LeaseID, err error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.lease != 0 {
+		return this.lease, nil
+	}
+	if err = this.ctx.Err(); err != nil {
+		return
+	}
+
+	ctx, cancel := requestContext()
+	defer cancel()
+	grant, err := this.client.Grant(ctx, SessionTimeToLive)
+	if err != nil {
+		return
+	}
+	keepAlive, err := this.client.KeepAlive(this.ctx, grant.ID)
+	if err != nil {
+		return
+	}
+	this.lease = grant.ID
+	etcdV3Log.Info("Granted session lease", "lease", int64(grant.ID))
+
+	this.keepAlives.Add(1)
+	go func() {
+		defer this.keepAlives.Done()
+		for range keepAlive {
+		}
+
+		// The lease expired or the store was closed. Another lease is granted when next needed.
+		this.lock.Lock()
+		defer this.lock.Unlock()
+		if this.lease == grant.ID && this.ctx.Err() == nil {
+			etcdV3Log.Warn("Lost session lease", "lease", int64(grant.ID))
+			this.lease = 0
+			this.lostLeases[grant.ID] = true
+		}
+	}()
+	return grant.ID, nil
+}
+
+// Determines whether a lease has expired or been revoked. The store's own session leases are judged by whether they
+// are still kept alive. Other leases are looked up once, and the result is kept in the provided map.
+func (this *EtcdV3Store) leaseEnded(lease clientv3.LeaseID, ended map[clientv3.LeaseID]bool) bool {
+	this.lock.Lock()
+	current, lost := lease == this.lease, this.lostLeases[lease]
+	this.lock.Unlock()
+	if current || lost {
+		return lost
+	}
+	if result, known := ended[lease]; known {
+		return result
+	}
+	ctx, cancel := requestContext()
+	defer cancel()
+	response, err := this.client.TimeToLive(ctx, lease)
+	ended[lease] = err == nil && response.TTL <= 0
+	return ended[lease]
+}
+
+// Returns the error for a failed comparison, which failed because the key is absent or was modified.
+func compareFailure(key string, response *clientv3.TxnResponse) error {
+	if len(response.Responses) > 0 {
+		if current := response.Responses[0].GetResponseRange(); current != nil && len(current.Kvs) == 0 {
+			return &StoreError{Code: StoreKeyNotFound, Key: key, Message: "Key not found"}
+		}
+	}
+	return &StoreError{Code: StoreTestFailed, Key: key, Message: "Compare failed"}
+}
+
+func etcdV3Key(key string) string {
+	return strings.Trim(key, "/")
+}
+
+// Returns the key prefix of the values beneath the provided key. An empty prefix matches all values.
+func etcdV3Prefix(key string) string {
+	if key = etcdV3Key(key); len(key) == 0 {
+		return ""
+	}
+	return key + "/"
+}
+
+func requestContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), EtcdV3RequestTimeout*time.Second)
+}
@@ -0,0 +1,126 @@
+package daprdockr
+
+import (
+	"context"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Endpoints of the etcd which the v3 store is tested against, eg: "http://localhost:2379". Tests which need etcd are
+// skipped if it is not set.
+const testEtcdEnv = "DAPRDOCKR_TEST_ETCD"
+
+func newTestEtcdV3Store(t *testing.T) (store *EtcdV3Store, client *clientv3.Client) {
+	endpoints := os.Getenv(testEtcdEnv)
+	if len(endpoints) == 0 {
+		t.Skip("Set " + testEtcdEnv + " to test against etcd")
+	}
+	client, err := clientv3.New(clientv3.Config{Endpoints: strings.Split(endpoints, ","), DialTimeout: EtcdDialTimeout * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewEtcdV3Store(client), client
+}
+
+// Returns the time to live which the lease of a key was granted, and whether it is the store's session lease.
+func grantedTimeToLive(t *testing.T, store *EtcdV3Store, client *clientv3.Client, key string) (ttl int64, session bool) {
+	response, err := client.Get(context.Background(), key)
+	if err != nil || len(response.Kvs) == 0 {
+		t.Fatalf("Expected %s to exist: %v", key, err)
+	}
+	lease := clientv3.LeaseID(response.Kvs[0].Lease)
+	if lease == 0 {
+		t.Fatalf("Expected %s to have a lease", key)
+	}
+	leaseTtl, err := client.TimeToLive(context.Background(), lease)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaseTtl.GrantedTTL, int64(lease) == store.LeaseFor(instancePath("", "", 0))
+}
+
+// An agent's instance records and locks share its session lease, so they are removed together when it stops, while
+// restart records keep their own time to live.
+func TestEtcdV3SessionLease(t *testing.T) {
+	store, client := newTestEtcdV3Store(t)
+	defer client.Close()
+	config := newTestServiceConfig(1)
+	config.Group = "test" + strconv.FormatInt(time.Now().UnixNano(), 36)
+
+	if _, err := LockInstance(store, "node-1", 0, config); err != nil {
+		t.Fatal(err)
+	}
+	instance := &Instance{Group: config.Group, Service: config.Name, Instance: 0, Owner: "node-1"}
+	if _, err := updateInstanceInStore(store, instance, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RecordInstanceFailure(store, "node-1", config.Group, config.Name, 0, "Exited with code 1"); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{lockPath(config.Group, config.Name, 0), instancePath(config.Group, config.Name, 0)} {
+		if ttl, session := grantedTimeToLive(t, store, client, key); ttl != SessionTimeToLive || !session {
+			t.Errorf("Expected %s to be on the session lease, got %d seconds, session lease: %v", key, ttl, session)
+		}
+	}
+	if _, session := grantedTimeToLive(t, store, client, restartsPath(config.Group, config.Name, 0)); session {
+		t.Error("Expected the restart record to keep its own time to live")
+	}
+
+	// Another agent sees the records of an agent which stops expire.
+	other := NewEtcdV3Store(client)
+	defer other.Close()
+	events := make(chan *StoreEvent, 10)
+	stop := make(chan bool)
+	defer close(stop)
+	go other.Watch("instances/"+config.Group, events, stop)
+	time.Sleep(100 * time.Millisecond)
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case event := <-events:
+		if event.Action != StoreExpire {
+			t.Errorf("Expected the instance record to expire, got %s", event.Action)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Timed out waiting for the instance record to expire")
+	}
+	if _, err := GetInstanceLock(other, config.Group, config.Name, 0); !isStoreError(err, StoreKeyNotFound) {
+		t.Errorf("Expected the lock to be removed with the session, got %v", err)
+	}
+	if record, err := GetRestartRecord(other, config.Group, config.Name, 0); err != nil || record == nil {
+		t.Errorf("Expected the restart record to be kept once the agent stopped, got %+v, %v", record, err)
+	}
+}
+
+func TestEtcdV3SessionKeys(t *testing.T) {
+	store := NewEtcdV3Store(nil)
+	for _, key := range []string{instancePath("web", "api", 0), lockPath("web", "api", 0)} {
+		if !store.isSessionKey(etcdV3Key(key)) {
+			t.Errorf("Expected %s to be kept alive by the session", key)
+		}
+	}
+	for _, key := range []string{journalPath("web", "api", 0), restartsPath("web", "api", 0)} {
+		if store.isSessionKey(etcdV3Key(key)) {
+			t.Errorf("Expected %s to keep its own time to live", key)
+		}
+	}
+}
+
+// The store's own leases are judged by whether they are kept alive, without asking etcd.
+func TestEtcdV3OwnLeaseEnded(t *testing.T) {
+	store := NewEtcdV3Store(nil)
+	store.lease = 2
+	store.lostLeases[1] = true
+	ended := make(map[clientv3.LeaseID]bool)
+	if store.leaseEnded(2, ended) {
+		t.Error("Expected the session lease which is kept alive not to have ended")
+	}
+	if !store.leaseEnded(1, ended) {
+		t.Error("Expected the lost session lease to have ended")
+	}
+}
@@ -0,0 +1,226 @@
+// Runtime which simulates containers in memory, for running agents without Docker.
+package daprdockr
+
+import (
+	goerrors "errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	FakeRuntimeFirstPort = 49153 // The first host port allocated to simulated containers, as in Docker.
+	fakeRuntimeKillCode  = 137
+)
+
+// A runtime which simulates containers without running anything. Started containers are allocated host ports for
+// their exposed ports, and keep running until they are stopped, killed or crashed using Crash.
+type FakeRuntime struct {
+	lock       sync.Mutex
+	lastId     int
+	nextPort   int
+	containers map[string]*fakeContainer // By ID.
+}
+
+type fakeContainer struct {
+	container RuntimeContainer
+	spec      ContainerSpec
+	output    []string
+	stopped   chan bool // Closed when the container stops. Nil if it is not running.
+}
+
+// Creates a runtime without any containers.
+func NewFakeRuntime() *FakeRuntime {
+	return &FakeRuntime{
+		nextPort:   FakeRuntimeFirstPort,
+		containers: make(map[string]*fakeContainer),
+	}
+}
+
+func (this *FakeRuntime) CreateContainer(spec *ContainerSpec) (container *RuntimeContainer, err error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if len(spec.Name) > 0 {
+		if _, err = this.find(spec.Name); err == nil {
+			return nil, goerrors.New("Conflict, the name " + spec.Name + " is already in use")
+		}
+	}
+	this.lastId++
+	id := fmt.Sprintf("%012x", this.lastId)
+	name := spec.Name
+	if len(name) == 0 {
+		name = id
+	}
+	created := &fakeContainer{
+		container: RuntimeContainer{
+			ID:           id,
+			Name:         name,
+			Image:        spec.Config.Image,
+			Status:       "Created",
+			PortMappings: make(map[string]string),
+			Env:          append([]string(nil), spec.Config.Env...),
+		},
+		spec: *spec,
+	}
+	this.containers[id] = created
+	return created.copy(), nil
+}
+
+func (this *FakeRuntime) StartContainer(id string) (err error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	container, err := this.find(id)
+	if err != nil {
+		return
+	}
+	if container.container.Running {
+		return goerrors.New("Container already running: " + id)
+	}
+	container.container.Running = true
+	container.container.ExitCode = 0
+	container.container.StartedAt = time.Now()
+	container.container.FinishedAt = time.Time{}
+	container.container.Status = "Up"
+	container.stopped = make(chan bool)
+	container.container.PortMappings = make(map[string]string)
+	for _, port := range exposedPorts(&container.spec.Config) {
+		container.container.PortMappings[port] = strconv.Itoa(this.nextPort)
+		this.nextPort++
+	}
+	container.output = append(container.output, "Started "+container.container.Image)
+	return
+}
+
+// Stopping a container which is not running has no effect, as in Docker.
+func (this *FakeRuntime) StopContainer(id string, timeout uint) (err error) {
+	_, err = this.exit(id, 0, "Stopped")
+	return
+}
+
+func (this *FakeRuntime) KillContainer(id string) (err error) {
+	_, err = this.exit(id, fakeRuntimeKillCode, "Killed")
+	return
+}
+
+// Simulates a running container exiting by itself with the provided exit code.
+func (this *FakeRuntime) Crash(id string, exitCode int) (err error) {
+	exited, err := this.exit(id, exitCode, "Crashed")
+	if err == nil && !exited {
+		err = goerrors.New("Container not running: " + id)
+	}
+	return
+}
+
+func (this *FakeRuntime) RemoveContainer(id string) (err error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	container, err := this.find(id)
+	if err != nil {
+		return
+	}
+	if container.container.Running {
+		return goerrors.New("Cannot remove running container: " + id)
+	}
+	delete(this.containers, container.container.ID)
+	return
+}
+
+func (this *FakeRuntime) ListContainers() (containers []*RuntimeContainer, err error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	containers = make([]*RuntimeContainer, 0, len(this.containers))
+	for _, container := range this.containers {
+		if container.container.Running {
+			containers = append(containers, container.copy())
+		}
+	}
+	sort.Sort(runtimeContainersByName(containers))
+	return
+}
+
+func (this *FakeRuntime) InspectContainer(id string) (container *RuntimeContainer, err error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	found, err := this.find(id)
+	if err != nil {
+		return
+	}
+	return found.copy(), nil
+}
+
+// Writes a line for each time the container started and stopped.
+func (this *FakeRuntime) ContainerLogs(id string, options ContainerLogsOptions, output io.Writer) (err error) {
+	this.lock.Lock()
+	container, err := this.find(id)
+	if err != nil {
+		this.lock.Unlock()
+		return
+	}
+	lines := append([]string(nil), container.output...)
+	stopped := container.stopped
+	this.lock.Unlock()
+
+	if tail, err := strconv.Atoi(options.Tail); err == nil && tail >= 0 && tail < len(lines) {
+		lines = lines[len(lines)-tail:]
+	}
+	for _, line := range lines {
+		if _, err = io.WriteString(output, line+"\n"); err != nil {
+			return
+		}
+	}
+	if options.Follow && stopped != nil {
+		<-stopped
+	}
+	return
+}
+
+// Stops a container if it is running, recording its exit code. Must not be called with the lock held.
+func (this *FakeRuntime) exit(id string, exitCode int, reason string) (exited bool, err error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	container, err := this.find(id)
+	if err != nil || !container.container.Running {
+		return
+	}
+	container.container.Running = false
+	container.container.ExitCode = exitCode
+	container.container.FinishedAt = time.Now()
+	container.container.Status = "Exited (" + strconv.Itoa(exitCode) + ")"
+	container.output = append(container.output, reason+" with exit code "+strconv.Itoa(exitCode))
+	close(container.stopped)
+	container.stopped = nil
+	return true, nil
+}
+
+// Finds a container by ID or name. Must be called with the lock held.
+func (this *FakeRuntime) find(id string) (container *fakeContainer, err error) {
+	if container, exists := this.containers[id]; exists {
+		return container, nil
+	}
+	name := strings.TrimPrefix(id, "/")
+	for _, container := range this.containers {
+		if container.container.Name == name {
+			return container, nil
+		}
+	}
+	return nil, goerrors.New("No such container: " + id)
+}
+
+func (this *fakeContainer) copy() *RuntimeContainer {
+	copied := this.container
+	copied.PortMappings = make(map[string]string, len(this.container.PortMappings))
+	for private, public := range this.container.PortMappings {
+		copied.PortMappings[private] = public
+	}
+	return &copied
+}
+
+type runtimeContainersByName []*RuntimeContainer
+
+func (this runtimeContainersByName) Len() int           { return len(this) }
+func (this runtimeContainersByName) Less(i, j int) bool { return this[i].Name < this[j].Name }
+func (this runtimeContainersByName) Swap(i, j int)      { this[i], this[j] = this[j], this[i] }
@@ -0,0 +1,108 @@
+// Locks which prevent multiple agents from instantiating the same instance.
+package daprdockr
+
+import (
+	"encoding/json"
+	goerrors "errors"
+	"strconv"
+	"time"
+)
+
+const (
+	ReleasedLockTimeToLive = 5 * 60 // Seconds for which a released lock is kept for diagnosis.
+)
+
+// The record of an agent's claim on an instance.
+// Locks are kept under "locks/", distinct from the instance records under "instances/".
+type InstanceLock struct {
+	Group    string `json:"-"`
+	Service  string `json:"-"`
+	Instance int    `json:"-"`
+	Node     string // The node which acquired the lock.
+	Acquired time.Time
+	Released bool   `json:",omitempty"` // The lock was given up and may be taken by any agent.
+	Reason   string `json:",omitempty"` // Why the lock was released, eg: the instantiation failure.
+	index    uint64 // The store index of the lock record.
+}
+
+func lockPath(group, service string, instance int) string {
+	return "locks/" + group + "/" + service + "/" + strconv.Itoa(instance)
+}
+
+// Acquires the lock on an instance for the provided node, taking over a lock which was released by its holder or which
+// the node already holds, since a node keeps the locks of the instances which it started.
+func LockInstance(store Store, node string, instance int, service *ServiceConfig) (lock *InstanceLock, err error) {
+	lock = &InstanceLock{
+		Group:    service.Group,
+		Service:  service.Name,
+		Instance: instance,
+		Node:     node,
+		Acquired: time.Now().UTC(),
+	}
+	payload, err := json.Marshal(lock)
+	if err != nil {
+		return nil, err
+	}
+
+	key := lockPath(service.Group, service.Name, instance)
+	lock.index, err = store.Create(key, string(payload), LockTimeToLive)
+	if isStoreError(err, StoreNodeExists) {
+		// Take over the existing lock only if its holder released it or it is this node's.
+		var existing *InstanceLock
+		existing, err = GetInstanceLock(store, service.Group, service.Name, instance)
+		if err != nil {
+			return nil, err
+		}
+		if !existing.Released && existing.Node != node {
+			return nil, &StoreError{Code: StoreNodeExists, Key: key, Message: "Instance locked by " + existing.Node}
+		}
+		lock.index, err = store.CompareAndSwap(key, string(payload), LockTimeToLive, existing.index)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Releases a lock which could not be used or is no longer needed, recording the reason so that it can be diagnosed.
+// Other agents may acquire the instance immediately.
+func ReleaseInstanceLock(store Store, lock *InstanceLock, reason string) (err error) {
+	released := *lock
+	released.Released = true
+	released.Reason = reason
+	payload, err := json.Marshal(&released)
+	if err != nil {
+		return
+	}
+	index, err := store.CompareAndSwap(lockPath(lock.Group, lock.Service, lock.Instance), string(payload), ReleasedLockTimeToLive, lock.index)
+	if err != nil {
+		return
+	}
+	lock.Released = true
+	lock.Reason = reason
+	lock.index = index
+	return
+}
+
+// Gets the lock on an instance.
+func GetInstanceLock(store Store, group, service string, instance int) (lock *InstanceLock, err error) {
+	node, err := store.Get(lockPath(group, service, instance))
+	if err != nil {
+		return
+	}
+	return parseInstanceLock(node, group, service, instance)
+}
+
+func parseInstanceLock(node *StoreNode, group, service string, instance int) (lock *InstanceLock, err error) {
+	if node == nil || len(node.Value) == 0 {
+		err = goerrors.New("Instance lock node missing or empty")
+		return
+	}
+	lock = &InstanceLock{Group: group, Service: service, Instance: instance}
+	err = json.Unmarshal([]byte(node.Value), lock)
+	if err != nil {
+		return
+	}
+	lock.index = node.Index
+	return
+}
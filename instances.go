@@ -1,14 +1,14 @@
 package daprdockr
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	goerrors "errors"
-	"github.com/coreos/go-etcd/etcd"
-	"log"
 	"reflect"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -22,14 +22,51 @@ type instances struct {
 	Heartbeats chan *Instance
 	Flatlines  chan *Instance
 	Updated    chan bool
+	Conflicts  chan *InstanceConflictError // Local instances whose records are owned by another node.
+	lock       sync.Mutex
+	done       chan bool // Closed once heartbeats and flatlines are no longer processed.
 }
 
-var Instances = &instances{}
+var instancesLog = NewLogger("Instances")
 
-func init() {
-	Instances.Heartbeats = make(chan *Instance)
-	Instances.Flatlines = make(chan *Instance)
-	Instances.Updated = make(chan bool, 1)
+func newInstances() *instances {
+	return &instances{
+		Heartbeats: make(chan *Instance),
+		Flatlines:  make(chan *Instance),
+		Updated:    make(chan bool, 1),
+		Conflicts:  make(chan *InstanceConflictError, 10),
+		done:       make(chan bool),
+	}
+}
+
+// Returns a channel which the processor of instance updates closes once it stops.
+func (this *instances) start() (done chan bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.done = make(chan bool)
+	return this.done
+}
+
+func (this *instances) stopped() chan bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.done
+}
+
+// Reports that a local instance is alive, unless instance updates have stopped.
+func (this *instances) heartbeat(instance *Instance) {
+	select {
+	case this.Heartbeats <- instance:
+	case <-this.stopped():
+	}
+}
+
+// Reports that a local instance has died, unless instance updates have stopped.
+func (this *instances) flatline(instance *Instance) {
+	select {
+	case this.Flatlines <- instance:
+	case <-this.stopped():
+	}
 }
 
 type Instance struct {
@@ -37,7 +74,23 @@ type Instance struct {
 	Service      string `json:"-"`
 	Instance     int    `json:"-"`
 	Addrs        []string
-	PortMappings map[string]string // Map from host port to container port.
+	PortMappings map[string]string // Map from container port to host port. UDP container ports are suffixed with "/udp", eg: "53/udp".
+	Agent        string            `json:",omitempty"` // Address of the HTTP endpoint of the agent managing the instance.
+	Owner        string            `json:",omitempty"` // Identifier of the node which owns the instance record.
+	Image        string            `json:",omitempty"` // Image which the container runs, or the command which the process runs.
+	ContainerId  string            `json:",omitempty"`
+	Started      time.Time         // When the container started, in UTC. Zero if unknown.
+	Revision     string            `json:",omitempty"` // Revision of the service configuration which the container was created from.
+}
+
+// Indicates that an instance record is owned by another node.
+type InstanceConflictError struct {
+	Instance *Instance
+	Owner    string
+}
+
+func (this *InstanceConflictError) Error() string {
+	return "Instance " + this.Instance.QualifiedName() + " is owned by " + this.Owner
 }
 
 func (this *Instance) String() string {
@@ -53,8 +106,9 @@ func (this *Instance) Equals(other *Instance) (equal bool) {
 	return reflect.DeepEqual(this, other)
 }
 
-func (this *Instance) FullyQualifiedDomainName() string {
-	return strconv.Itoa(this.Instance) + "." + this.Service + "." + this.Group + "." + ContainerDomainSuffix
+// Returns the instance's name within the zone, eg: "0.api.web.container".
+func (this *Instance) FullyQualifiedDomainName(zone string) string {
+	return this.QualifiedName() + "." + zone
 }
 
 func (this *Instance) QualifiedName() string {
@@ -84,58 +138,150 @@ func (op Operation) String() (result string) {
 	return
 }
 
+func (op Operation) MarshalText() (text []byte, err error) {
+	return []byte(op.String()), nil
+}
+
 type InstanceUpdate struct {
 	Operation Operation
 	Instance  *Instance
 }
 
+// Parses an instance name in the form "<instance>.<service>.<group>", optionally followed by the provided zone.
+func ParseInstanceQualifiedName(name, zone string) (group, service string, instance int, err error) {
+	parts := strings.Split(trimZone(name, zone), ".")
+	if len(parts) != 3 || len(parts[1]) == 0 || len(parts[2]) == 0 {
+		err = goerrors.New("Instance name must be in the form <instance>.<service>.<group>[." + zone + "]: " + name)
+		return
+	}
+	instance, err = strconv.Atoi(parts[0])
+	if err != nil || instance < 0 {
+		err = goerrors.New("Instance number must be a non-negative integer: " + name)
+		return
+	}
+	service = parts[1]
+	group = parts[2]
+	return
+}
+
+// Returns a name without the zone or a trailing dot, eg: "0.api.web" for "0.api.web.container.".
+func trimZone(name, zone string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(name, "."), "."+zone)
+}
+
 func instancePath(group, service string, instance int) string {
 	return "instances/" + group + "/" + service + "/" + strconv.Itoa(instance)
 }
 
-func updateInstanceInStore(client *etcd.Client, instance *Instance) (err error) {
+// Writes the record of a local instance, provided that the record is absent or owned by the local node.
+// The index is that of the previous write by this node, or zero if unknown. Returns the index of the new record.
+// An InstanceConflictError is returned if another node owns the record.
+func updateInstanceInStore(store Store, instance *Instance, index uint64) (newIndex uint64, err error) {
 	payload, err := json.Marshal(instance)
 	if err != nil {
 		return
 	}
-	_, err = client.Set(instancePath(instance.Group, instance.Service, instance.Instance), string(payload), UpdateTimeToLive)
-	if err != nil {
-		return
+	key := instancePath(instance.Group, instance.Service, instance.Instance)
+
+	if index > 0 {
+		newIndex, err = store.CompareAndSwap(key, string(payload), UpdateTimeToLive, index)
+	} else {
+		newIndex, err = store.Create(key, string(payload), UpdateTimeToLive)
+	}
+
+	switch {
+	case isStoreError(err, StoreKeyNotFound):
+		// The record expired since the previous heartbeat.
+		newIndex, err = store.Create(key, string(payload), UpdateTimeToLive)
+	case isStoreError(err, StoreTestFailed), isStoreError(err, StoreNodeExists):
+		// The record was written by another agent, or by this node before the index was known.
+		var owner string
+		owner, index, err = getInstanceOwner(store, key)
+		if err != nil {
+			return
+		}
+		if len(owner) > 0 && owner != instance.Owner {
+			err = &InstanceConflictError{Instance: instance, Owner: owner}
+			return
+		}
+		newIndex, err = store.CompareAndSwap(key, string(payload), UpdateTimeToLive, index)
 	}
 	return
 }
 
-func removeInstanceFromStore(client *etcd.Client, instance *Instance) (err error) {
-	_, err = client.Delete(instancePath(instance.Group, instance.Service, instance.Instance), false)
+// Removes the record of a local instance, provided that the record is owned by the local node.
+// The index is that of the previous write by this node, or zero if unknown.
+func removeInstanceFromStore(store Store, instance *Instance, index uint64) (err error) {
+	key := instancePath(instance.Group, instance.Service, instance.Instance)
+	if index == 0 {
+		var owner string
+		owner, index, err = getInstanceOwner(store, key)
+		if err != nil {
+			return
+		}
+		if len(owner) > 0 && owner != instance.Owner {
+			return &InstanceConflictError{Instance: instance, Owner: owner}
+		}
+	}
+	err = store.CompareAndDelete(key, index)
+	if isStoreError(err, StoreTestFailed) {
+		// The record changed hands since this node last wrote it.
+		var owner string
+		owner, _, err = getInstanceOwner(store, key)
+		if err == nil {
+			err = &InstanceConflictError{Instance: instance, Owner: owner}
+		}
+	}
+	return
+}
+
+// Gets the owner and index of an instance record.
+func getInstanceOwner(store Store, key string) (owner string, index uint64, err error) {
+	node, err := store.Get(key)
 	if err != nil {
 		return
 	}
-	return
+	instance, err := parseInstance(node)
+	if err != nil {
+		return
+	}
+	return instance.Owner, node.Index, nil
 }
 
-func LockInstance(client *etcd.Client, instance int, service *ServiceConfig) (err error) {
-	key := instancePath(service.Group, service.Name, instance)
-	_, err = client.Create(key, "", LockTimeToLive)
+// Gets the current record of an instance.
+func GetInstance(store Store, group, service string, instance int) (result *Instance, err error) {
+	node, err := store.Get(instancePath(group, service, instance))
+	if err != nil {
+		return
+	}
+	result, err = parseInstance(node)
 	return
 }
 
-// Broadcasts the latest instance updates to the output channels.
+// Broadcasts the latest instance updates to the output channels until the context is done, then closes them.
 // Multiple subsequent messages to any given channel are suppressed and only the latest value is made available for consumers.
-func LatestInstances(etcdClient *etcd.Client, stop chan bool, numChans int, throttleInterval time.Duration) (outgoing []chan map[string]*Instance) {
-	incomingUpdates := currentInstances(etcdClient, stop)
-	return latestInstanceUpdates(incomingUpdates, numChans, throttleInterval)
+func (this *Agent) LatestInstances(ctx context.Context, outgoing []chan map[string]*Instance) (err error) {
+	var wg sync.WaitGroup
+	incomingUpdates := this.currentInstances(ctx, &wg)
+	latestInstanceUpdates(ctx, incomingUpdates, outgoing, this.throttleInterval, &wg)
+	wg.Wait()
+	return
 }
 
 // Broadcasts messages from the provided channel to the output channels.
 // Multiple subsequent messages to any given channel are suppressed and only the latest value is made available for consumers.
-func latestInstanceUpdates(incomingUpdates chan map[string]*Instance, numChans int, throttleInterval time.Duration) (outgoing []chan map[string]*Instance) {
-	outgoing = make([]chan map[string]*Instance, 0, numChans)
-	incoming := make([]chan map[string]*Instance, 0, numChans)
-	for i := 0; i < numChans; i++ {
+func latestInstanceUpdates(ctx context.Context, incomingUpdates chan map[string]*Instance, outgoing []chan map[string]*Instance, throttleInterval time.Duration, wg *sync.WaitGroup) {
+	incoming := make([]chan map[string]*Instance, 0, len(outgoing))
+	for i := range outgoing {
 		incoming = append(incoming, make(chan map[string]*Instance))
-		outgoing = append(outgoing, latestInstances(incoming[i], throttleInterval))
+		latestInstances(ctx, incoming[i], outgoing[i], throttleInterval, wg)
 	}
-	go func() {
+	goTracked(wg, func() {
+		defer func() {
+			for _, ch := range incoming {
+				close(ch)
+			}
+		}()
 		for instances := range incomingUpdates {
 			for _, ch := range incoming {
 				select {
@@ -144,29 +290,30 @@ func latestInstanceUpdates(incomingUpdates chan map[string]*Instance, numChans i
 				}
 			}
 		}
-	}()
-	return
+	})
 }
 
-// Forwards messages from the provided channel to the output channel.
+// Forwards messages from the provided channel to the consumer channel, which is closed once the context is done.
 // Multiple subsequent messages are suppressed and only the latest value is made available for consumers.
-func latestInstances(incomingUpdates chan map[string]*Instance, throttleInterval time.Duration) chan map[string]*Instance {
-	// Consumer channel.
-	consumer := make(chan map[string]*Instance)
-
+func latestInstances(ctx context.Context, incomingUpdates chan map[string]*Instance, consumer chan map[string]*Instance, throttleInterval time.Duration, wg *sync.WaitGroup) {
 	// Shared channels.
 	updateAvailable := make(chan bool, 1)
 	latestUpdate := make(chan map[string]*Instance)
 
 	// Get updates as they are made available.
-	go func() {
+	goTracked(wg, func() {
 		var latest map[string]*Instance
 		for {
 			select {
 			case latestUpdate <- latest:
 				// The latest update has been retrieved.
-			case latest = <-incomingUpdates:
+			case update, ok := <-incomingUpdates:
+				if !ok {
+					return
+				}
+
 				// A new update has arrived.
+				latest = update
 				select {
 				case updateAvailable <- true:
 				// Notify of an update, if not already notified.
@@ -174,206 +321,261 @@ func latestInstances(incomingUpdates chan map[string]*Instance, throttleInterval
 				}
 			}
 		}
-	}()
+	})
 
 	// Provide only the latest update to the consumer.
-	go func() {
+	goTracked(wg, func() {
+		defer close(consumer)
 		throttler := time.NewTicker(throttleInterval)
+		defer throttler.Stop()
 
 		// Wait for initial update to be made available.
-		<-updateAvailable
+		select {
+		case <-ctx.Done():
+			return
+		case <-updateAvailable:
+		}
 		for {
 			// Retrieve update.
-			update := <-latestUpdate
+			var update map[string]*Instance
+			select {
+			case <-ctx.Done():
+				return
+			case update = <-latestUpdate:
+			}
 
 			// Either wait for another update (and retrieve it), or pass the latest update to the consumer.
 			select {
+			case <-ctx.Done():
+				return
 			case <-updateAvailable:
 				// Another update became available before the previous one was consumed.
 			case consumer <- update:
 				// The latest update has been consumed.
-				// Wait for throttler.
-				<-throttler.C
-				// Wait for another update.
-				<-updateAvailable
+				// Wait for throttler, then for another update.
+				select {
+				case <-ctx.Done():
+					return
+				case <-throttler.C:
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-updateAvailable:
+				}
 			}
 		}
-	}()
-	return consumer
+	})
 }
 
 // Returns a channel publishing the current instances whenever they change.
-func currentInstances(client *etcd.Client, stop chan bool) (currentInstances chan map[string]*Instance) {
+func (this *Agent) currentInstances(ctx context.Context, wg *sync.WaitGroup) (currentInstances chan map[string]*Instance) {
+	store := this.store
 	currentInstancesMap := make(map[string]*Instance)
 
+	// The index of the latest record written by this node for each local instance, used to fence heartbeats.
+	ownedIndexes := make(map[string]uint64)
+
+	// Stores which keep records alive need them to be rewritten only when they change or when their lease is lost.
+	leased, _ := store.(LeasedStore)
+	writtenLeases := make(map[string]int64)
+	unchanged := func(name string, instance *Instance) bool {
+		if leased == nil || ownedIndexes[name] == 0 {
+			return false
+		}
+		lease := leased.LeaseFor(instancePath(instance.Group, instance.Service, instance.Instance))
+		current, exists := currentInstancesMap[name]
+		return lease != 0 && writtenLeases[name] == lease && exists && current.Equals(instance)
+	}
+
 	updated := func(update *InstanceUpdate) (instances map[string]*Instance, changed bool) {
 		instances = currentInstancesMap
 		name := update.Instance.QualifiedName()
+		logger := instancesLog.WithInstance(update.Instance.Group, update.Instance.Service, update.Instance.Instance)
 		switch update.Operation {
 		case Heartbeat:
-			log.Printf("[Instances] Heartbeat %s.\n", name)
-			err := updateInstanceInStore(client, update.Instance)
+			logger.Debug("Heartbeat")
+			if unchanged(name, update.Instance) {
+				break
+			}
+			var lease int64
+			if leased != nil {
+				lease = leased.LeaseFor(instancePath(update.Instance.Group, update.Instance.Service, update.Instance.Instance))
+			}
+			index, err := updateInstanceInStore(store, update.Instance, ownedIndexes[name])
+			if conflict, ok := err.(*InstanceConflictError); ok {
+				// Another node owns the instance, so the local container is a duplicate.
+				delete(ownedIndexes, name)
+				this.metrics.instanceOwnershipConflicts.Inc(update.Instance.Service, update.Instance.Group)
+				logger.Warn("Instance is owned by another node", "owner", conflict.Owner)
+				select {
+				case this.instances.Conflicts <- conflict:
+				default:
+					// The conflict will be reported again on the next heartbeat.
+				}
+				break
+			}
 			if err != nil {
-				log.Printf("[Instances] Failed to update store with heartbeat for %s.\n", name)
+				delete(ownedIndexes, name)
+				this.metrics.heartbeatWriteErrors.Inc(update.Instance.Service, update.Instance.Group)
+				logger.Error("Failed to update store with heartbeat", "error", err)
+			} else {
+				ownedIndexes[name] = index
+				writtenLeases[name] = lease
 			}
 			fallthrough
 		case Add:
 			if current, exists := currentInstancesMap[name]; !exists || !current.Equals(update.Instance) {
 				currentInstancesMap[name] = update.Instance
 				changed = true
-				log.Printf("[Instances] Adding %s.\n", name)
+				logger.Info("Adding instance", "addrs", update.Instance.Addrs)
 			}
 		case Flatline:
-			log.Printf("[Instances] Flatline %s.\n", name)
-			err := removeInstanceFromStore(client, update.Instance)
-			if err != nil {
-				log.Printf("[Instances] Failed to update store with demise of %s.\n", name)
+			logger.Info("Flatline")
+			err := removeInstanceFromStore(store, update.Instance, ownedIndexes[name])
+			delete(ownedIndexes, name)
+			if conflict, ok := err.(*InstanceConflictError); ok {
+				// The record belongs to another node, whose instance is still alive.
+				logger.Info("Not removing instance owned by another node", "owner", conflict.Owner)
+				break
+			}
+			if err != nil && !isStoreError(err, StoreKeyNotFound) {
+				logger.Error("Failed to update store with demise of instance", "error", err)
 			}
 			fallthrough
 		case Remove:
 			if _, exists := currentInstancesMap[name]; exists {
 				delete(currentInstancesMap, name)
 				changed = true
-				log.Printf("[Instances] Removing %s.\n", name)
+				logger.Info("Removing instance")
 			}
 		}
 		return
 	}
 
 	currentInstances = make(chan map[string]*Instance, 10)
-	go func() {
+	updates := this.instanceUpdates(ctx, wg)
+	goTracked(wg, func() {
 		defer close(currentInstances)
-		for update := range instanceUpdates(client, stop) {
-			// Mutate the current instances collection and publish it.
+		for update := range updates {
+			// Mutate the current instances collection and publish a copy of it, which consumers may read concurrently.
 			newCurrentInstances, changed := updated(update)
 			if changed {
-				currentInstances <- newCurrentInstances
+				this.state.setInstances(newCurrentInstances)
+				published := make(map[string]*Instance, len(newCurrentInstances))
+				for name, instance := range newCurrentInstances {
+					published[name] = instance
+				}
+				currentInstances <- published
 			}
 		}
 
-		log.Printf("[Instances] Exiting.\n")
-	}()
+		instancesLog.Info("Exiting")
+	})
 
 	return
 }
 
-func getAllInstances(client *etcd.Client, instances chan *InstanceUpdate) {
-	log.Printf("[Instances] Pulling all instances.\n")
-	response, err := client.Get("instances", false, true)
+func (this *Agent) getAllInstances(instances chan *InstanceUpdate) {
+	instancesLog.Debug("Pulling all instances")
+	nodes, err := this.store.List("instances")
 	if err != nil {
-		log.Printf("[Instances] Unable to get instances directory: %s.\n", err)
+		instancesLog.Error("Unable to get instances", "error", err)
 		return
 	}
 
-	for _, n := range response.Node.Nodes {
-		for _, node := range n.Nodes {
-			r, err := client.Get(node.Key, false, true)
-			if err != nil {
-				log.Printf("[Instances] Unable to get instance: %s.\n", err)
-				continue
-			}
-			for _, iNode := range r.Node.Nodes {
-				instance, err := parseInstance(&iNode)
-				if err != nil {
-					log.Printf("[Instances] Unable to parse instance: %s.\n", err)
-					continue
-				}
+	for _, node := range nodes {
+		instance, err := parseInstance(node)
+		if err != nil {
+			instancesLog.Warn("Unable to parse instance", "key", node.Key, "error", err)
+			continue
+		}
 
-				instanceUpdate := new(InstanceUpdate)
-				instanceUpdate.Operation = Add
-				instanceUpdate.Instance = instance
-				instances <- instanceUpdate
-			}
+		instanceUpdate := new(InstanceUpdate)
+		instanceUpdate.Operation = Add
+		instanceUpdate.Instance = instance
+		instances <- instanceUpdate
+	}
 
-			// Notify any since interested party that an update occurred.
-			select {
-			case Instances.Updated <- true:
-			default:
-			}
-		}
+	// Notify any since interested party that an update occurred.
+	select {
+	case this.instances.Updated <- true:
+	default:
 	}
-	log.Printf("[Instances] Pulled instances.\n")
+	instancesLog.Debug("Pulled instances")
 }
 
 // Returns a channel of all instance updates.
-func instanceUpdates(client *etcd.Client, stop chan bool) (updates chan *InstanceUpdate) {
+func (this *Agent) instanceUpdates(ctx context.Context, wg *sync.WaitGroup) (updates chan *InstanceUpdate) {
 	updates = make(chan *InstanceUpdate)
-
-	go func() {
-		getAllInstances(client, updates)
-		incomingUpdates := make(chan *etcd.Response)
-		go func() {
-			for {
-				select {
-				case <-stop:
-					break
-				default:
-				}
-				client.Watch("instances", 0, true, incomingUpdates, stop)
-			}
-		}()
+	done := this.instances.start()
+	incomingUpdates := this.watchPrefix(ctx, "instances", wg)
+
+	goTracked(wg, func() {
+		// Heartbeats and flatlines are no longer accepted once the updates stop.
+		defer close(done)
+		defer close(updates)
+		this.getAllInstances(updates)
 		fullSync := time.NewTicker(FullInstanceSyncInterval * time.Second)
+		defer fullSync.Stop()
 		for {
 			select {
-			case <-stop:
-				break
+			case <-ctx.Done():
+				return
 			case <-fullSync.C:
-				getAllInstances(client, updates)
+				this.getAllInstances(updates)
 			case incomingUpdate := <-incomingUpdates:
 				instance, err := parseInstanceUpdate(incomingUpdate)
 				if err != nil {
-					log.Printf("[Instances] Unable to parse instance update: %s.\n", err)
+					instancesLog.Warn("Unable to parse instance update", "error", err)
 				} else {
+					if incomingUpdate.Action == StoreExpire {
+						journalExpiry(this.store, instance.Instance, incomingUpdate.Node.Index)
+					}
 					updates <- instance
 				}
-			case instance := <-Instances.Heartbeats:
+			case instance := <-this.instances.Heartbeats:
 				update := new(InstanceUpdate)
 				update.Instance = instance
 				update.Operation = Heartbeat
 				updates <- update
-			case instance := <-Instances.Flatlines:
+			case instance := <-this.instances.Flatlines:
 				update := new(InstanceUpdate)
 				update.Instance = instance
 				update.Operation = Flatline
 				updates <- update
 			}
 		}
-	}()
+	})
 	return
 }
 
-func parseActionToOperation(action string) (operation Operation, err error) {
+func parseActionToOperation(action StoreAction) (operation Operation, err error) {
 	switch action {
-	case "set":
-		fallthrough
-	case "update":
-		fallthrough
-	case "create":
-		fallthrough
-	case "compareAndSwap":
+	case StoreSet:
 		operation = Add
-	case "delete":
+	case StoreDelete:
 		fallthrough
-	case "expire":
+	case StoreExpire:
 		operation = Remove
 	default:
-		err = errors.New("Invalid action: " + action)
+		err = errors.New("Invalid action: " + string(action))
 	}
 	return
 }
-func parseInstance(node *etcd.Node) (instance *Instance, err error) {
+func parseInstance(node *StoreNode) (instance *Instance, err error) {
 	if node == nil {
 		err = goerrors.New("Instance status node missing or node key missing")
 		return
 	}
 
 	keyParts := strings.Split(node.Key, "/")
-	if len(keyParts) < 5 {
+	if len(keyParts) < 4 {
 		err = goerrors.New("Instance status node key invalid: " + node.Key)
 		return
 	}
 
-	keyParts = keyParts[2:]
+	keyParts = keyParts[1:]
 	instance = new(Instance)
 
 	instance.Group = keyParts[0]
@@ -383,22 +585,17 @@ func parseInstance(node *etcd.Node) (instance *Instance, err error) {
 		return
 	}
 
-	// Do not attempt to parse value if it is not present.
-	if len(node.Value) > 0 {
-		err = json.Unmarshal([]byte(node.Value), instance)
-		if err != nil {
-			return
-		}
-	} else {
-		// This is a lock node.
-		err = errors.New("Attempted to parse lock node")
+	if len(node.Value) == 0 {
+		err = goerrors.New("Instance status node empty: " + node.Key)
 		instance = nil
+		return
 	}
+	err = json.Unmarshal([]byte(node.Value), instance)
 	return
 }
 
 // Parses an instance from an update response and returns the instance.
-func parseInstanceUpdate(update *etcd.Response) (instanceUpdate *InstanceUpdate, err error) {
+func parseInstanceUpdate(update *StoreEvent) (instanceUpdate *InstanceUpdate, err error) {
 	instanceUpdate = new(InstanceUpdate)
 
 	instanceUpdate.Operation, err = parseActionToOperation(update.Action)
@@ -406,7 +603,12 @@ func parseInstanceUpdate(update *etcd.Response) (instanceUpdate *InstanceUpdate,
 		return
 	}
 
-	instance, err := parseInstance(update.Node)
+	node := update.Node
+	if instanceUpdate.Operation == Remove && update.PrevNode != nil && len(update.PrevNode.Value) > 0 {
+		// Removals carry the removed record in the previous node.
+		node = update.PrevNode
+	}
+	instance, err := parseInstance(node)
 
 	if err != nil {
 		instanceUpdate = nil
@@ -0,0 +1,39 @@
+package daprdockr
+
+import (
+	"testing"
+)
+
+func TestParseInstanceQualifiedName(t *testing.T) {
+	tests := []struct {
+		name     string
+		group    string
+		service  string
+		instance int
+		valid    bool
+	}{
+		{name: "1.api.web", group: "web", service: "api", instance: 1, valid: true},
+		{name: "1.api.web.", group: "web", service: "api", instance: 1, valid: true},
+		{name: "1.api.web.svc.internal", group: "web", service: "api", instance: 1, valid: true},
+		{name: "1.api.web.svc.internal.", group: "web", service: "api", instance: 1, valid: true},
+		{name: "1.api.web.anything.else"},
+		{name: "1.api.web.internal"},
+		{name: "api.web"},
+		{name: "api.web.svc.internal"},
+		{name: "one.api.web"},
+		{name: "-1.api.web"},
+		{name: "1..web"},
+	}
+	for _, test := range tests {
+		group, service, instance, err := ParseInstanceQualifiedName(test.name, "svc.internal")
+		if !test.valid {
+			if err == nil {
+				t.Errorf("Expected %q to be rejected, got instance %d of %s.%s", test.name, instance, service, group)
+			}
+			continue
+		}
+		if err != nil || group != test.group || service != test.service || instance != test.instance {
+			t.Errorf("Expected %q to be instance %d of %s.%s, got %d of %s.%s, %v", test.name, test.instance, test.service, test.group, instance, service, group, err)
+		}
+	}
+}
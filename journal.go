@@ -0,0 +1,181 @@
+// Journal of cluster events, stored in etcd.
+package daprdockr
+
+import (
+	"encoding/json"
+	goerrors "errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	JournalTimeToLive = 24 * 60 * 60 // Seconds
+)
+
+var journalLog = NewLogger("Journal")
+
+type EventType string
+
+const (
+	InstanceStarted         EventType = "InstanceStarted"         // The runner started an instance.
+	InstanceStartFailed     EventType = "InstanceStartFailed"     // The runner failed to start an instance.
+	InstanceRemoved         EventType = "InstanceRemoved"         // The runner removed an instance.
+	InstanceRemovalRequired EventType = "InstanceRemovalRequired" // The work finder determined that an instance must be removed.
+	ContainerExited         EventType = "ContainerExited"         // The watcher found that a container exited on its own.
+	InstanceExpired         EventType = "InstanceExpired"         // An instance record expired because heartbeats stopped.
+	InstanceCrashLooping    EventType = "InstanceCrashLooping"    // An instance failed repeatedly and is being backed off.
+	InstanceDuplicate       EventType = "InstanceDuplicate"       // An agent stopped its container because another node owns the instance.
+)
+
+type Event struct {
+	Type     EventType
+	Group    string
+	Service  string
+	Instance int
+	Reason   string
+	Node     string // The node on which the event occurred.
+	Time     time.Time
+}
+
+func (this *Event) String() string {
+	id := &ServiceIdentifier{Name: this.Service, Group: this.Group}
+	return this.Time.Format(time.RFC3339) + " " + string(this.Type) + " " + id.InstanceQualifiedName(this.Instance) + "@" + this.Node + ": " + this.Reason
+}
+
+func journalPath(group, service string, instance int) string {
+	return "journal/" + group + "/" + service + "/" + strconv.Itoa(instance)
+}
+
+// Creates an event concerning an instance on the provided node.
+func newInstanceEvent(node string, eventType EventType, group, service string, instance int, reason string) *Event {
+	return &Event{
+		Type:     eventType,
+		Group:    group,
+		Service:  service,
+		Instance: instance,
+		Reason:   reason,
+		Node:     node,
+		Time:     time.Now().UTC(),
+	}
+}
+
+// Appends an event to the journal.
+func AppendEvent(store Store, event *Event) (err error) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	key := journalPath(event.Group, event.Service, event.Instance) + "/" + fmt.Sprintf("%020d", event.Time.UnixNano())
+	_, err = store.Set(key, string(payload), JournalTimeToLive)
+	return
+}
+
+// Appends an event to the journal unless an event with the same identifier was already appended for the instance.
+// This allows all agents to report an event which they all observe without duplicating it.
+func appendUniqueEvent(store Store, event *Event, id string) (err error) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	key := journalPath(event.Group, event.Service, event.Instance) + "/" + id
+	_, err = store.Create(key, string(payload), JournalTimeToLive)
+	if isStoreError(err, StoreNodeExists) {
+		err = nil
+	}
+	return
+}
+
+// Appends an event to the journal, logging any failure.
+func journal(store Store, event *Event) {
+	if err := AppendEvent(store, event); err != nil {
+		journalLog.WithInstance(event.Group, event.Service, event.Instance).Warn("Failed to append event", "type", event.Type, "error", err)
+	}
+}
+
+// Records the expiry of an instance record, which occurs when its agent stops sending heartbeats.
+// Every agent observes the expiry, so the store index of the expiry identifies the event.
+func journalExpiry(store Store, instance *Instance, index uint64) {
+	// The owner identifies the node which stopped sending heartbeats. Older records only carry addresses.
+	node := instance.Owner
+	if len(node) == 0 {
+		if host, _, err := net.SplitHostPort(instance.Agent); err == nil {
+			node = host
+		} else if len(instance.Addrs) > 0 {
+			node = instance.Addrs[0]
+		}
+	}
+	event := &Event{
+		Type:     InstanceExpired,
+		Group:    instance.Group,
+		Service:  instance.Service,
+		Instance: instance.Instance,
+		Reason:   "Heartbeats stopped",
+		Node:     node,
+		Time:     time.Now().UTC(),
+	}
+	if err := appendUniqueEvent(store, event, "expired-"+strconv.FormatUint(index, 10)); err != nil {
+		journalLog.WithInstance(event.Group, event.Service, event.Instance).Warn("Failed to append event", "type", event.Type, "error", err)
+	}
+}
+
+// Gets the events of a service, or of a single instance if instance is not negative, ordered by time.
+func GetEvents(store Store, group, service string, instance int) (events []*Event, err error) {
+	key := "journal/" + group + "/" + service
+	if instance >= 0 {
+		key = journalPath(group, service, instance)
+	}
+	nodes, err := store.List(key)
+	if err != nil {
+		return
+	}
+
+	events = make([]*Event, 0, len(nodes))
+	for _, node := range nodes {
+		event, err := parseEvent(node)
+		if err != nil {
+			journalLog.Warn("Unable to parse event", "key", node.Key, "error", err)
+			continue
+		}
+		events = append(events, event)
+	}
+
+	sort.Sort(eventsByTime(events))
+	return
+}
+
+func parseEvent(node *StoreNode) (event *Event, err error) {
+	if node == nil || len(node.Value) == 0 {
+		err = goerrors.New("Event node missing or empty")
+		return
+	}
+	event = new(Event)
+	err = json.Unmarshal([]byte(node.Value), event)
+	return
+}
+
+// Parses a service or instance name for querying the journal.
+// The name is in the form "<service>.<group>" or "<instance>.<service>.<group>", optionally followed by the provided
+// zone. Instance numbers are numeric, which distinguishes instance names from service names. Instance is -1 for services.
+func ParseJournalQuery(name, zone string) (group, service string, instance int, err error) {
+	parts := strings.Split(trimZone(name, zone), ".")
+	_, numbered := strconv.Atoi(parts[0])
+	switch {
+	case len(parts) == 3 && numbered == nil:
+		group, service, instance, err = ParseInstanceQualifiedName(name, zone)
+	case len(parts) == 2 && len(parts[0]) > 0 && len(parts[1]) > 0:
+		service, group, instance = parts[0], parts[1], -1
+	default:
+		err = goerrors.New("Expected <service>.<group> or <instance>.<service>.<group>: " + name)
+	}
+	return
+}
+
+type eventsByTime []*Event
+
+func (this eventsByTime) Len() int           { return len(this) }
+func (this eventsByTime) Less(i, j int) bool { return this[i].Time.Before(this[j].Time) }
+func (this eventsByTime) Swap(i, j int)      { this[i], this[j] = this[j], this[i] }
@@ -0,0 +1,34 @@
+package daprdockr
+
+import (
+	"testing"
+)
+
+func TestParseJournalQuery(t *testing.T) {
+	tests := []struct {
+		name     string
+		group    string
+		service  string
+		instance int
+		valid    bool
+	}{
+		{name: "api.web", group: "web", service: "api", instance: -1, valid: true},
+		{name: "api.web.container.", group: "web", service: "api", instance: -1, valid: true},
+		{name: "2.api.web.container", group: "web", service: "api", instance: 2, valid: true},
+		{name: "api.web.other"},
+		{name: "2.api.web.other"},
+		{name: "web"},
+	}
+	for _, test := range tests {
+		group, service, instance, err := ParseJournalQuery(test.name, DefaultZone)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("Expected %q to be rejected, got instance %d of %s.%s", test.name, instance, service, group)
+			}
+			continue
+		}
+		if err != nil || group != test.group || service != test.service || instance != test.instance {
+			t.Errorf("Expected %q to be instance %d of %s.%s, got %d of %s.%s, %v", test.name, test.instance, test.service, test.group, instance, service, group, err)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+// Lifecycle of long-running components.
+package daprdockr
+
+import (
+	"context"
+	"sync"
+)
+
+// A long-running part of the agent. Components run until the context is cancelled or they fail, and return only
+// once all of their goroutines have exited. A nil result means that the component stopped because it was cancelled.
+type Component func(ctx context.Context) error
+
+// Runs the components until the context is cancelled or any component fails, in which case the others are cancelled.
+// Returns once every component has returned, with the error of the first component which failed.
+func RunComponents(ctx context.Context, components ...Component) (err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var once sync.Once
+	var wg sync.WaitGroup
+	for _, component := range components {
+		component := component
+		goTracked(&wg, func() {
+			if componentErr := component(ctx); componentErr != nil {
+				once.Do(func() {
+					err = componentErr
+					cancel()
+				})
+			}
+		})
+	}
+	wg.Wait()
+	return
+}
+
+// Runs the function in a goroutine which the wait group waits for.
+func goTracked(wg *sync.WaitGroup, f func()) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		f()
+	}()
+}
+
+// Returns a channel which is closed once the context is done, for APIs which take a stop channel.
+func stopChannel(ctx context.Context, wg *sync.WaitGroup) chan bool {
+	stop := make(chan bool)
+	goTracked(wg, func() {
+		<-ctx.Done()
+		close(stop)
+	})
+	return stop
+}
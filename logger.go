@@ -0,0 +1,276 @@
+// Levelled, structured logging.
+package daprdockr
+
+import (
+	"bytes"
+	"encoding/json"
+	goerrors "errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type LogLevel int
+
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarn
+	LogError
+)
+
+const (
+	DefaultLogLevel = LogInfo
+	LogFormatText   = "text"
+	LogFormatJson   = "json"
+)
+
+func (level LogLevel) String() (result string) {
+	switch level {
+	case LogDebug:
+		result = "debug"
+	case LogInfo:
+		result = "info"
+	case LogWarn:
+		result = "warn"
+	case LogError:
+		result = "error"
+	}
+	return
+}
+
+func ParseLogLevel(level string) (result LogLevel, err error) {
+	switch strings.ToLower(strings.TrimSpace(level)) {
+	case "debug":
+		result = LogDebug
+	case "info":
+		result = LogInfo
+	case "warn", "warning":
+		result = LogWarn
+	case "error":
+		result = LogError
+	default:
+		err = goerrors.New("Invalid log level: " + level)
+	}
+	return
+}
+
+// Process-wide logging configuration.
+type logConfig struct {
+	lock            sync.RWMutex
+	output          io.Writer
+	format          string
+	defaultLevel    LogLevel
+	componentLevels map[string]LogLevel
+	fields          []interface{} // Fields included in every entry, eg: the node.
+}
+
+var logging = &logConfig{
+	output:          os.Stderr,
+	format:          LogFormatText,
+	defaultLevel:    DefaultLogLevel,
+	componentLevels: make(map[string]LogLevel),
+}
+
+// Sets the destination of all log entries.
+func SetLogOutput(output io.Writer) {
+	logging.lock.Lock()
+	defer logging.lock.Unlock()
+	logging.output = output
+}
+
+// Sets the format of all log entries, either "text" or "json".
+func SetLogFormat(format string) (err error) {
+	if format != LogFormatText && format != LogFormatJson {
+		return goerrors.New("Invalid log format: " + format)
+	}
+	logging.lock.Lock()
+	defer logging.lock.Unlock()
+	logging.format = format
+	return
+}
+
+// Sets log levels from a comma separated list of levels, optionally qualified by component.
+// Example: "info,Instances=debug,DNS=warn".
+func SetLogLevels(spec string) (err error) {
+	defaultLevel := DefaultLogLevel
+	componentLevels := make(map[string]LogLevel)
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if len(part) == 0 {
+			continue
+		}
+		var level LogLevel
+		if eq := strings.Index(part, "="); eq >= 0 {
+			level, err = ParseLogLevel(part[eq+1:])
+			if err != nil {
+				return
+			}
+			componentLevels[strings.ToLower(strings.TrimSpace(part[:eq]))] = level
+		} else {
+			defaultLevel, err = ParseLogLevel(part)
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	logging.lock.Lock()
+	defer logging.lock.Unlock()
+	logging.defaultLevel = defaultLevel
+	logging.componentLevels = componentLevels
+	return
+}
+
+// Sets the node which is included in every log entry.
+func SetLogNode(node string) {
+	logging.lock.Lock()
+	defer logging.lock.Unlock()
+	logging.fields = []interface{}{"node", node}
+}
+
+// Writes log entries for a component, annotated with key-value fields.
+type Logger struct {
+	component string
+	fields    []interface{}
+}
+
+func NewLogger(component string) *Logger {
+	return &Logger{component: component}
+}
+
+// Returns a logger which includes the provided key-value pairs in each entry.
+func (this *Logger) With(keyvals ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(this.fields)+len(keyvals))
+	fields = append(fields, this.fields...)
+	fields = append(fields, keyvals...)
+	return &Logger{component: this.component, fields: fields}
+}
+
+// Returns a logger which includes the identity of the instance in each entry.
+func (this *Logger) WithInstance(group, service string, instance int) *Logger {
+	return this.With("group", group, "service", service, "instance", instance)
+}
+
+func (this *Logger) Debug(message string, keyvals ...interface{}) {
+	this.log(LogDebug, message, keyvals)
+}
+
+func (this *Logger) Info(message string, keyvals ...interface{}) {
+	this.log(LogInfo, message, keyvals)
+}
+
+func (this *Logger) Warn(message string, keyvals ...interface{}) {
+	this.log(LogWarn, message, keyvals)
+}
+
+func (this *Logger) Error(message string, keyvals ...interface{}) {
+	this.log(LogError, message, keyvals)
+}
+
+// Determines whether entries at the provided level are written.
+func (this *Logger) Enabled(level LogLevel) bool {
+	logging.lock.RLock()
+	defer logging.lock.RUnlock()
+	minimum, exists := logging.componentLevels[strings.ToLower(this.component)]
+	if !exists {
+		minimum = logging.defaultLevel
+	}
+	return level >= minimum
+}
+
+func (this *Logger) log(level LogLevel, message string, keyvals []interface{}) {
+	if !this.Enabled(level) {
+		return
+	}
+
+	logging.lock.RLock()
+	output, format, globalFields := logging.output, logging.format, logging.fields
+	logging.lock.RUnlock()
+
+	fields := make([]interface{}, 0, len(globalFields)+len(this.fields)+len(keyvals))
+	fields = append(fields, globalFields...)
+	fields = append(fields, this.fields...)
+	fields = append(fields, keyvals...)
+
+	var entry []byte
+	now := time.Now().UTC()
+	if format == LogFormatJson {
+		entry = formatJsonLogEntry(now, level, this.component, message, fields)
+	} else {
+		entry = formatTextLogEntry(now, level, this.component, message, fields)
+	}
+
+	logging.lock.Lock()
+	defer logging.lock.Unlock()
+	output.Write(entry)
+}
+
+func formatTextLogEntry(now time.Time, level LogLevel, component, message string, fields []interface{}) []byte {
+	buffer := new(bytes.Buffer)
+	fmt.Fprintf(buffer, "%s %-5s [%s] %s", now.Format(time.RFC3339), strings.ToUpper(level.String()), component, message)
+	for i := 0; i < len(fields); i += 2 {
+		key, value := logField(fields, i)
+		text := formatLogValue(value)
+		if len(text) == 0 || strings.ContainsAny(text, " \t\n\"=") {
+			text = strconv.Quote(text)
+		}
+		fmt.Fprintf(buffer, " %s=%s", key, text)
+	}
+	buffer.WriteByte('\n')
+	return buffer.Bytes()
+}
+
+func formatJsonLogEntry(now time.Time, level LogLevel, component, message string, fields []interface{}) []byte {
+	entry := make(map[string]interface{}, len(fields)/2+4)
+	for i := 0; i < len(fields); i += 2 {
+		key, value := logField(fields, i)
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		entry[key] = value
+	}
+	entry["time"] = now.Format(time.RFC3339Nano)
+	entry["level"] = level.String()
+	entry["component"] = component
+	entry["msg"] = message
+
+	payload, err := json.Marshal(entry)
+	if err != nil {
+		// Fall back to formatting each value as a string.
+		for key, value := range entry {
+			entry[key] = formatLogValue(value)
+		}
+		payload, _ = json.Marshal(entry)
+	}
+	return append(payload, '\n')
+}
+
+// Returns the key and value at the provided position in a key-value list.
+func logField(fields []interface{}, i int) (key string, value interface{}) {
+	key = fmt.Sprint(fields[i])
+	if i+1 < len(fields) {
+		value = fields[i+1]
+	} else {
+		value = "(missing)"
+	}
+	return
+}
+
+func formatLogValue(value interface{}) string {
+	switch value := value.(type) {
+	case string:
+		return value
+	case error:
+		return value.Error()
+	case fmt.Stringer:
+		return value.String()
+	case []string:
+		return strings.Join(value, ",")
+	}
+	return fmt.Sprint(value)
+}
@@ -0,0 +1,236 @@
+// Store held in memory, for running agents without etcd, such as a whole cluster within a single test process.
+package daprdockr
+
+import (
+	goerrors "errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	memoryStoreWatchBuffer = 256 // Events which may be pending for a watcher before it is dropped.
+)
+
+type memoryStoreEntry struct {
+	node   StoreNode
+	expiry *time.Timer
+}
+
+type memoryStoreWatcher struct {
+	prefix  string
+	events  chan *StoreEvent
+	dropped chan bool // Closed if the watcher fell behind and was removed.
+}
+
+// A store which holds values in memory. Values expire after their time to live, as in etcd.
+// Watchers which fall behind are dropped, so their watch fails and must be re-established.
+type MemoryStore struct {
+	lock     sync.Mutex
+	index    uint64
+	entries  map[string]*memoryStoreEntry
+	watchers map[*memoryStoreWatcher]bool
+}
+
+// Creates an empty store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		entries:  make(map[string]*memoryStoreEntry),
+		watchers: make(map[*memoryStoreWatcher]bool),
+	}
+}
+
+func (this *MemoryStore) Get(key string) (node *StoreNode, err error) {
+	key = memoryStoreKey(key)
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	entry, exists := this.entries[key]
+	if !exists {
+		return nil, &StoreError{Code: StoreKeyNotFound, Key: key, Message: "Key not found"}
+	}
+	copied := entry.node
+	return &copied, nil
+}
+
+func (this *MemoryStore) List(prefix string) (nodes []*StoreNode, err error) {
+	prefix = memoryStoreKey(prefix)
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	nodes = make([]*StoreNode, 0)
+	for key, entry := range this.entries {
+		if keyHasPrefix(key, prefix) {
+			copied := entry.node
+			nodes = append(nodes, &copied)
+		}
+	}
+	sort.Sort(storeNodesByKey(nodes))
+	return
+}
+
+func (this *MemoryStore) Set(key, value string, ttl uint64) (index uint64, err error) {
+	key = memoryStoreKey(key)
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.put(key, value, ttl), nil
+}
+
+func (this *MemoryStore) Create(key, value string, ttl uint64) (index uint64, err error) {
+	key = memoryStoreKey(key)
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if _, exists := this.entries[key]; exists {
+		return 0, &StoreError{Code: StoreNodeExists, Key: key, Message: "Key already exists"}
+	}
+	return this.put(key, value, ttl), nil
+}
+
+func (this *MemoryStore) CompareAndSwap(key, value string, ttl uint64, prevIndex uint64) (index uint64, err error) {
+	key = memoryStoreKey(key)
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if err = this.compare(key, prevIndex); err != nil {
+		return
+	}
+	return this.put(key, value, ttl), nil
+}
+
+func (this *MemoryStore) CompareAndDelete(key string, prevIndex uint64) (err error) {
+	key = memoryStoreKey(key)
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if err = this.compare(key, prevIndex); err != nil {
+		return
+	}
+	this.remove(key, StoreDelete)
+	return
+}
+
+func (this *MemoryStore) Delete(key string) (err error) {
+	key = memoryStoreKey(key)
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if _, exists := this.entries[key]; !exists {
+		return &StoreError{Code: StoreKeyNotFound, Key: key, Message: "Key not found"}
+	}
+	this.remove(key, StoreDelete)
+	return
+}
+
+func (this *MemoryStore) Watch(prefix string, receiver chan *StoreEvent, stop chan bool) (err error) {
+	watcher := &memoryStoreWatcher{
+		prefix:  memoryStoreKey(prefix),
+		events:  make(chan *StoreEvent, memoryStoreWatchBuffer),
+		dropped: make(chan bool),
+	}
+	this.lock.Lock()
+	this.watchers[watcher] = true
+	this.lock.Unlock()
+	defer func() {
+		this.lock.Lock()
+		delete(this.watchers, watcher)
+		this.lock.Unlock()
+	}()
+
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-watcher.dropped:
+			return goerrors.New("Watcher fell behind: " + watcher.prefix)
+		case event := <-watcher.events:
+			select {
+			case receiver <- event:
+			case <-stop:
+				return nil
+			}
+		}
+	}
+}
+
+// Fails unless the key exists and was last modified at the provided index. Must be called with the lock held.
+func (this *MemoryStore) compare(key string, prevIndex uint64) (err error) {
+	entry, exists := this.entries[key]
+	if !exists {
+		return &StoreError{Code: StoreKeyNotFound, Key: key, Message: "Key not found"}
+	}
+	if entry.node.Index != prevIndex {
+		return &StoreError{Code: StoreTestFailed, Key: key, Message: "Compare failed"}
+	}
+	return
+}
+
+// Stores a value and notifies watchers. Must be called with the lock held.
+func (this *MemoryStore) put(key, value string, ttl uint64) (index uint64) {
+	this.index++
+	index = this.index
+	var prev *StoreNode
+	if existing, exists := this.entries[key]; exists {
+		if existing.expiry != nil {
+			existing.expiry.Stop()
+		}
+		copied := existing.node
+		prev = &copied
+	}
+
+	entry := &memoryStoreEntry{node: StoreNode{Key: key, Value: value, Index: index}}
+	if ttl > 0 {
+		entry.expiry = time.AfterFunc(time.Duration(ttl)*time.Second, func() { this.expire(key, index) })
+	}
+	this.entries[key] = entry
+
+	node := entry.node
+	this.notify(&StoreEvent{Action: StoreSet, Node: &node, PrevNode: prev})
+	return
+}
+
+// Removes a value whose time to live elapsed, unless it was modified since.
+func (this *MemoryStore) expire(key string, index uint64) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if entry, exists := this.entries[key]; exists && entry.node.Index == index {
+		this.remove(key, StoreExpire)
+	}
+}
+
+// Removes a value and notifies watchers. Must be called with the lock held.
+func (this *MemoryStore) remove(key string, action StoreAction) {
+	entry := this.entries[key]
+	if entry.expiry != nil {
+		entry.expiry.Stop()
+	}
+	delete(this.entries, key)
+	this.index++
+	prev := entry.node
+	this.notify(&StoreEvent{Action: action, Node: &StoreNode{Key: key, Index: this.index}, PrevNode: &prev})
+}
+
+// Queues an event for each watcher of the key, dropping watchers which fell behind. Must be called with the lock held.
+func (this *MemoryStore) notify(event *StoreEvent) {
+	for watcher := range this.watchers {
+		if !keyHasPrefix(event.Node.Key, watcher.prefix) {
+			continue
+		}
+		select {
+		case watcher.events <- event:
+		default:
+			delete(this.watchers, watcher)
+			close(watcher.dropped)
+		}
+	}
+}
+
+func memoryStoreKey(key string) string {
+	return strings.Trim(key, "/")
+}
+
+// Determines whether the key is the prefix or lies beneath it.
+func keyHasPrefix(key, prefix string) bool {
+	return len(prefix) == 0 || key == prefix || strings.HasPrefix(key, prefix+"/")
+}
+
+type storeNodesByKey []*StoreNode
+
+func (this storeNodesByKey) Len() int           { return len(this) }
+func (this storeNodesByKey) Less(i, j int) bool { return this[i].Key < this[j].Key }
+func (this storeNodesByKey) Swap(i, j int)      { this[i], this[j] = this[j], this[i] }
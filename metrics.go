@@ -0,0 +1,272 @@
+// Metrics exposed in the Prometheus text format.
+package daprdockr
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	MetricsPath = "/metrics"
+)
+
+// The metrics of an agent. Each agent has its own, so that agents in one process are counted separately.
+type agentMetrics struct {
+	metricRegistry
+	containerStarts            *CounterVec
+	containerStartFailures     *CounterVec
+	containerStartDuration     *HistogramVec
+	containerRemovals          *CounterVec
+	instanceLockConflicts      *CounterVec
+	instanceOwnershipConflicts *CounterVec
+	heartbeatWriteErrors       *CounterVec
+	dnsQueries                 *CounterVec
+	dnsQueryDuration           *HistogramVec
+	nginxReloads               *CounterVec
+	nginxCrashes               *CounterVec
+	etcdWatchReconnects        *CounterVec
+}
+
+func newAgentMetrics() (metrics *agentMetrics) {
+	metrics = &agentMetrics{}
+	metrics.containerStarts = metrics.newCounterVec("daprdockr_container_starts_total",
+		"Containers started by the runner.", "service", "group")
+	metrics.containerStartFailures = metrics.newCounterVec("daprdockr_container_start_failures_total",
+		"Containers which the runner failed to start.", "service", "group")
+	metrics.containerStartDuration = metrics.newHistogramVec("daprdockr_container_start_duration_seconds",
+		"Time taken to start containers, including failed attempts.",
+		[]float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}, "service", "group")
+	metrics.containerRemovals = metrics.newCounterVec("daprdockr_container_removals_total",
+		"Containers removed by the runner.", "service", "group")
+	metrics.instanceLockConflicts = metrics.newCounterVec("daprdockr_instance_lock_conflicts_total",
+		"Attempts to lock an instance which was already locked by another agent.", "service", "group")
+	metrics.instanceOwnershipConflicts = metrics.newCounterVec("daprdockr_instance_ownership_conflicts_total",
+		"Heartbeats rejected because another node owns the instance record.", "service", "group")
+	metrics.heartbeatWriteErrors = metrics.newCounterVec("daprdockr_heartbeat_write_errors_total",
+		"Failures to write instance heartbeats to the store.", "service", "group")
+	metrics.dnsQueries = metrics.newCounterVec("daprdockr_dns_queries_total",
+		"DNS questions answered, by handler, query type and result.", "handler", "type", "result")
+	metrics.dnsQueryDuration = metrics.newHistogramVec("daprdockr_dns_query_duration_seconds",
+		"Time taken to answer DNS requests, by handler.",
+		[]float64{0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}, "handler")
+	metrics.nginxReloads = metrics.newCounterVec("daprdockr_nginx_reloads_total",
+		"Nginx configuration reloads.")
+	metrics.nginxCrashes = metrics.newCounterVec("daprdockr_nginx_crashes_total",
+		"Nginx process exits.")
+	metrics.etcdWatchReconnects = metrics.newCounterVec("daprdockr_etcd_watch_reconnects_total",
+		"Watches on the store which had to be re-established, by key prefix.", "prefix")
+	return
+}
+
+// A set of metrics, in registration order.
+type metricRegistry struct {
+	metrics []metric
+}
+
+type metric interface {
+	write(writer io.Writer)
+}
+
+// Writes all metrics in the Prometheus text exposition format.
+func (this *metricRegistry) write(writer io.Writer) {
+	for _, m := range this.metrics {
+		m.write(writer)
+	}
+}
+
+// Writes the agent's metrics in the Prometheus text exposition format.
+func (this *Agent) WriteMetrics(writer io.Writer) {
+	this.metrics.write(writer)
+}
+
+func (this *Agent) serveMetrics(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	this.WriteMetrics(writer)
+}
+
+// Records the time since the provided start time in the histogram.
+func observeSince(histogram *HistogramVec, start time.Time, labelValues ...string) {
+	histogram.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+type metricDescription struct {
+	name   string
+	help   string
+	labels []string
+}
+
+func (this *metricDescription) writeHeader(writer io.Writer, kind string) {
+	fmt.Fprintf(writer, "# HELP %s %s\n# TYPE %s %s\n", this.name, this.help, this.name, kind)
+}
+
+// Formats a label set, including any extra trailing label.
+func (this *metricDescription) formatLabels(values []string, extraName, extraValue string) string {
+	pairs := make([]string, 0, len(values)+1)
+	for i, value := range values {
+		pairs = append(pairs, this.labels[i]+"=\""+escapeLabelValue(value)+"\"")
+	}
+	if len(extraName) > 0 {
+		pairs = append(pairs, extraName+"=\""+escapeLabelValue(extraValue)+"\"")
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (this *metricDescription) key(values []string) string {
+	if len(values) != len(this.labels) {
+		panic("metric " + this.name + " expects " + strconv.Itoa(len(this.labels)) + " label values")
+	}
+	return strings.Join(values, "\xff")
+}
+
+func escapeLabelValue(value string) string {
+	value = strings.Replace(value, "\\", "\\\\", -1)
+	value = strings.Replace(value, "\"", "\\\"", -1)
+	return strings.Replace(value, "\n", "\\n", -1)
+}
+
+func formatFloat(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// A set of counters partitioned by label values.
+type CounterVec struct {
+	metricDescription
+	lock   sync.Mutex
+	values map[string]*counterValue
+}
+
+type counterValue struct {
+	labels []string
+	value  float64
+}
+
+// Creates and registers a counter.
+func (this *metricRegistry) newCounterVec(name, help string, labels ...string) *CounterVec {
+	counter := &CounterVec{
+		metricDescription: metricDescription{name: name, help: help, labels: labels},
+		values:            make(map[string]*counterValue),
+	}
+	// A counter without labels has a single value, which is reported as zero until it is first incremented.
+	if len(labels) == 0 {
+		counter.values[""] = &counterValue{}
+	}
+	this.metrics = append(this.metrics, counter)
+	return counter
+}
+
+// Increments the counter with the provided label values.
+func (this *CounterVec) Inc(labelValues ...string) {
+	this.Add(1, labelValues...)
+}
+
+// Adds to the counter with the provided label values.
+func (this *CounterVec) Add(delta float64, labelValues ...string) {
+	key := this.key(labelValues)
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	value, exists := this.values[key]
+	if !exists {
+		value = &counterValue{labels: append([]string(nil), labelValues...)}
+		this.values[key] = value
+	}
+	value.value += delta
+}
+
+func (this *CounterVec) write(writer io.Writer) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.writeHeader(writer, "counter")
+	keys := make([]string, 0, len(this.values))
+	for key := range this.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := this.values[key]
+		fmt.Fprintf(writer, "%s%s %s\n", this.name, this.formatLabels(value.labels, "", ""), formatFloat(value.value))
+	}
+}
+
+// A set of histograms partitioned by label values.
+type HistogramVec struct {
+	metricDescription
+	buckets []float64
+	lock    sync.Mutex
+	values  map[string]*histogramValue
+}
+
+type histogramValue struct {
+	labels []string
+	counts []uint64 // Non-cumulative count per bucket.
+	sum    float64
+	count  uint64
+}
+
+// Creates and registers a histogram.
+func (this *metricRegistry) newHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	histogram := &HistogramVec{
+		metricDescription: metricDescription{name: name, help: help, labels: labels},
+		buckets:           buckets,
+		values:            make(map[string]*histogramValue),
+	}
+	if len(labels) == 0 {
+		histogram.values[""] = &histogramValue{counts: make([]uint64, len(buckets))}
+	}
+	this.metrics = append(this.metrics, histogram)
+	return histogram
+}
+
+// Records an observation in the histogram with the provided label values.
+func (this *HistogramVec) Observe(observation float64, labelValues ...string) {
+	key := this.key(labelValues)
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	value, exists := this.values[key]
+	if !exists {
+		value = &histogramValue{labels: append([]string(nil), labelValues...), counts: make([]uint64, len(this.buckets))}
+		this.values[key] = value
+	}
+	for i, upperBound := range this.buckets {
+		if observation <= upperBound {
+			value.counts[i]++
+			break
+		}
+	}
+	value.sum += observation
+	value.count++
+}
+
+func (this *HistogramVec) write(writer io.Writer) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.writeHeader(writer, "histogram")
+	keys := make([]string, 0, len(this.values))
+	for key := range this.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := this.values[key]
+		var cumulative uint64
+		for i, upperBound := range this.buckets {
+			cumulative += value.counts[i]
+			fmt.Fprintf(writer, "%s_bucket%s %d\n", this.name, this.formatLabels(value.labels, "le", formatFloat(upperBound)), cumulative)
+		}
+		fmt.Fprintf(writer, "%s_bucket%s %d\n", this.name, this.formatLabels(value.labels, "le", "+Inf"), value.count)
+		fmt.Fprintf(writer, "%s_sum%s %s\n", this.name, this.formatLabels(value.labels, "", ""), formatFloat(value.sum))
+		fmt.Fprintf(writer, "%s_count%s %d\n", this.name, this.formatLabels(value.labels, "", ""), value.count)
+	}
+}
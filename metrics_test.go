@@ -0,0 +1,54 @@
+package daprdockr
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+func newTestMetricsAgent(t *testing.T) *Agent {
+	agent, err := NewAgent(AgentOptions{Store: NewMemoryStore(), Runtime: NewFakeRuntime(), HostIp: net.ParseIP("10.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return agent
+}
+
+// Metrics without labels are reported before they are first recorded, so that their rates can be computed from zero.
+func TestUnlabelledMetricsReportZero(t *testing.T) {
+	var output bytes.Buffer
+	newTestMetricsAgent(t).WriteMetrics(&output)
+	for _, sample := range []string{"daprdockr_nginx_reloads_total 0", "daprdockr_nginx_crashes_total 0"} {
+		if !strings.Contains(output.String(), "\n"+sample+"\n") {
+			t.Errorf("Expected the sample %q, got:\n%s", sample, output.String())
+		}
+	}
+
+	var registry metricRegistry
+	histogram := registry.newHistogramVec("daprdockr_test_duration_seconds", "Test.", []float64{1})
+	output.Reset()
+	histogram.write(&output)
+	for _, sample := range []string{`daprdockr_test_duration_seconds_bucket{le="1"} 0`, `daprdockr_test_duration_seconds_bucket{le="+Inf"} 0`, "daprdockr_test_duration_seconds_count 0"} {
+		if !strings.Contains(output.String(), sample+"\n") {
+			t.Errorf("Expected the sample %q, got:\n%s", sample, output.String())
+		}
+	}
+}
+
+// Agents in one process count separately, so that each reports only its own activity.
+func TestAgentsHaveTheirOwnMetrics(t *testing.T) {
+	first, second := newTestMetricsAgent(t), newTestMetricsAgent(t)
+	first.metrics.nginxReloads.Inc()
+
+	var output bytes.Buffer
+	first.WriteMetrics(&output)
+	if !strings.Contains(output.String(), "\ndaprdockr_nginx_reloads_total 1\n") {
+		t.Errorf("Expected the first agent to report its reload, got:\n%s", output.String())
+	}
+	output.Reset()
+	second.WriteMetrics(&output)
+	if !strings.Contains(output.String(), "\ndaprdockr_nginx_reloads_total 0\n") {
+		t.Errorf("Expected the second agent not to report the first agent's reload, got:\n%s", output.String())
+	}
+}
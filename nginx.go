@@ -2,12 +2,11 @@ package daprdockr
 
 import (
 	"bytes"
-	"github.com/coreos/go-etcd/etcd"
+	"context"
 	"io/ioutil"
-	"log"
 	"os"
 	"os/exec"
-	"strings"
+	"sync"
 	"syscall"
 	"text/template"
 	"time"
@@ -42,6 +41,8 @@ http {
 	{{end}}
 }`
 
+var loadBalancerLog = NewLogger("LoadBalancer")
+
 var nginxConfigurationTemplate, nginxConfigurationTemplateErr = template.New("HTTP Load Balancer Configuration").Parse(NginxConfigurationTemplate)
 
 type SiteConfig struct {
@@ -56,100 +57,149 @@ type SiteConfig struct {
 const pidFile = "/tmp/nginx.pid"
 const configFile = "/tmp/nginx.conf"
 
-func StartLoadBalancer(etcdClient *etcd.Client, currentInstances chan map[string]*Instance, stop chan bool, errorChan *chan error) {
+// Runs Nginx as an HTTP load balancer for the configured sites until the context is done.
+func (this *Agent) StartLoadBalancer(ctx context.Context, currentInstances chan map[string]*Instance) (err error) {
+	errorChan := this.errors
 	reload := make(chan bool)
-	defer close(reload)
 	start := make(chan bool, 1)
-	defer close(start)
+	var wg sync.WaitGroup
 
 	// Keep load balancer running.
-	go func() {
+	goTracked(&wg, func() {
 		starting := false
 		var cmd *exec.Cmd
 		for {
 			select {
-			case _, _ = <-stop:
-				break
-			case _, ok := <-start:
-				if !ok {
-					break
-				}
-
+			case <-ctx.Done():
+				// The running process is stopped by runLoadBalancer.
+				return
+			case <-start:
 				// The process is not running, run it.
-				log.Println("[LoadBalancer] Starting.")
+				loadBalancerLog.Info("Starting")
 				exec.Command("nginx", "-g", "pid "+pidFile+";", "-s", "stop").Run()
 				cmd = exec.Command("nginx", "-g", "daemon off; pid "+pidFile+";", "-c", configFile)
 				starting = true
-				go runLoadBalancer(cmd, start, errorChan)
-			case _, ok := <-reload:
-				if !ok {
-					break
-				}
-
+				process := cmd
+				goTracked(&wg, func() { this.runLoadBalancer(ctx, process, start) })
+			case <-reload:
 				// Reload configuration.
-				log.Println("[LoadBalancer] Reloading configuration.")
+				loadBalancerLog.Info("Reloading configuration")
 				if cmd != nil && cmd.Process != nil {
 					starting = false
 					cmd.Process.Signal(syscall.SIGHUP)
+					this.metrics.nginxReloads.Inc()
+					this.state.updateLoadBalancer(func(status *LoadBalancerStatus) {
+						status.LastReload = time.Now()
+					})
 				} else if !starting {
 					start <- true
 				}
 			}
 		}
-	}()
+	})
 
 	// Initially run the load balancer
+update:
 	for {
 		select {
-		case _, _ = <-stop:
-			break
+		case <-ctx.Done():
+			break update
 		case instances, ok := <-currentInstances:
 			if !ok {
-				break
+				break update
 			}
 
-			err := updateLoadBalancerConfig(etcdClient, instances)
+			err := this.updateLoadBalancerConfig(instances)
 			if err != nil && errorChan != nil {
 				*errorChan <- err
 				continue
 			}
-			reload <- true
-
+			select {
+			case reload <- true:
+			case <-ctx.Done():
+				break update
+			}
 		}
 	}
-	log.Println("[LoadBalancer] Stopping.")
+	wg.Wait()
+	loadBalancerLog.Info("Stopped")
+	return
 }
 
-func runLoadBalancer(cmd *exec.Cmd, restart chan bool, errorChan *chan error) {
-	err := cmd.Run()
+func (this *Agent) runLoadBalancer(ctx context.Context, cmd *exec.Cmd, restart chan bool) {
+	errorChan := this.errors
+	err := cmd.Start()
+	if err == nil {
+		this.state.updateLoadBalancer(func(status *LoadBalancerStatus) {
+			status.Running = true
+			status.Pid = cmd.Process.Pid
+			status.Started = time.Now()
+		})
+
+		// Let the process finish serving current requests and exit once the agent stops.
+		exited := make(chan bool)
+		go func() {
+			select {
+			case <-ctx.Done():
+				loadBalancerLog.Info("Stopping process")
+				cmd.Process.Signal(syscall.SIGQUIT)
+			case <-exited:
+			}
+		}()
+		err = cmd.Wait()
+		close(exited)
+	}
+	this.state.updateLoadBalancer(func(status *LoadBalancerStatus) {
+		status.Running = false
+		status.Pid = 0
+		status.LastExit = time.Now()
+		if err != nil {
+			status.LastError = err.Error()
+		}
+	})
+
+	// The process is expected to exit when the agent stops.
+	select {
+	case <-ctx.Done():
+		loadBalancerLog.Info("Process exited", "error", err)
+		return
+	default:
+	}
+
 	if err != nil && errorChan != nil {
 		*errorChan <- err
 	}
-	log.Println("[LoadBalancer] Process died.")
+	loadBalancerLog.Warn("Process died", "error", err)
+	this.metrics.nginxCrashes.Inc()
 
 	// Avoid quickly successive failures.
-	<-time.After(10 * time.Second)
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(10 * time.Second):
+	}
 	restart <- true
 }
 
-func updateLoadBalancerConfig(client *etcd.Client, currentInstances map[string]*Instance) (err error) {
+func (this *Agent) updateLoadBalancerConfig(currentInstances map[string]*Instance) (err error) {
+	store := this.store
 	err = nginxConfigurationTemplateErr
 	siteMap := make(map[string][]string) // map of public hostname to private address
 
 	// Derive sites from current instances.
 	for _, instance := range currentInstances {
 		if len(instance.Addrs) == 0 {
-			log.Printf("[LoadBalancer] Skipping instance with no known addresses: %s.\n", instance.QualifiedName())
+			loadBalancerLog.WithInstance(instance.Group, instance.Service, instance.Instance).Warn("Skipping instance with no known addresses")
 			continue
 		}
 
-		config, err := GetServiceConfig(client, instance.Group, instance.Service)
+		config, err := GetServiceConfig(store, instance.Group, instance.Service)
 		if err != nil {
 			return err
 		}
 
 		if len(config.Http.HostName) == 0 {
-			log.Printf("[LoadBalancer] Skipping instance with no configured hostname: %s.\n", instance.QualifiedName())
+			loadBalancerLog.WithInstance(instance.Group, instance.Service, instance.Instance).Debug("Skipping instance with no configured hostname")
 			// This isn't a site container.
 			continue
 		}
@@ -172,7 +222,7 @@ func updateLoadBalancerConfig(client *etcd.Client, currentInstances map[string]*
 			continue
 		}
 
-		log.Printf("[LoadBalancer] Updating configuration for %s (upstream: %s).\n", host, strings.Join(servers, ", "))
+		loadBalancerLog.Info("Updating configuration", "host", host, "upstream", servers)
 		sites = append(sites, SiteConfig{Name: host, Servers: servers})
 	}
 
@@ -183,6 +233,13 @@ func updateLoadBalancerConfig(client *etcd.Client, currentInstances map[string]*
 	}
 
 	err = ioutil.WriteFile(configFile, []byte(config), NginxConfigFilePerms)
+	if err == nil {
+		this.state.updateLoadBalancer(func(status *LoadBalancerStatus) {
+			status.Sites = sites
+			status.ConfigFile = configFile
+			status.ConfigUpdate = time.Now()
+		})
+	}
 	return
 }
 
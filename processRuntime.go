@@ -0,0 +1,525 @@
+// Runtime which runs services as host processes rather than in containers.
+package daprdockr
+
+import (
+	"bytes"
+	"encoding/json"
+	goerrors "errors"
+	"github.com/dotcloud/docker"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	ProcessLogLines        = 1000 // Lines of output which are kept for each process.
+	ProcessPortRetries     = 3    // Times a process is started again with new ports if another program took one of them.
+	ProcessPortRetryWindow = 5    // Seconds after starting within which a process which exits may have failed to listen.
+	DefaultProcessStateDir = "/var/run/daprdockr/processes"
+)
+
+var processRuntimeLog = NewLogger("ProcessRuntime")
+
+// A runtime which runs the entrypoint and command of each container as a process on the host, with the configured
+// environment and working directory. The image and other container settings are ignored.
+// Each exposed port is allocated a free host port, which the process is told to listen on through its environment:
+// PORT_<container port>=<host port> for each port, eg: PORT_8080 or PORT_53_UDP, and PORT=<host port> if there is only one.
+// Processes run in their own process group, so that stopping a process also stops its children.
+// A port is only free until the process listens on it, so a process which exits soon after starting while one of its
+// ports is taken is started again with new ports.
+// The process group of each running process is recorded in the state directory, so that processes which are left
+// running when their agent is killed are stopped once another runtime uses the directory.
+type ProcessRuntime struct {
+	lock      sync.Mutex
+	lastId    int
+	processes map[string]*process // By ID.
+	stateDir  string
+	recordDir string   // Directory within the state directory which holds this runtime's records. Created on first use.
+	recordsIn *os.File // Locked for as long as this runtime's process lives, so that other runtimes leave its records.
+}
+
+type process struct {
+	container RuntimeContainer
+	spec      ContainerSpec
+	pid       int
+	output    *processOutput
+	exited    chan bool // Closed when the process exits. Nil if it has not been started.
+	stopping  bool      // Whether the process is being stopped, in which case it is not started again.
+}
+
+// The process group of a running process, recorded in the state directory.
+type processRecord struct {
+	Name string
+	Pid  int
+	Pgid int
+}
+
+// Creates a runtime without any processes, which records its processes in the state directory, eg:
+// DefaultProcessStateDir. Processes recorded by runtimes whose processes have exited, eg: because the agent was
+// killed, are killed, so that they are not left running alongside the instances which replace them. No records are
+// kept if the state directory is empty.
+func NewProcessRuntime(stateDir string) *ProcessRuntime {
+	runtime := &ProcessRuntime{processes: make(map[string]*process), stateDir: stateDir}
+	if len(stateDir) > 0 {
+		killOrphanedProcesses(stateDir)
+	}
+	return runtime
+}
+
+func (this *ProcessRuntime) CreateContainer(spec *ContainerSpec) (container *RuntimeContainer, err error) {
+	if len(processCommand(&spec.Config)) == 0 {
+		return nil, goerrors.New("Process " + spec.Name + " requires a command")
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if _, err = this.find(spec.Name); err == nil {
+		return nil, goerrors.New("Conflict, the name " + spec.Name + " is already in use")
+	}
+	this.lastId++
+	id := "process-" + strconv.Itoa(this.lastId)
+	created := &process{
+		container: RuntimeContainer{
+			ID:           id,
+			Name:         spec.Name,
+			Image:        processCommand(&spec.Config)[0],
+			Status:       "Created",
+			PortMappings: make(map[string]string),
+			Env:          append([]string(nil), spec.Config.Env...),
+		},
+		spec:   *spec,
+		output: newProcessOutput(),
+	}
+	this.processes[id] = created
+	return created.copy(), nil
+}
+
+func (this *ProcessRuntime) StartContainer(id string) (err error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	process, err := this.find(id)
+	if err != nil {
+		return
+	}
+	if process.container.Running {
+		return goerrors.New("Process already running: " + id)
+	}
+	process.exited = make(chan bool)
+	process.stopping = false
+	if err = this.start(process, 0); err != nil {
+		process.exited = nil
+	}
+	return
+}
+
+// Allocates ports to a process and starts it, counting the times which it was started again because another program
+// took one of its ports. Must be called with the lock held.
+func (this *ProcessRuntime) start(process *process, retries int) (err error) {
+	config := &process.spec.Config
+	portMappings := make(map[string]string)
+	env := []string{"PATH=" + os.Getenv("PATH")}
+	if len(config.Hostname) > 0 {
+		env = append(env, "HOSTNAME="+config.Hostname)
+	}
+	env = append(env, config.Env...)
+	ports := exposedPorts(config)
+	allocated := this.allocatedPorts()
+	for _, port := range ports {
+		hostPort, err := allocateHostPort(strings.HasSuffix(port, "/udp"), allocated)
+		if err != nil {
+			return err
+		}
+		allocated[hostPort] = true
+		portMappings[port] = hostPort
+		env = append(env, "PORT_"+strings.ToUpper(strings.Replace(port, "/", "_", 1))+"="+hostPort)
+	}
+	if len(ports) == 1 {
+		env = append(env, "PORT="+portMappings[ports[0]])
+	}
+
+	command := processCommand(config)
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Env = env
+	cmd.Dir = config.WorkingDir
+	cmd.Stdout = process.output
+	cmd.Stderr = process.output
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err = cmd.Start(); err != nil {
+		return
+	}
+
+	process.pid = cmd.Process.Pid
+	process.container.Running = true
+	process.container.ExitCode = 0
+	process.container.StartedAt = time.Now()
+	process.container.FinishedAt = time.Time{}
+	process.container.Status = "Up"
+	process.container.PortMappings = portMappings
+	if err := this.record(process); err != nil {
+		processRuntimeLog.Warn("Unable to record process", "name", process.container.Name, "error", err)
+	}
+	go this.wait(process, cmd, retries)
+	processRuntimeLog.Debug("Started process", "name", process.container.Name, "pid", process.pid, "ports", portMappings)
+	return
+}
+
+// Waits for a process to exit, starting it again with new ports if it could not listen on one of its ports.
+func (this *ProcessRuntime) wait(process *process, cmd *exec.Cmd, retries int) {
+	cmd.Wait()
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.forget(process)
+	startedAt := process.container.StartedAt
+	if !process.stopping && retries < ProcessPortRetries && time.Since(startedAt) < ProcessPortRetryWindow*time.Second && portsTaken(process.container.PortMappings) {
+		processRuntimeLog.Warn("Port taken before the process listened on it, starting again", "name", process.container.Name, "ports", process.container.PortMappings)
+		if err := this.start(process, retries+1); err == nil {
+			return
+		}
+	}
+	process.container.Running = false
+	process.container.ExitCode = processExitCode(cmd.ProcessState)
+	process.container.FinishedAt = time.Now()
+	process.container.Status = "Exited (" + strconv.Itoa(process.container.ExitCode) + ")"
+	close(process.exited)
+}
+
+// Sends SIGTERM to the process group, then SIGKILL if the process has not exited within the timeout.
+func (this *ProcessRuntime) StopContainer(id string, timeout uint) (err error) {
+	pid, exited, err := this.stop(id)
+	if err != nil || exited == nil {
+		return
+	}
+	syscall.Kill(-pid, syscall.SIGTERM)
+	select {
+	case <-exited:
+		return
+	case <-time.After(time.Duration(timeout) * time.Second):
+	}
+	syscall.Kill(-pid, syscall.SIGKILL)
+	<-exited
+	return
+}
+
+func (this *ProcessRuntime) KillContainer(id string) (err error) {
+	pid, exited, err := this.stop(id)
+	if err != nil || exited == nil {
+		return
+	}
+	syscall.Kill(-pid, syscall.SIGKILL)
+	<-exited
+	return
+}
+
+func (this *ProcessRuntime) RemoveContainer(id string) (err error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	process, err := this.find(id)
+	if err != nil {
+		return
+	}
+	if process.container.Running {
+		return goerrors.New("Cannot remove running process: " + id)
+	}
+	delete(this.processes, process.container.ID)
+	return
+}
+
+func (this *ProcessRuntime) ListContainers() (containers []*RuntimeContainer, err error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	containers = make([]*RuntimeContainer, 0, len(this.processes))
+	for _, process := range this.processes {
+		if process.container.Running {
+			containers = append(containers, process.copy())
+		}
+	}
+	sort.Sort(runtimeContainersByName(containers))
+	return
+}
+
+func (this *ProcessRuntime) InspectContainer(id string) (container *RuntimeContainer, err error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	process, err := this.find(id)
+	if err != nil {
+		return
+	}
+	return process.copy(), nil
+}
+
+// Writes the process's combined standard output and error. Only the last ProcessLogLines lines are kept.
+func (this *ProcessRuntime) ContainerLogs(id string, options ContainerLogsOptions, output io.Writer) (err error) {
+	this.lock.Lock()
+	process, err := this.find(id)
+	if err != nil {
+		this.lock.Unlock()
+		return
+	}
+	exited := process.exited
+	this.lock.Unlock()
+
+	lines, position, written := process.output.since(-1)
+	if tail, err := strconv.Atoi(options.Tail); err == nil && tail >= 0 && tail < len(lines) {
+		lines = lines[len(lines)-tail:]
+	}
+	for {
+		for _, line := range lines {
+			if _, err = io.WriteString(output, line+"\n"); err != nil {
+				return
+			}
+		}
+		if !options.Follow || exited == nil {
+			return
+		}
+		select {
+		case <-written:
+		case <-exited:
+			// Write whatever the process wrote before exiting.
+			lines, _, _ = process.output.since(position)
+			options.Follow = false
+			continue
+		}
+		lines, position, written = process.output.since(position)
+	}
+}
+
+// Marks a running process as stopping, so that it is not started again, returning its process ID and exit channel,
+// or a nil channel if it is not running.
+func (this *ProcessRuntime) stop(id string) (pid int, exited chan bool, err error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	process, err := this.find(id)
+	if err != nil || !process.container.Running {
+		return
+	}
+	process.stopping = true
+	return process.pid, process.exited, nil
+}
+
+// Returns the host ports allocated to running processes. Must be called with the lock held.
+func (this *ProcessRuntime) allocatedPorts() (ports map[string]bool) {
+	ports = make(map[string]bool)
+	for _, process := range this.processes {
+		if process.container.Running {
+			for _, hostPort := range process.container.PortMappings {
+				ports[hostPort] = true
+			}
+		}
+	}
+	return
+}
+
+// Records the process group of a running process in this runtime's directory, creating it and locking it for as long
+// as this runtime's process lives if it does not yet exist. Must be called with the lock held.
+func (this *ProcessRuntime) record(process *process) (err error) {
+	if len(this.stateDir) == 0 {
+		return
+	}
+	if this.recordsIn == nil {
+		if err = os.MkdirAll(this.stateDir, 0755); err != nil {
+			return
+		}
+		dir, err := ioutil.TempDir(this.stateDir, "runtime-")
+		if err != nil {
+			return err
+		}
+		if this.recordsIn, err = lockProcessRecords(dir); err != nil {
+			os.RemoveAll(dir)
+			return err
+		}
+		this.recordDir = dir
+	}
+	payload, err := json.Marshal(&processRecord{Name: process.container.Name, Pid: process.pid, Pgid: process.pid})
+	if err != nil {
+		return
+	}
+	return ioutil.WriteFile(filepath.Join(this.recordDir, process.container.ID), payload, 0644)
+}
+
+// Removes the record of a process which exited. Must be called with the lock held.
+func (this *ProcessRuntime) forget(process *process) {
+	if len(this.recordDir) > 0 {
+		os.Remove(filepath.Join(this.recordDir, process.container.ID))
+	}
+}
+
+// Finds a process by ID or name. Must be called with the lock held.
+func (this *ProcessRuntime) find(id string) (found *process, err error) {
+	if found, exists := this.processes[id]; exists {
+		return found, nil
+	}
+	name := strings.TrimPrefix(id, "/")
+	for _, process := range this.processes {
+		if process.container.Name == name {
+			return process, nil
+		}
+	}
+	return nil, goerrors.New("No such process: " + id)
+}
+
+func (this *process) copy() *RuntimeContainer {
+	copied := this.container
+	copied.PortMappings = make(map[string]string, len(this.container.PortMappings))
+	for private, public := range this.container.PortMappings {
+		copied.PortMappings[private] = public
+	}
+	return &copied
+}
+
+// Returns the command line of a process, formed from the entrypoint and command as in Docker.
+func processCommand(config *docker.Config) (command []string) {
+	command = append(command, config.Entrypoint...)
+	return append(command, config.Cmd...)
+}
+
+// Returns the exit code of a process, or 128 plus the signal number if it was killed, as in Docker.
+func processExitCode(state *os.ProcessState) int {
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return state.ExitCode()
+}
+
+// Finds a free TCP or UDP port on the host which is not already allocated.
+func allocateHostPort(udp bool, allocated map[string]bool) (port string, err error) {
+	for attempt := 0; attempt < 10; attempt++ {
+		var addr net.Addr
+		if addr, err = listenHostPort(udp, "0"); err != nil {
+			return
+		}
+		if _, port, err = net.SplitHostPort(addr.String()); err != nil || !allocated[port] {
+			return
+		}
+	}
+	return "", goerrors.New("Unable to find a free port")
+}
+
+// Listens on a port and closes it again, returning the address listened on.
+func listenHostPort(udp bool, port string) (addr net.Addr, err error) {
+	if udp {
+		conn, err := net.ListenPacket("udp", ":"+port)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		return conn.LocalAddr(), nil
+	}
+	listener, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		return nil, err
+	}
+	defer listener.Close()
+	return listener.Addr(), nil
+}
+
+// Returns whether any of the host ports of a process which exited are in use by another program.
+func portsTaken(portMappings map[string]string) bool {
+	for private, public := range portMappings {
+		if _, err := listenHostPort(strings.HasSuffix(private, "/udp"), public); err != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Opens and locks the lock file of a runtime's record directory, failing if another runtime holds the lock.
+func lockProcessRecords(dir string) (lock *os.File, err error) {
+	if lock, err = os.OpenFile(filepath.Join(dir, ".lock"), os.O_RDWR|os.O_CREATE, 0644); err != nil {
+		return
+	}
+	if err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		lock.Close()
+		return nil, err
+	}
+	return
+}
+
+// Kills the process groups recorded by runtimes which no longer hold their record directory's lock, since their
+// processes exited, then removes their records.
+func killOrphanedProcesses(stateDir string) {
+	dirs, err := ioutil.ReadDir(stateDir)
+	if err != nil {
+		return
+	}
+	for _, dir := range dirs {
+		path := filepath.Join(stateDir, dir.Name())
+		if !dir.IsDir() {
+			continue
+		}
+		lock, err := lockProcessRecords(path)
+		if err != nil {
+			continue
+		}
+		files, _ := ioutil.ReadDir(path)
+		for _, file := range files {
+			payload, err := ioutil.ReadFile(filepath.Join(path, file.Name()))
+			record := new(processRecord)
+			if err != nil || file.Name() == ".lock" || json.Unmarshal(payload, record) != nil || record.Pgid <= 1 {
+				continue
+			}
+			if err = syscall.Kill(-record.Pgid, syscall.SIGKILL); err == nil {
+				processRuntimeLog.Warn("Killed orphaned process", "name", record.Name, "pid", record.Pid)
+			}
+		}
+		os.RemoveAll(path)
+		lock.Close()
+	}
+}
+
+// The most recent lines written by a process.
+type processOutput struct {
+	lock    sync.Mutex
+	lines   []string
+	total   int    // Lines written since the process was created, including those which were discarded.
+	partial []byte // Output following the last complete line.
+	written chan bool
+}
+
+func newProcessOutput() *processOutput {
+	return &processOutput{written: make(chan bool)}
+}
+
+func (this *processOutput) Write(p []byte) (n int, err error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.partial = append(this.partial, p...)
+	for {
+		end := bytes.IndexByte(this.partial, '\n')
+		if end < 0 {
+			break
+		}
+		this.lines = append(this.lines, string(this.partial[:end]))
+		this.partial = this.partial[end+1:]
+		this.total++
+	}
+	if len(this.lines) > ProcessLogLines {
+		this.lines = append([]string(nil), this.lines[len(this.lines)-ProcessLogLines:]...)
+	}
+	close(this.written)
+	this.written = make(chan bool)
+	return len(p), nil
+}
+
+// Returns the kept lines which follow the provided number of lines, or all kept lines if it is negative, along with
+// the number of lines written so far and a channel which is closed when more output is written.
+func (this *processOutput) since(position int) (lines []string, next int, written chan bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	first := this.total - len(this.lines) // Position of the first kept line.
+	start := 0
+	if position >= first {
+		start = position - first
+	}
+	if start < len(this.lines) {
+		lines = append(lines, this.lines[start:]...)
+	}
+	return lines, this.total, this.written
+}
@@ -0,0 +1,197 @@
+package daprdockr
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/dotcloud/docker"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestProcessSpec(name, script string, ports ...docker.Port) *ContainerSpec {
+	config := docker.Config{Cmd: []string{"/bin/sh", "-c", script}, ExposedPorts: make(map[docker.Port]struct{})}
+	for _, port := range ports {
+		config.ExposedPorts[port] = struct{}{}
+	}
+	return &ContainerSpec{Name: name, Runtime: RuntimeProcess, Config: config}
+}
+
+// Creates and starts a process, failing the test if it cannot.
+func startTestProcess(t *testing.T, runtime *ProcessRuntime, spec *ContainerSpec) (container *RuntimeContainer) {
+	container, err := runtime.CreateContainer(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = runtime.StartContainer(container.ID); err != nil {
+		t.Fatal(err)
+	}
+	if container, err = runtime.InspectContainer(container.ID); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// Returns the logs of a process, following them until it exits if requested.
+func processLogs(t *testing.T, runtime *ProcessRuntime, id string, options ContainerLogsOptions) string {
+	var output bytes.Buffer
+	if err := runtime.ContainerLogs(id, options, &output); err != nil {
+		t.Fatal(err)
+	}
+	return output.String()
+}
+
+func TestProcessRuntimeRunsProcesses(t *testing.T) {
+	runtime := NewProcessRuntime(t.TempDir())
+	container := startTestProcess(t, runtime, newTestProcessSpec("0.api.web.container", `echo "port $PORT $PORT_8080"; echo failed >&2; exec sleep 30`, "8080/tcp"))
+	if !container.Running || container.Image != "/bin/sh" {
+		t.Fatalf("Expected the process to be running, got %+v", container)
+	}
+	port := container.PortMappings["8080"]
+	if len(port) == 0 {
+		t.Fatalf("Expected the exposed port to be mapped, got %v", container.PortMappings)
+	}
+	waitFor(t, "the process's output", func() bool {
+		return processLogs(t, runtime, container.ID, ContainerLogsOptions{}) == "port "+port+" "+port+"\nfailed\n"
+	})
+	if logs := processLogs(t, runtime, container.ID, ContainerLogsOptions{Tail: "1"}); logs != "failed\n" {
+		t.Errorf("Expected the last line of output, got %q", logs)
+	}
+	if listed, _ := runtime.ListContainers(); len(listed) != 1 || listed[0].Name != container.Name {
+		t.Errorf("Expected the running process to be listed, got %v", listed)
+	}
+	if _, err := runtime.CreateContainer(newTestProcessSpec(container.Name, "true")); err == nil {
+		t.Error("Expected a second process with the same name to be refused")
+	}
+	if err := runtime.RemoveContainer(container.ID); err == nil {
+		t.Error("Expected a running process not to be removed")
+	}
+
+	if err := runtime.StopContainer(container.Name, 5); err != nil {
+		t.Fatal(err)
+	}
+	if stopped, _ := runtime.InspectContainer(container.ID); stopped.Running || stopped.ExitCode != 143 || stopped.FinishedAt.IsZero() {
+		t.Errorf("Expected the process to be stopped by SIGTERM, got %+v", stopped)
+	}
+	if listed, _ := runtime.ListContainers(); len(listed) != 0 {
+		t.Errorf("Expected no processes to be listed, got %v", listed)
+	}
+	if err := runtime.RemoveContainer(container.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := runtime.InspectContainer(container.ID); err == nil {
+		t.Error("Expected the process to be removed")
+	}
+}
+
+func TestProcessRuntimeFollowsLogsUntilExit(t *testing.T) {
+	runtime := NewProcessRuntime("")
+	container := startTestProcess(t, runtime, newTestProcessSpec("0.api.web.container", "echo one; sleep 0.2; echo two; exit 3"))
+	if logs := processLogs(t, runtime, container.ID, ContainerLogsOptions{Follow: true}); logs != "one\ntwo\n" {
+		t.Errorf("Expected the output until the process exited, got %q", logs)
+	}
+	if exited, _ := runtime.InspectContainer(container.ID); exited.Running || exited.ExitCode != 3 || exited.Status != "Exited (3)" {
+		t.Errorf("Expected the process to exit with its code, got %+v", exited)
+	}
+}
+
+// A process whose port is taken before it listens on it is started again with a new port.
+func TestProcessRuntimeRetriesTakenPorts(t *testing.T) {
+	runtime := NewProcessRuntime("")
+	marker := filepath.Join(t.TempDir(), "started")
+	container := startTestProcess(t, runtime, newTestProcessSpec("0.api.web.container", `echo "port $PORT"; test -e `+marker+` && exec sleep 30; touch `+marker+`; sleep 0.5; exit 1`, "8080/tcp"))
+	defer runtime.KillContainer(container.ID)
+	taken, err := net.Listen("tcp", ":"+container.PortMappings["8080"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+
+	var restarted *RuntimeContainer
+	waitFor(t, "the process to be started with a new port", func() bool {
+		restarted, _ = runtime.InspectContainer(container.ID)
+		return restarted.PortMappings["8080"] != container.PortMappings["8080"]
+	})
+	if !restarted.Running {
+		t.Errorf("Expected the process to be running, got %+v", restarted)
+	}
+	waitFor(t, "the process's output", func() bool {
+		return strings.Count(processLogs(t, runtime, container.ID, ContainerLogsOptions{}), "port ") == 2
+	})
+	if logs := processLogs(t, runtime, container.ID, ContainerLogsOptions{Tail: "1"}); logs != "port "+restarted.PortMappings["8080"]+"\n" {
+		t.Errorf("Expected the process to be told its new port, got %q", logs)
+	}
+}
+
+// Processes which a runtime leaves running when its agent is killed are killed by the next runtime.
+func TestProcessRuntimeKillsOrphanedProcesses(t *testing.T) {
+	stateDir := t.TempDir()
+	orphaned := NewProcessRuntime(stateDir)
+	container := startTestProcess(t, orphaned, newTestProcessSpec("0.api.web.container", "exec sleep 30"))
+	defer orphaned.KillContainer(container.ID)
+
+	// Another runtime leaves the records of a runtime which is alive.
+	NewProcessRuntime(stateDir)
+	if running, _ := orphaned.InspectContainer(container.ID); !running.Running {
+		t.Fatal("Expected the process of a live runtime to be left running")
+	}
+
+	// The lock is released when the agent's process exits.
+	orphaned.recordsIn.Close()
+	NewProcessRuntime(stateDir)
+	waitFor(t, "the orphaned process to be killed", func() bool {
+		killed, _ := orphaned.InspectContainer(container.ID)
+		return !killed.Running && killed.ExitCode == 137
+	})
+	if dirs, _ := os.ReadDir(stateDir); len(dirs) != 0 {
+		t.Errorf("Expected the orphaned records to be removed, got %v", dirs)
+	}
+}
+
+// The runner starts an instance whose process exited again once its backoff has elapsed, as it does containers.
+func TestProcessInstanceStartedAgainAfterExit(t *testing.T) {
+	store, processes := NewMemoryStore(), NewProcessRuntime("")
+	agent, err := NewAgent(AgentOptions{Store: store, Runtime: NewFakeRuntime(), ProcessRuntime: processes, HostIp: net.ParseIP("10.0.0.1"), NodeId: "node-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(agent.instances.start())
+	config := newTestServiceConfig(1)
+	config.Runtime = RuntimeProcess
+	config.Container.Cmd = []string{"/bin/sh", "-c", "exit 3"}
+	name := config.FullyQualifiedDomainName(0, agent.Zone())
+	add := map[string]*RequiredStateChange{config.InstanceQualifiedName(0): {ServiceConfig: config, Instance: 0, Operation: Add}}
+	if err = applyChanges(agent, add); err != nil {
+		t.Fatal(err)
+	}
+	first, err := processes.InspectContainer(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the process to exit", func() bool {
+		exited, _ := processes.InspectContainer(name)
+		return !exited.Running
+	})
+
+	if err = applyChanges(agent, add); err != nil {
+		t.Fatal(err)
+	}
+	record, err := GetRestartRecord(store, "web", "api", 0)
+	if err != nil || record == nil || record.LastReason != "Exited with code 3" {
+		t.Fatalf("Expected the exit to be recorded as a failure, got %+v, %v", record, err)
+	}
+	record.BackoffUntil = time.Now().Add(-time.Second)
+	payload, _ := json.Marshal(record)
+	if _, err = store.Set(restartsPath("web", "api", 0), string(payload), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err = applyChanges(agent, add); err != nil {
+		t.Fatal(err)
+	}
+	if started, err := processes.InspectContainer(name); err != nil || started.ID == first.ID {
+		t.Errorf("Expected the process to be started again, got %+v, %v", started, err)
+	}
+}
@@ -10,17 +10,14 @@ import (
 	"strings"
 )
 
-var (
-	Route4FilePath = "/proc/net/route"
-	Route6FilePath = "/proc/net/ipv6_route"
+const (
+	DefaultRoute4FilePath = "/proc/net/route"
+	DefaultRoute6FilePath = "/proc/net/ipv6_route"
 )
 
 var internetDestintationIPv4 = []byte{0, 0, 0, 0}
 var internetDestintationIPv6 = []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
 
-// The IP address of the docker host.
-var hostIp net.IP
-
 /*
 type Flags uint
 
@@ -37,24 +34,9 @@ const (
 )
 */
 
-// Sets IP address of the docker host.
-func SetHostIp(ip net.IP) {
-	hostIp = make(net.IP, 0, len(ip))
-	hostIp = append(hostIp, ip...)
-}
-
-// Gets the IP address of the docker host.
-func HostIp() (ip net.IP, err error) {
-	if len(hostIp) == 0 {
-		err = errors.New("Host IP unknown")
-		return
-	}
-	ip = hostIp
-	return
-}
-
-func InternetRoutedIp() (ip net.IP, err error) {
-	ips, err := internetRoutedIps()
+// Returns an IP address which has a route to the Internet, according to the provided IPv4 route file.
+func InternetRoutedIp(route4File string) (ip net.IP, err error) {
+	ips, err := internetRoutedIps(route4File)
 	if err != nil && len(ips) == 0 {
 		return
 	}
@@ -63,8 +45,8 @@ func InternetRoutedIp() (ip net.IP, err error) {
 }
 
 // Returns a collection of IP addresses which have a route to the Internet
-func internetRoutedIps() (ips []net.IP, err error) {
-	routes, err := parseRoutes()
+func internetRoutedIps(route4File string) (ips []net.IP, err error) {
+	routes, err := parseRoutes(route4File)
 	if err != nil {
 		return
 	}
@@ -138,13 +120,13 @@ func getInterfaces() (interfaces map[string]net.Interface, err error) {
 	}
 	return
 }
-func parseRoutes() (routes []RouteEntry, err error) {
+func parseRoutes(route4File string) (routes []RouteEntry, err error) {
 
 	interfaces, err := getInterfaces()
 	if err != nil {
 		return
 	}
-	routes4, err := parseRoutes4(interfaces)
+	routes4, err := parseRoutes4(route4File, interfaces)
 	if err != nil {
 		return
 	} /*
@@ -157,9 +139,9 @@ func parseRoutes() (routes []RouteEntry, err error) {
 	return
 }
 
-func parseRoutes4(interfaces map[string]net.Interface) (routes []RouteEntry, err error) {
+func parseRoutes4(routeFile string, interfaces map[string]net.Interface) (routes []RouteEntry, err error) {
 	routes = make([]RouteEntry, 0, 10)
-	systemRouteText, err := ioutil.ReadFile(Route4FilePath)
+	systemRouteText, err := ioutil.ReadFile(routeFile)
 	if err != nil {
 		return
 	}
@@ -209,7 +191,7 @@ func parseRoute4(routeText string, interfaces map[string]net.Interface) (route R
 /*
 func parseRoutes6(interfaces map[string]net.Interface) (routes []RouteEntry, err error) {
 	routes = make([]RouteEntry, 0, 10)
-	systemRouteText, err := ioutil.ReadFile(Route6FilePath)
+	systemRouteText, err := ioutil.ReadFile(DefaultRoute6FilePath)
 	if err != nil {
 		return
 	}
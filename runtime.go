@@ -0,0 +1,213 @@
+// Runtimes which run the containers of service instances on the local host.
+package daprdockr
+
+import (
+	goerrors "errors"
+	"github.com/dotcloud/docker"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Names of the runtimes which a service configuration may select.
+const (
+	RuntimeDocker  = "docker"
+	RuntimeProcess = "process"
+)
+
+// A container as reported by a runtime.
+type RuntimeContainer struct {
+	ID           string
+	Name         string // Eg: "0.api.web.container" for a managed container.
+	Runtime      string // Name of the runtime which runs the container, eg: RuntimeDocker.
+	Image        string
+	Status       string // Human-readable status, eg: "Up 5 minutes".
+	Running      bool
+	ExitCode     int
+	StartedAt    time.Time
+	FinishedAt   time.Time
+	PortMappings map[string]string // Map from container port to host port, as in Instance.
+	Env          []string          // Environment of the container. Runtimes may only report it when inspecting.
+}
+
+// The name and configuration of a container to create.
+type ContainerSpec struct {
+	Name    string
+	Runtime string // Name of the runtime which should run the container. Default: RuntimeDocker.
+	Config  docker.Config
+}
+
+// Creates and controls containers on the local host.
+type Runtime interface {
+	// Creates a container which has not been started.
+	CreateContainer(spec *ContainerSpec) (container *RuntimeContainer, err error)
+
+	// Starts a created container, publishing its exposed ports on the host.
+	StartContainer(id string) (err error)
+
+	// Stops a container, killing it if it does not stop within the timeout, in seconds.
+	StopContainer(id string, timeout uint) (err error)
+
+	KillContainer(id string) (err error)
+
+	// Removes a stopped container.
+	RemoveContainer(id string) (err error)
+
+	// Lists the running containers.
+	ListContainers() (containers []*RuntimeContainer, err error)
+
+	// Gets a container by ID or name.
+	InspectContainer(id string) (container *RuntimeContainer, err error)
+
+	// Writes a container's output until it is exhausted or, if following, until the container stops.
+	ContainerLogs(id string, options ContainerLogsOptions, output io.Writer) (err error)
+}
+
+// A runtime which creates each container using the runtime named by its specification, and finds existing
+// containers in any of its runtimes.
+type runtimeSet struct {
+	names    []string // Runtimes in the order in which they are searched.
+	runtimes map[string]Runtime
+}
+
+func newRuntimeSet(runtimes map[string]Runtime) *runtimeSet {
+	set := &runtimeSet{runtimes: runtimes}
+	for name := range runtimes {
+		set.names = append(set.names, name)
+	}
+	sort.Strings(set.names)
+	return set
+}
+
+func (this *runtimeSet) CreateContainer(spec *ContainerSpec) (container *RuntimeContainer, err error) {
+	name := spec.Runtime
+	if len(name) == 0 {
+		name = RuntimeDocker
+	}
+	runtime, exists := this.runtimes[name]
+	if !exists {
+		return nil, goerrors.New("Unknown runtime: " + name)
+	}
+	if container, err = runtime.CreateContainer(spec); err == nil {
+		container.Runtime = name
+	}
+	return
+}
+
+func (this *runtimeSet) StartContainer(id string) (err error) {
+	runtime, err := this.find(id)
+	if err != nil {
+		return
+	}
+	return runtime.StartContainer(id)
+}
+
+func (this *runtimeSet) StopContainer(id string, timeout uint) (err error) {
+	runtime, err := this.find(id)
+	if err != nil {
+		return
+	}
+	return runtime.StopContainer(id, timeout)
+}
+
+func (this *runtimeSet) KillContainer(id string) (err error) {
+	runtime, err := this.find(id)
+	if err != nil {
+		return
+	}
+	return runtime.KillContainer(id)
+}
+
+func (this *runtimeSet) RemoveContainer(id string) (err error) {
+	runtime, err := this.find(id)
+	if err != nil {
+		return
+	}
+	return runtime.RemoveContainer(id)
+}
+
+func (this *runtimeSet) ListContainers() (containers []*RuntimeContainer, err error) {
+	containers = make([]*RuntimeContainer, 0)
+	for _, name := range this.names {
+		listed, err := this.runtimes[name].ListContainers()
+		if err != nil {
+			return nil, err
+		}
+		for _, container := range listed {
+			container.Runtime = name
+		}
+		containers = append(containers, listed...)
+	}
+	return
+}
+
+func (this *runtimeSet) InspectContainer(id string) (container *RuntimeContainer, err error) {
+	for _, name := range this.names {
+		if container, err = this.runtimes[name].InspectContainer(id); err == nil {
+			container.Runtime = name
+			return
+		}
+	}
+	return
+}
+
+func (this *runtimeSet) ContainerLogs(id string, options ContainerLogsOptions, output io.Writer) (err error) {
+	runtime, err := this.find(id)
+	if err != nil {
+		return
+	}
+	return runtime.ContainerLogs(id, options, output)
+}
+
+// Returns the runtime which runs the container.
+func (this *runtimeSet) find(id string) (runtime Runtime, err error) {
+	container, err := this.InspectContainer(id)
+	if err != nil {
+		return
+	}
+	return this.runtimes[container.Runtime], nil
+}
+
+// Returns the keys of the container ports which the configuration exposes, eg: "80" or "53/udp".
+func exposedPorts(config *docker.Config) (ports []string) {
+	exposed := make(map[string]bool)
+	for port := range config.ExposedPorts {
+		exposed[portMappingKeyFromSpec(string(port))] = true
+	}
+	for _, portSpec := range config.PortSpecs {
+		// Port specifications take the form "[[hostIp:]hostPort:]containerPort[/protocol]".
+		parts := strings.Split(portSpec, ":")
+		exposed[portMappingKeyFromSpec(parts[len(parts)-1])] = true
+	}
+	for port := range exposed {
+		ports = append(ports, port)
+	}
+	sort.Strings(ports)
+	return
+}
+
+// Returns the key of a container port in an instance's port mappings: the port, suffixed with "/udp" for UDP ports.
+func portMappingKey(port, protocol string) string {
+	if strings.EqualFold(protocol, "udp") {
+		return port + "/udp"
+	}
+	return port
+}
+
+// Returns the port mapping key of a port in the form "port[/protocol]".
+func portMappingKeyFromSpec(port string) string {
+	parts := strings.SplitN(port, "/", 2)
+	if len(parts) == 2 {
+		return portMappingKey(parts[0], parts[1])
+	}
+	return parts[0]
+}
+
+// Splits a port mapping key into the port and its protocol, "tcp" or "udp".
+func splitPortMappingKey(key string) (port, protocol string) {
+	if strings.HasSuffix(key, "/udp") {
+		return strings.TrimSuffix(key, "/udp"), "udp"
+	}
+	return key, "tcp"
+}
@@ -1,29 +1,32 @@
 package daprdockr
 
 import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
 	goerrors "errors"
-	"github.com/coreos/go-etcd/etcd"
 	"github.com/dotcloud/docker"
-	"log"
 	"reflect"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 const (
 	FullServiceConfigSyncInterval = 65
+	ServiceRevisionEnv            = "DAPRDOCKR_REVISION" // Environment variable holding the configuration revision of a container.
 )
 
 type serviceConfigs struct {
 	Updated chan bool
 }
 
-var ServiceConfigs serviceConfigs
+var serviceConfigLog = NewLogger("ServiceConfig")
 
-func init() {
-	ServiceConfigs.Updated = make(chan bool, 1)
+func newServiceConfigs() *serviceConfigs {
+	return &serviceConfigs{Updated: make(chan bool, 1)}
 }
 
 // Uniquely identifies a service.
@@ -35,8 +38,10 @@ type ServiceIdentifier struct {
 func (id *ServiceIdentifier) QualifiedName() string {
 	return id.Name + "." + id.Group
 }
-func (id *ServiceIdentifier) FullyQualifiedDomainName(instance int) string {
-	return id.InstanceQualifiedName(instance) + "." + ContainerDomainSuffix
+
+// Returns the name of an instance of the service within the zone, which is also the name of its container.
+func (id *ServiceIdentifier) FullyQualifiedDomainName(instance int, zone string) string {
+	return id.InstanceQualifiedName(instance) + "." + zone
 }
 
 func (id *ServiceIdentifier) InstanceQualifiedName(instance int) string {
@@ -59,6 +64,7 @@ type ServiceHttpConfig struct {
 type ServiceConfig struct {
 	ServiceIdentifier
 	Instances int
+	Runtime   string `json:",omitempty"` // Runs the instances: RuntimeDocker (default) or RuntimeProcess.
 	Container docker.Config
 	// The Docker container image used to pull and run the container
 	Http ServiceHttpConfig
@@ -69,53 +75,78 @@ func (this *ServiceConfig) Equals(other *ServiceConfig) bool {
 	return reflect.DeepEqual(this, other)
 }
 
+// Returns an identifier of the configuration which instances are created from, eg: "3f786850e387".
+// The revision changes whenever the configuration changes, other than the number of instances.
+func (this *ServiceConfig) Revision() string {
+	config := *this
+	config.Instances = 0
+	encoded, _ := json.Marshal(&config)
+	hash := sha1.Sum(encoded)
+	return hex.EncodeToString(hash[:])[:12]
+}
+
+// Returns the configuration revision which a container was created from, as recorded in its environment.
+func revisionFromEnv(env []string) string {
+	for _, variable := range env {
+		if strings.HasPrefix(variable, ServiceRevisionEnv+"=") {
+			return strings.TrimPrefix(variable, ServiceRevisionEnv+"=")
+		}
+	}
+	return ""
+}
+
 type ServiceConfigUpdate struct {
 	Operation     Operation
 	ServiceConfig *ServiceConfig
 }
 
 // Adds or updates service configuration.
-func SetServiceConfig(client *etcd.Client, config *ServiceConfig) (err error) {
+func SetServiceConfig(store Store, config *ServiceConfig) (err error) {
 	encodedConfig, err := json.Marshal(config)
 	if err != nil {
 		return
 	}
-	_, err = client.Set(config.Key(), string(encodedConfig), 0)
+	_, err = store.Set(config.Key(), string(encodedConfig), 0)
 	return
 }
 
 // Removes a service.
-func DeleteService(client *etcd.Client, id *ServiceIdentifier) (err error) {
-	_, err = client.Delete(id.Key(), false)
+func DeleteService(store Store, id *ServiceIdentifier) (err error) {
+	err = store.Delete(id.Key())
 	return
 }
 
-// Sends the latest service configurations to the output channel.
+// Sends the latest service configurations to the output channel until the context is done, then closes it.
 // Multiple subsequent messages are suppressed and only the latest value is made available for consumers.
-func LatestServiceConfigs(etcdClient *etcd.Client, stop chan bool, throttleInterval time.Duration) chan map[string]*ServiceConfig {
-	incomingUpdates := currentServiceConfigs(etcdClient, stop)
-	return latestServiceConfigUpdates(incomingUpdates, throttleInterval)
+func (this *Agent) LatestServiceConfigs(ctx context.Context, outgoing chan map[string]*ServiceConfig) (err error) {
+	var wg sync.WaitGroup
+	incomingUpdates := this.currentServiceConfigs(ctx, &wg)
+	latestServiceConfigUpdates(ctx, incomingUpdates, outgoing, this.throttleInterval, &wg)
+	wg.Wait()
+	return
 }
 
-// Forwards messages from the provided channel to the output channel.
+// Forwards messages from the provided channel to the consumer channel, which is closed once the context is done.
 // Multiple subsequent messages are suppressed and only the latest value is made available for consumers.
-func latestServiceConfigUpdates(incomingUpdates chan map[string]*ServiceConfig, throttleInterval time.Duration) chan map[string]*ServiceConfig {
-	// Consumer channel.
-	consumer := make(chan map[string]*ServiceConfig)
-
+func latestServiceConfigUpdates(ctx context.Context, incomingUpdates chan map[string]*ServiceConfig, consumer chan map[string]*ServiceConfig, throttleInterval time.Duration, wg *sync.WaitGroup) {
 	// Shared channels.
 	updateAvailable := make(chan bool, 1)
 	latestUpdate := make(chan map[string]*ServiceConfig)
 
 	// Get updates as they are made available.
-	go func() {
+	goTracked(wg, func() {
 		var latest map[string]*ServiceConfig
 		for {
 			select {
 			case latestUpdate <- latest:
 				// The latest update has been retrieved.
-			case latest = <-incomingUpdates:
+			case update, ok := <-incomingUpdates:
+				if !ok {
+					return
+				}
+
 				// A new update has arrived.
+				latest = update
 				select {
 				case updateAvailable <- true:
 				// Notify of an update, if not already notified.
@@ -123,36 +154,55 @@ func latestServiceConfigUpdates(incomingUpdates chan map[string]*ServiceConfig,
 				}
 			}
 		}
-	}()
+	})
 
 	// Provide only the latest update to the consumer.
-	go func() {
+	goTracked(wg, func() {
+		defer close(consumer)
 		throttler := time.NewTicker(throttleInterval)
+		defer throttler.Stop()
 
 		// Wait for initial update to be made available.
-		<-updateAvailable
+		select {
+		case <-ctx.Done():
+			return
+		case <-updateAvailable:
+		}
 		for {
 			// Retrieve update.
-			update := <-latestUpdate
+			var update map[string]*ServiceConfig
+			select {
+			case <-ctx.Done():
+				return
+			case update = <-latestUpdate:
+			}
 
 			// Either wait for another update (and retrieve it), or pass the latest update to the consumer.
 			select {
+			case <-ctx.Done():
+				return
 			case <-updateAvailable:
 				// Another update became available before the previous one was consumed.
 			case consumer <- update:
 				// The latest update has been consumed.
-				// Wait for throttler.
-				<-throttler.C
-				// Wait for another update.
-				<-updateAvailable
+				// Wait for throttler, then for another update.
+				select {
+				case <-ctx.Done():
+					return
+				case <-throttler.C:
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-updateAvailable:
+				}
 			}
 		}
-	}()
-	return consumer
+	})
 }
 
 // Returns a channel publishing the current service configs whenever they change.
-func currentServiceConfigs(client *etcd.Client, stop chan bool) (currentServiceConfigs chan map[string]*ServiceConfig) {
+func (this *Agent) currentServiceConfigs(ctx context.Context, wg *sync.WaitGroup) (currentServiceConfigs chan map[string]*ServiceConfig) {
 	serviceConfigMap := make(map[string]*ServiceConfig)
 	updated := func(update *ServiceConfigUpdate) (newServiceConfigMap map[string]*ServiceConfig, changed bool) {
 		newServiceConfigMap = serviceConfigMap
@@ -173,118 +223,109 @@ func currentServiceConfigs(client *etcd.Client, stop chan bool) (currentServiceC
 	}
 
 	currentServiceConfigs = make(chan map[string]*ServiceConfig)
-	go func() {
+	updates := this.serviceConfigUpdates(ctx, wg)
+	goTracked(wg, func() {
 		defer close(currentServiceConfigs)
-		for update := range serviceConfigUpdates(client, stop) {
-			// Mutate the current service configs collection
+		for update := range updates {
+			// Mutate the current service configs collection and publish a copy of it, which consumers may read concurrently.
 			newServiceConfigMap, changed := updated(update)
 			if changed {
-				log.Println("[ServiceConfig] Configuration updated.")
-				currentServiceConfigs <- newServiceConfigMap
+				serviceConfigLog.Info("Configuration updated", "service", update.ServiceConfig.Name, "group", update.ServiceConfig.Group)
+				this.state.setServiceConfigs(newServiceConfigMap)
+				published := make(map[string]*ServiceConfig, len(newServiceConfigMap))
+				for name, config := range newServiceConfigMap {
+					published[name] = config
+				}
+				currentServiceConfigs <- published
 			}
 		}
-		log.Println("[ServiceConfig] Exiting.")
-	}()
+		serviceConfigLog.Info("Exiting")
+	})
 
 	return
 }
-func GetServiceConfig(client *etcd.Client, group, name string) (config *ServiceConfig, err error) {
-	response, err := client.Get(GetConfigKey(group, name), false, false)
+func GetServiceConfig(store Store, group, name string) (config *ServiceConfig, err error) {
+	node, err := store.Get(GetConfigKey(group, name))
 	if err != nil {
 		return
 	}
-	config, err = parseServiceConfig(response.Node)
+	config, err = parseServiceConfig(node)
 	if err != nil {
 		return
 	}
 	return
 }
-func getServiceConfigs(client *etcd.Client, serviceConfigs chan *ServiceConfigUpdate) {
-	log.Printf("[ServiceConfig] Pulling all configurations.\n")
-	response, err := client.Get("config/services", false, true)
+func (this *Agent) getServiceConfigs(serviceConfigs chan *ServiceConfigUpdate) {
+	serviceConfigLog.Debug("Pulling all configurations")
+	nodes, err := this.store.List("config/services")
 	if err != nil {
-		log.Printf("[ServiceConfig] Unable to get services: %s.\n", err)
+		serviceConfigLog.Error("Unable to get service configurations", "error", err)
 		return
 	}
-	for _, node := range response.Node.Nodes {
-		r, err := client.Get(node.Key, false, true)
+	for _, node := range nodes {
+		serviceConfig, err := parseServiceConfig(node)
 		if err != nil {
-			log.Printf("[ServiceConfig] Unable to get service configurations: %s.\n", err)
+			serviceConfigLog.Warn("Unable to parse configuration", "key", node.Key, "error", err)
 			continue
 		}
-		for _, iNode := range r.Node.Nodes {
-			serviceConfig, err := parseServiceConfig(&iNode)
-			if err != nil {
-				log.Printf("[ServiceConfig] Unable to parse configuration: %s.\n", err)
-				continue
-			}
 
-			serviceConfigUpdate := new(ServiceConfigUpdate)
-			serviceConfigUpdate.Operation = Add
-			serviceConfigUpdate.ServiceConfig = serviceConfig
-			serviceConfigs <- serviceConfigUpdate
-		}
+		serviceConfigUpdate := new(ServiceConfigUpdate)
+		serviceConfigUpdate.Operation = Add
+		serviceConfigUpdate.ServiceConfig = serviceConfig
+		serviceConfigs <- serviceConfigUpdate
+	}
 
-		// Notify any since interested party that an update occurred.
-		select {
-		case ServiceConfigs.Updated <- true:
-		default:
-		}
+	// Notify any since interested party that an update occurred.
+	select {
+	case this.serviceConfigs.Updated <- true:
+	default:
 	}
-	log.Printf("[ServiceConfig] Pulled configurations.\n")
+	serviceConfigLog.Debug("Pulled configurations")
 }
 
 // Returns a channel of all service configuration updates.
-func serviceConfigUpdates(client *etcd.Client, stop chan bool) (updates chan *ServiceConfigUpdate) {
+func (this *Agent) serviceConfigUpdates(ctx context.Context, wg *sync.WaitGroup) (updates chan *ServiceConfigUpdate) {
 	updates = make(chan *ServiceConfigUpdate)
+	incomingUpdates := this.watchPrefix(ctx, "config/services", wg)
 
-	go func() {
-		getServiceConfigs(client, updates)
-		incomingUpdates := make(chan *etcd.Response)
-		go func() {
-			for {
-				select {
-				case <-stop:
-					break
-				default:
-				}
-				client.Watch("config/services", 0, true, incomingUpdates, stop)
-			}
-		}()
+	goTracked(wg, func() {
+		defer close(updates)
+		this.getServiceConfigs(updates)
 		fullSync := time.NewTicker(FullServiceConfigSyncInterval * time.Second)
+		defer fullSync.Stop()
 		for {
 			select {
-			case <-stop:
-				break
+			case <-ctx.Done():
+				return
 			case <-fullSync.C:
-				getServiceConfigs(client, updates)
+				this.getServiceConfigs(updates)
 			case incomingUpdate := <-incomingUpdates:
 				config, err := parseServiceConfigUpdate(incomingUpdate)
 				if err != nil {
-					log.Printf("[ServiceConfig] Unable to parse update: %s\n", err)
+					serviceConfigLog.Warn("Unable to parse update", "error", err)
 					continue
 				} else {
 					updates <- config
 				}
 			}
 		}
-	}()
+	})
 	return
 }
 
-func parseServiceConfig(node *etcd.Node) (serviceConfig *ServiceConfig, err error) {
+func parseServiceConfig(node *StoreNode) (serviceConfig *ServiceConfig, err error) {
 	if node == nil {
 		err = goerrors.New("Service configuration node missing or node key missing")
 		return
 	}
 
 	keyParts := strings.Split(node.Key, "/")
-	if len(keyParts) < 5 {
+	if len(keyParts) < 4 {
 		err = goerrors.New("Service configuration node key invalid: " + node.Key)
 		return
 	}
 
-	keyParts = keyParts[3:]
+	keyParts = keyParts[2:]
 	serviceConfig = new(ServiceConfig)
 	serviceConfig.Group = keyParts[0]
 	serviceConfig.Name = keyParts[1]
@@ -304,13 +345,13 @@ func parseServiceConfig(node *etcd.Node) (serviceConfig *ServiceConfig, err erro
 }
 
 // Parses a service config from an update response and returns the config.
-func parseServiceConfigUpdate(response *etcd.Response) (update *ServiceConfigUpdate, err error) {
+func parseServiceConfigUpdate(event *StoreEvent) (update *ServiceConfigUpdate, err error) {
 	update = new(ServiceConfigUpdate)
-	update.Operation, err = parseActionToOperation(response.Action)
+	update.Operation, err = parseActionToOperation(event.Action)
 	if err != nil {
 		return
 	}
 
-	update.ServiceConfig, err = parseServiceConfig(response.Node)
+	update.ServiceConfig, err = parseServiceConfig(event.Node)
 	return
 }
@@ -0,0 +1,49 @@
+package daprdockr
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Each published collection of service configs is a copy, so consumers may keep reading it while later updates are
+// applied.
+func TestPublishedServiceConfigsAreCopies(t *testing.T) {
+	store := NewMemoryStore()
+	agent, err := NewAgent(AgentOptions{Store: store, Runtime: NewFakeRuntime(), HostIp: net.ParseIP("10.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	defer wg.Wait()
+	defer cancel()
+	if err = SetServiceConfig(store, newTestServiceConfig(1)); err != nil {
+		t.Fatal(err)
+	}
+	current := agent.currentServiceConfigs(ctx, &wg)
+	receive := func() map[string]*ServiceConfig {
+		select {
+		case configs := <-current:
+			return configs
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for the service configs")
+		}
+		return nil
+	}
+
+	first := receive()
+	other := newTestServiceConfig(1)
+	other.Name = "db"
+	if err = SetServiceConfig(store, other); err != nil {
+		t.Fatal(err)
+	}
+	if second := receive(); len(second) != 2 {
+		t.Fatalf("Expected both services to be published, got %v", second)
+	}
+	if len(first) != 1 {
+		t.Errorf("Expected the first published configs to be unchanged, got %v", first)
+	}
+}
@@ -0,0 +1,139 @@
+// Orderly departure of an agent from the cluster.
+package daprdockr
+
+import (
+	goerrors "errors"
+	"time"
+)
+
+const (
+	HandoffTimeout      = 60 // Seconds to wait for other agents to take over instances.
+	HandoffPollInterval = 1  // Seconds
+)
+
+// Determines what happens to the managed containers when the agent exits.
+type ExitMode string
+
+const (
+	ExitStop    ExitMode = "stop"    // Stop the managed containers.
+	ExitLeave   ExitMode = "leave"   // Leave the managed containers running.
+	ExitHandoff ExitMode = "handoff" // Stop each managed container once another agent has taken over its instance.
+)
+
+var shutdownLog = NewLogger("Shutdown")
+
+func ParseExitMode(mode string) (result ExitMode, err error) {
+	switch result = ExitMode(mode); result {
+	case ExitStop, ExitLeave, ExitHandoff:
+	default:
+		err = goerrors.New("Invalid exit mode: " + mode)
+	}
+	return
+}
+
+// Removes this node's instance records and locks so that other agents can take over its instances, then handles the
+// managed containers according to the exit mode.
+// Must be called after the components have returned, so that heartbeats do not recreate the records.
+func (this *Agent) LeaveCluster(mode ExitMode) (err error) {
+	containers, err := this.runtime.ListContainers()
+	if err != nil {
+		return
+	}
+	local := make([]*Instance, 0, len(containers))
+	processes := make(map[*Instance]bool) // Local instances which run as processes, which the agent cannot leave running.
+	for _, container := range containers {
+		if !containerIsManaged(container.Name, this.zone) {
+			continue
+		}
+		instance, err := this.instanceFromContainer(container)
+		if err != nil {
+			shutdownLog.Warn("Error deriving instance from container", "container", container.ID, "name", container.Name, "error", err)
+			continue
+		}
+		local = append(local, instance)
+		processes[instance] = container.Runtime == RuntimeProcess
+	}
+
+	for _, instance := range local {
+		logger := shutdownLog.WithInstance(instance.Group, instance.Service, instance.Instance)
+		err := removeInstanceFromStore(this.store, instance, 0)
+		if _, conflict := err.(*InstanceConflictError); err != nil && !conflict && !isStoreError(err, StoreKeyNotFound) {
+			logger.Warn("Failed to remove instance record", "error", err)
+		}
+		releaseHeldLock(this.store, instance, "Agent stopped")
+	}
+	shutdownLog.Info("Removed instance records", "instances", len(local), "mode", mode)
+
+	switch mode {
+	case ExitStop:
+		for _, instance := range local {
+			this.stopLocalInstance(instance, "Agent stopped")
+		}
+	case ExitHandoff:
+		this.handoff(local)
+	case ExitLeave:
+		// Processes cannot be adopted by a restarted agent, so they are stopped regardless.
+		left := 0
+		for _, instance := range local {
+			if processes[instance] {
+				this.stopLocalInstance(instance, "Agent stopped")
+			} else {
+				left++
+			}
+		}
+		shutdownLog.Info("Leaving containers running", "containers", left)
+	}
+	return
+}
+
+// Stops each local instance once another agent owns its record, or once the handoff times out.
+func (this *Agent) handoff(local []*Instance) {
+	pending := local
+	deadline := time.Now().Add(HandoffTimeout * time.Second)
+	for len(pending) > 0 {
+		remaining := make([]*Instance, 0, len(pending))
+		for _, instance := range pending {
+			current, err := GetInstance(this.store, instance.Group, instance.Service, instance.Instance)
+			if err == nil && len(current.Owner) > 0 && current.Owner != instance.Owner {
+				this.stopLocalInstance(instance, "Handed off to "+current.Owner)
+			} else {
+				remaining = append(remaining, instance)
+			}
+		}
+		pending = remaining
+
+		if len(pending) > 0 && time.Now().After(deadline) {
+			shutdownLog.Warn("Timed out waiting for other agents to take over instances", "instances", len(pending))
+			for _, instance := range pending {
+				this.stopLocalInstance(instance, "Handoff timed out")
+			}
+			return
+		}
+		if len(pending) > 0 {
+			time.Sleep(HandoffPollInterval * time.Second)
+		}
+	}
+}
+
+func (this *Agent) stopLocalInstance(instance *Instance, reason string) {
+	logger := shutdownLog.WithInstance(instance.Group, instance.Service, instance.Instance)
+	config := &ServiceConfig{ServiceIdentifier: ServiceIdentifier{Name: instance.Service, Group: instance.Group}}
+	if err := this.removeContainer(config, instance.Instance); err != nil {
+		logger.Warn("Failed to stop instance", "error", err)
+		return
+	}
+	this.metrics.containerRemovals.Inc(instance.Service, instance.Group)
+	logger.Info("Stopped instance", "reason", reason)
+	journal(this.store, this.newInstanceEvent(InstanceRemoved, instance.Group, instance.Service, instance.Instance, reason))
+}
+
+// Releases the lock on a local instance if this node still holds it, so that other agents need not wait for it to expire.
+func releaseHeldLock(store Store, instance *Instance, reason string) {
+	lock, err := GetInstanceLock(store, instance.Group, instance.Service, instance.Instance)
+	if err != nil || lock.Released || lock.Node != instance.Owner {
+		return
+	}
+	if err = ReleaseInstanceLock(store, lock, reason); err != nil {
+		shutdownLog.WithInstance(instance.Group, instance.Service, instance.Instance).Warn("Failed to release lock", "error", err)
+	}
+}
@@ -0,0 +1,150 @@
+// Key-value store which holds the cluster's configuration and state.
+package daprdockr
+
+import (
+	"context"
+	goerrors "errors"
+	"github.com/coreos/go-etcd/etcd"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"sync"
+	"time"
+)
+
+const (
+	EtcdDialTimeout = 5 // Seconds
+)
+
+// A value in the store.
+type StoreNode struct {
+	Key   string // The key relative to the root of the store, without a leading slash, eg: "instances/web/api/0".
+	Value string
+	Index uint64 // The store index at which the value was last modified.
+}
+
+type StoreAction string
+
+const (
+	StoreSet    StoreAction = "set"    // The value was created or replaced.
+	StoreDelete StoreAction = "delete" // The value was deleted.
+	StoreExpire StoreAction = "expire" // The value's time to live elapsed.
+)
+
+// A change to a value in the store, as reported to watchers.
+type StoreEvent struct {
+	Action   StoreAction
+	Node     *StoreNode // The new value, or the removed key for deletions and expiries.
+	PrevNode *StoreNode // The previous value, if known.
+}
+
+// A store with etcd v2 semantics. Keys are slash-separated paths without a leading slash.
+// Times to live are in seconds, and zero means that the value does not expire.
+type Store interface {
+	// Gets the value of a key.
+	Get(key string) (node *StoreNode, err error)
+
+	// Gets all values under the prefix, at any depth. Returns no values if the prefix does not exist.
+	List(prefix string) (nodes []*StoreNode, err error)
+
+	// Sets the value of a key, returning the index of the new value.
+	Set(key, value string, ttl uint64) (index uint64, err error)
+
+	// Sets the value of a key which does not exist, returning the index of the new value.
+	Create(key, value string, ttl uint64) (index uint64, err error)
+
+	// Sets the value of a key which was last modified at the provided index, returning the index of the new value.
+	CompareAndSwap(key, value string, ttl uint64, prevIndex uint64) (index uint64, err error)
+
+	// Deletes a key which was last modified at the provided index.
+	CompareAndDelete(key string, prevIndex uint64) (err error)
+
+	// Deletes a key.
+	Delete(key string) (err error)
+
+	// Sends changes to keys under the prefix to the receiver until the stop channel is closed, in which case
+	// nil is returned, or until the watch fails. Changes made while no watch is established are not reported.
+	Watch(prefix string, receiver chan *StoreEvent, stop chan bool) (err error)
+}
+
+type StoreErrorCode int
+
+const (
+	StoreKeyNotFound StoreErrorCode = iota + 1
+	StoreTestFailed                 // The value was modified since the provided index.
+	StoreNodeExists
+)
+
+// An error which a store reports for a key.
+type StoreError struct {
+	Code    StoreErrorCode
+	Key     string
+	Message string
+}
+
+func (this *StoreError) Error() string {
+	return this.Message + ": " + this.Key
+}
+
+// Determines whether the error is a store error with the provided code.
+func isStoreError(err error, code StoreErrorCode) bool {
+	storeErr, ok := err.(*StoreError)
+	return ok && storeErr != nil && storeErr.Code == code
+}
+
+// Connects to etcd using the provided API version, either "v2" or "v3".
+// The returned function closes the connection, releasing any lease which the store holds.
+func ConnectEtcdStore(api string, endpoints []string) (store Store, closeStore func(), err error) {
+	switch api {
+	case "", "v2":
+		return NewEtcdStore(etcd.NewClient(endpoints)), func() {}, nil
+	case "v3":
+		client, err := clientv3.New(clientv3.Config{Endpoints: endpoints, DialTimeout: EtcdDialTimeout * time.Second})
+		if err != nil {
+			return nil, nil, err
+		}
+		v3Store := NewEtcdV3Store(client)
+		closeStore = func() {
+			v3Store.Close()
+			client.Close()
+		}
+		return v3Store, closeStore, nil
+	}
+	return nil, nil, goerrors.New("Invalid etcd API version: " + api)
+}
+
+// Watches a prefix in the store, re-establishing the watch until the context is done.
+// The goroutines are tracked by the wait group.
+func (this *Agent) watchPrefix(ctx context.Context, prefix string, wg *sync.WaitGroup) (updates chan *StoreEvent) {
+	updates = make(chan *StoreEvent)
+	received := make(chan *StoreEvent)
+	watching := make(chan bool)
+	stop := stopChannel(ctx, wg)
+
+	goTracked(wg, func() {
+		defer close(watching)
+		for {
+			this.store.Watch(prefix, received, stop)
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+			this.metrics.etcdWatchReconnects.Inc(prefix)
+		}
+	})
+
+	goTracked(wg, func() {
+		for {
+			select {
+			case <-watching:
+				return
+			case event := <-received:
+				select {
+				case updates <- event:
+				case <-ctx.Done():
+					// Discard events until the watch stops, so that it is not blocked.
+				}
+			}
+		}
+	})
+	return
+}
@@ -3,6 +3,7 @@ usage() {
 	echo <<DELIM "Echo public IP of a running service.
 Usage:
 	$0 {instance}.{service}.{group} [nameserver]
+Set ZONE to the cluster's DNS zone if it is not \"container\".
 Example:
 	$0 2.web.gulaghypercloud"
 DELIM
@@ -14,4 +15,4 @@ DELIM
 INSTANCE=${1} # Instance must be specified, in the form '<instance>.<service>.<group>'.
 NAMESERVER=${2+'@'$2} # Use default nameserver if not specified.
 
-dig ${NAMESERVER} ${INSTANCE}.container +short A
\ No newline at end of file
+dig ${NAMESERVER} ${INSTANCE}.${ZONE:-container} +short A
\ No newline at end of file
@@ -3,6 +3,7 @@ usage() {
 	echo <<DELIM "Echo public port of a running service.
 Usage:
 	$0 {instance}.{service}.{group} {internal port} [nameserver]
+Set ZONE to the cluster's DNS zone if it is not \"container\".
 Example:
 	$0 2.web.gulaghypercloud 8080"
 DELIM
@@ -15,4 +16,4 @@ INSTANCE=${1} # Instance must be specified, in the form '<instance>.<service>.<g
 PORT=${2} # Port must be specified
 NAMESERVER=${3+'@'$3} # Use default nameserver if not specified.
 
-dig ${NAMESERVER} ${PORT}.tcp.${INSTANCE}.container +short SRV | cut -d" " -f3
\ No newline at end of file
+dig ${NAMESERVER} ${PORT}.tcp.${INSTANCE}.${ZONE:-container} +short SRV | cut -d" " -f3
\ No newline at end of file
@@ -1,16 +1,20 @@
 package daprdockr
 
 import (
-	"log"
+	"context"
+	"strconv"
 	"time"
 )
 
 var RequiredStateChangeRetry = time.Second * 15
 
+var workFinderLog = NewLogger("WorkFinder")
+
 type RequiredStateChange struct {
 	ServiceConfig *ServiceConfig
 	Operation     Operation
 	Instance      int
+	Reason        string
 }
 
 type ServiceState struct {
@@ -18,90 +22,120 @@ type ServiceState struct {
 	Instances []*Instance
 }
 
-func RequiredStateChanges(instances chan map[string]*Instance, serviceConfigs chan map[string]*ServiceConfig, stop chan bool) (changes chan map[string]*RequiredStateChange) {
-	changes = make(chan map[string]*RequiredStateChange)
-	go func() {
-		defer close(changes)
-		desired := make(map[string]*ServiceConfig)
-		current := make(map[string]*Instance)
+// Determines the changes required to bring the current instances in line with the service configurations, and sends
+// them to the changes channel until the context is done or either input is closed. Closes the changes channel on exit.
+func (this *Agent) RequiredStateChanges(ctx context.Context, instances chan map[string]*Instance, serviceConfigs chan map[string]*ServiceConfig, changes chan map[string]*RequiredStateChange) (err error) {
+	defer close(changes)
+	desired := make(map[string]*ServiceConfig)
+	current := make(map[string]*Instance)
 
-		instancesValid, configsValid := false, false
+	instancesValid, configsValid := false, false
 
-		for {
-			// Wait for a state change or exit condition.
-			select {
-			case newServiceConfigs, ok := <-serviceConfigs:
-				if !ok {
-					break
-				}
-				desired = newServiceConfigs
-			case newInstances, ok := <-instances:
-				if !ok {
-					break
-				}
-				current = newInstances
-			case _, _ = <-stop:
-				break
-			case _ = <-time.After(RequiredStateChangeRetry):
+	// Removals which have already been journaled.
+	journaled := make(map[string]bool)
+
+find:
+	for {
+		// Wait for a state change or exit condition.
+		select {
+		case newServiceConfigs, ok := <-serviceConfigs:
+			if !ok {
+				break find
 			}
-			if !instancesValid {
-				log.Printf("[WorkFinder] Waiting for full instance status update before creating work.\n")
-				<-Instances.Updated
-				instancesValid = true
-				continue
+			desired = newServiceConfigs
+		case newInstances, ok := <-instances:
+			if !ok {
+				break find
 			}
-			if !configsValid {
-				log.Printf("[WorkFinder] Waiting for full configuration update before creating work.\n")
-				<-ServiceConfigs.Updated
-				configsValid = true
-				continue
+			current = newInstances
+		case <-ctx.Done():
+			break find
+		case _ = <-time.After(RequiredStateChangeRetry):
+		}
+		if !instancesValid {
+			workFinderLog.Info("Waiting for full instance status update before creating work")
+			select {
+			case <-this.instances.Updated:
+			case <-ctx.Done():
+				break find
+			}
+			instancesValid = true
+			continue
+		}
+		if !configsValid {
+			workFinderLog.Info("Waiting for full configuration update before creating work")
+			select {
+			case <-this.serviceConfigs.Updated:
+			case <-ctx.Done():
+				break find
 			}
+			configsValid = true
+			continue
+		}
 
-			// Find the delta between desired and current state.
-			delta := make(map[string]*RequiredStateChange)
+		// Find the delta between desired and current state.
+		delta := make(map[string]*RequiredStateChange)
 
-			// Check for additions and modifications.
-			for _, serviceConfig := range desired {
-				for i := 0; i < serviceConfig.Instances; i++ {
-					key := serviceConfig.InstanceQualifiedName(i)
-					if _ /*instance*/, exists := current[key]; !exists {
-						change := new(RequiredStateChange)
-						change.ServiceConfig = serviceConfig
-						change.Instance = i
-						change.Operation = Add
-						delta[key] = change
-						log.Printf("[WorkFinder] Need to start %s.\n", key)
-					} else {
-						// ToDo: Check that instance matches the service config - easiest thing to do is delete the instance
-						// and wait for it to be re-added. Ensure good monitoring for equality issues.
-					}
+		// Check for additions and modifications.
+		for _, serviceConfig := range desired {
+			for i := 0; i < serviceConfig.Instances; i++ {
+				key := serviceConfig.InstanceQualifiedName(i)
+				if _ /*instance*/, exists := current[key]; !exists {
+					change := new(RequiredStateChange)
+					change.ServiceConfig = serviceConfig
+					change.Instance = i
+					change.Operation = Add
+					change.Reason = "Instance is not running"
+					delta[key] = change
+					workFinderLog.WithInstance(serviceConfig.Group, serviceConfig.Name, i).Info("Need to start instance")
+				} else {
+					// ToDo: Check that instance matches the service config - easiest thing to do is delete the instance
+					// and wait for it to be re-added. Ensure good monitoring for equality issues.
 				}
 			}
+		}
 
-			// Check for deletions.
-			for _, instance := range current {
-				serviceKey := instance.Service + "." + instance.Group
-				if serviceConfig, exists := desired[serviceKey]; !exists || serviceConfig.Instances <= instance.Instance {
-					key := serviceConfig.InstanceQualifiedName(instance.Instance)
-					// This instance must be deleted.
-					change := new(RequiredStateChange)
-					change.ServiceConfig = new(ServiceConfig)
-					change.ServiceConfig.Name = instance.Service
-					change.ServiceConfig.Group = instance.Group
-					change.Instance = instance.Instance
-					change.Operation = Remove
-					delta[key] = change
-					log.Printf("[WorkFinder] Need to remove %s.\n", key)
+		// Check for deletions.
+		removals := make(map[string]bool)
+		for _, instance := range current {
+			serviceKey := instance.Service + "." + instance.Group
+			if serviceConfig, exists := desired[serviceKey]; !exists || serviceConfig.Instances <= instance.Instance {
+				// This instance must be deleted.
+				change := new(RequiredStateChange)
+				change.ServiceConfig = new(ServiceConfig)
+				change.ServiceConfig.Name = instance.Service
+				change.ServiceConfig.Group = instance.Group
+				change.Instance = instance.Instance
+				change.Operation = Remove
+				if !exists {
+					change.Reason = "Service configuration removed"
+				} else {
+					change.Reason = "Service scaled down to " + strconv.Itoa(serviceConfig.Instances) + " instances"
+				}
+				key := change.ServiceConfig.InstanceQualifiedName(instance.Instance)
+				delta[key] = change
+				workFinderLog.WithInstance(instance.Group, instance.Service, instance.Instance).Info("Need to remove instance", "reason", change.Reason)
+
+				// Each removal is journaled once, by the node which owns the instance.
+				removals[key] = true
+				if !journaled[key] && instance.Owner == this.nodeId {
+					journal(this.store, this.newInstanceEvent(InstanceRemovalRequired, instance.Group, instance.Service, instance.Instance, change.Reason))
 				}
 			}
+		}
+		journaled = removals
 
-			if len(delta) > 0 {
-				changes <- delta
-			} else {
-				log.Println("[WorkFinder] All services seem healthy, no work posted.")
+		this.state.setRequiredChanges(delta)
+		if len(delta) > 0 {
+			select {
+			case changes <- delta:
+			case <-ctx.Done():
+				break find
 			}
+		} else {
+			workFinderLog.Debug("All services seem healthy, no work posted")
 		}
-		log.Printf("[WorkFinder] Exiting.\n")
-	}()
+	}
+	workFinderLog.Info("Exiting")
 	return
 }
@@ -0,0 +1,163 @@
+package daprdockr
+
+import (
+	"context"
+	"github.com/dotcloud/docker"
+	"net"
+	"sort"
+	"testing"
+	"time"
+)
+
+// Creates an agent which runs its instances in memory. Heartbeats are discarded, as instance updates are not processed.
+func newTestAgent(t *testing.T, store Store, runtime Runtime, node string) *Agent {
+	agent, err := NewAgent(AgentOptions{Store: store, Runtime: runtime, HostIp: net.ParseIP("10.0.0.1"), NodeId: node})
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(agent.instances.start())
+	return agent
+}
+
+func newTestServiceConfig(instances int) *ServiceConfig {
+	return &ServiceConfig{
+		ServiceIdentifier: ServiceIdentifier{Name: "api", Group: "web"},
+		Instances:         instances,
+		Container:         docker.Config{Image: "nginx", ExposedPorts: map[docker.Port]struct{}{"80/tcp": {}}},
+	}
+}
+
+// Returns the first changes which the work finder requires for the instances and service configurations.
+func findChanges(t *testing.T, agent *Agent, instances map[string]*Instance, configs map[string]*ServiceConfig) (delta map[string]*RequiredStateChange) {
+	defer func(retry time.Duration) { RequiredStateChangeRetry = retry }(RequiredStateChangeRetry)
+	RequiredStateChangeRetry = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	instanceUpdates := make(chan map[string]*Instance, 1)
+	configUpdates := make(chan map[string]*ServiceConfig, 1)
+	changes := make(chan map[string]*RequiredStateChange)
+	instanceUpdates <- instances
+	configUpdates <- configs
+	agent.instances.Updated <- true
+	agent.serviceConfigs.Updated <- true
+	go agent.RequiredStateChanges(ctx, instanceUpdates, configUpdates, changes)
+
+	select {
+	case delta = <-changes:
+	case <-time.After(5 * time.Second):
+		t.Error("Timed out waiting for changes")
+	}
+	cancel()
+	for range changes {
+		// Wait for the work finder to exit.
+	}
+	return
+}
+
+func TestRequiredStateChanges(t *testing.T) {
+	tests := []struct {
+		name      string
+		running   int // Instances of the service which are running.
+		instances int // Instances which the configuration requires, or -1 if the service is removed.
+		adds      []string
+		removes   []string
+		reason    string
+	}{
+		{name: "service added", running: 0, instances: 2, adds: []string{"0.api.web", "1.api.web"}, reason: "Instance is not running"},
+		{name: "service scaled up", running: 1, instances: 3, adds: []string{"1.api.web", "2.api.web"}, reason: "Instance is not running"},
+		{name: "service scaled down", running: 3, instances: 1, removes: []string{"1.api.web", "2.api.web"}, reason: "Service scaled down to 1 instances"},
+		{name: "service removed", running: 2, instances: -1, removes: []string{"0.api.web", "1.api.web"}, reason: "Service configuration removed"},
+	}
+	for _, test := range tests {
+		store, runtime := NewMemoryStore(), NewFakeRuntime()
+		agent := newTestAgent(t, store, runtime, "node-1")
+
+		// Start the running instances as the runner would.
+		start := make(map[string]*RequiredStateChange)
+		for i := 0; i < test.running; i++ {
+			start[newTestServiceConfig(test.running).InstanceQualifiedName(i)] = &RequiredStateChange{ServiceConfig: newTestServiceConfig(test.running), Instance: i, Operation: Add}
+		}
+		if err := applyChanges(agent, start); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		current := make(map[string]*Instance)
+		for i := 0; i < test.running; i++ {
+			instance, err := GetInstance(store, "web", "api", i)
+			if err != nil {
+				t.Fatalf("%s: instance %d was not recorded: %s", test.name, i, err)
+			}
+			current[instance.QualifiedName()] = instance
+		}
+		configs := make(map[string]*ServiceConfig)
+		if test.instances >= 0 {
+			config := newTestServiceConfig(test.instances)
+			configs[config.QualifiedName()] = config
+		}
+
+		delta := findChanges(t, agent, current, configs)
+		var adds, removes []string
+		for key, change := range delta {
+			if change.Reason != test.reason {
+				t.Errorf("%s: expected %s to be required because %q, got %q", test.name, key, test.reason, change.Reason)
+			}
+			if change.Operation == Add {
+				adds = append(adds, key)
+			} else {
+				removes = append(removes, key)
+			}
+		}
+		sort.Strings(adds)
+		sort.Strings(removes)
+		if !equalStrings(adds, test.adds) || !equalStrings(removes, test.removes) {
+			t.Errorf("%s: expected adds %v and removes %v, got %v and %v", test.name, test.adds, test.removes, adds, removes)
+			continue
+		}
+
+		// Apply the changes, then check the records which they leave.
+		if err := applyChanges(agent, delta); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		for _, key := range test.adds {
+			group, service, i, _ := ParseInstanceQualifiedName(key, agent.Zone())
+			instance, err := GetInstance(store, group, service, i)
+			if err != nil || instance.Owner != "node-1" || len(instance.PortMappings["80"]) == 0 {
+				t.Errorf("%s: expected %s to be recorded as owned by node-1 with its port, got %+v, %v", test.name, key, instance, err)
+			}
+			lock, err := GetInstanceLock(store, group, service, i)
+			if err != nil || lock.Node != "node-1" || lock.Released {
+				t.Errorf("%s: expected the lock on %s to be kept once started, got %+v, %v", test.name, key, lock, err)
+			}
+		}
+		for _, key := range test.removes {
+			group, service, i, _ := ParseInstanceQualifiedName(key, agent.Zone())
+			if _, err := runtime.InspectContainer(key + "." + agent.Zone()); err == nil {
+				t.Errorf("%s: expected the container of %s to be removed", test.name, key)
+			}
+			events, _ := GetEvents(store, group, service, i)
+			if !hasEvent(events, InstanceRemovalRequired) || !hasEvent(events, InstanceRemoved) {
+				t.Errorf("%s: expected the removal of %s to be journaled, got %v", test.name, key, events)
+			}
+		}
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func hasEvent(events []*Event, eventType EventType) bool {
+	for _, event := range events {
+		if event.Type == eventType {
+			return true
+		}
+	}
+	return false
+}